@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reliable messages carry an ackId that the client echoes back in an "ack"
+// message. Recipients that haven't acked within ACK_TIMEOUT get the message
+// once more; after another timeout they're counted as lost.
+var ackTimeout = positiveDuration(getEnvDuration("ACK_TIMEOUT", 5*time.Second), 5*time.Second)
+
+// Deliveries kept for /admin/acks, oldest dropped first
+const deliveryHistory = 100
+
+// Delivery tracks who received a reliable message
+type Delivery struct {
+	AckID   uint64 `json:"ackId"`
+	Type    string `json:"type"`
+	Sent    int    `json:"sent"`
+	Acked   int    `json:"acked"`
+	Retried int    `json:"retried"`
+	Lost    int    `json:"lost"`
+}
+
+type pendingAck struct {
+	player  *Player
+	msg     WSMessage
+	retried bool
+}
+
+var (
+	ackCounter    atomic.Uint64
+	pendingAcks   = make(map[uint64]map[uint64]*pendingAck) // ackId -> player ID -> pending
+	deliveries    = make(map[uint64]*Delivery)
+	deliveryOrder []uint64
+	acksMu        sync.Mutex
+)
+
+// sendReliable sends msg to each player with a fresh ackId and tracks the
+// acks; it returns the ackId and how many players it was sent to
+func sendReliable(list []*Player, msg WSMessage) (uint64, int) {
+	ackID := ackCounter.Add(1)
+	msg.AckID = flexID(ackID)
+	waiting := make(map[uint64]*pendingAck)
+	var failed []*Player
+	for _, player := range list {
+		if err := player.Send(msg); err != nil {
+			if player.writeFailed(err) {
+				failed = append(failed, player)
+			}
+			continue
+		}
+		waiting[player.ID] = &pendingAck{player: player, msg: msg}
+	}
+
+	acksMu.Lock()
+	pendingAcks[ackID] = waiting
+	deliveries[ackID] = &Delivery{AckID: ackID, Type: msg.Type, Sent: len(waiting)}
+	deliveryOrder = append(deliveryOrder, ackID)
+	if len(deliveryOrder) > deliveryHistory {
+		delete(deliveries, deliveryOrder[0])
+		deliveryOrder = deliveryOrder[1:]
+	}
+	acksMu.Unlock()
+
+	afterFunc(ackTimeout, func() { retryUnacked(ackID) })
+	disconnectPlayers(failed, leaveError)
+	return ackID, len(waiting)
+}
+
+// retryUnacked resends to recipients that haven't acked yet, or gives up
+// on them if they already had their retry
+func retryUnacked(ackID uint64) {
+	acksMu.Lock()
+	defer acksMu.Unlock()
+	waiting := pendingAcks[ackID]
+	if len(waiting) == 0 {
+		delete(pendingAcks, ackID)
+		return
+	}
+	d := deliveries[ackID]
+
+	retrying := false
+	for id, pending := range waiting {
+		if pending.retried || pending.player.Send(pending.msg) != nil {
+			delete(waiting, id)
+			if d != nil {
+				d.Lost++
+			}
+			continue
+		}
+		pending.retried = true
+		retrying = true
+		if d != nil {
+			d.Retried++
+		}
+	}
+	if retrying {
+		afterFunc(ackTimeout, func() { retryUnacked(ackID) })
+	} else {
+		delete(pendingAcks, ackID)
+	}
+}
+
+// handleAck marks a reliable message as delivered to player
+func handleAck(player *Player, ackID uint64) {
+	acksMu.Lock()
+	defer acksMu.Unlock()
+	waiting := pendingAcks[ackID]
+	if _, ok := waiting[player.ID]; !ok {
+		return // unknown, duplicate or too late
+	}
+	delete(waiting, player.ID)
+	if d := deliveries[ackID]; d != nil {
+		d.Acked++
+	}
+}
+
+func validateAck(msg *WSMessage) error {
+	if msg.AckID == 0 {
+		return errors.New("ack: missing ackId")
+	}
+	return nil
+}
+
+// acksHandler reports delivery of a reliable message (?id=ackId), or of
+// all recent ones
+func acksHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, scopeRead) {
+		return
+	}
+
+	acksMu.Lock()
+	defer acksMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if idParam := r.URL.Query().Get("id"); idParam != "" {
+		id, err := strconv.ParseUint(idParam, 10, 64)
+		if err != nil {
+			apiError(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		d, ok := deliveries[id]
+		if !ok {
+			apiError(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+		return
+	}
+
+	list := make([]*Delivery, 0, len(deliveryOrder))
+	for i := len(deliveryOrder) - 1; i >= 0; i-- {
+		list = append(list, deliveries[deliveryOrder[i]])
+	}
+	json.NewEncoder(w).Encode(list)
+}
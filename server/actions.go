@@ -0,0 +1,25 @@
+package main
+
+import "fmt"
+
+// Input actions are discrete events (a jump, a wave) that animations need
+// but positions don't reveal. Only actions from INPUT_ACTIONS are relayed.
+var allowedActions = parseReactions(getEnv("INPUT_ACTIONS", "jump,wave,interact"))
+
+func validateInput(msg *WSMessage) error {
+	if !allowedActions[msg.Action] {
+		return fmt.Errorf("input: action %q not allowed", msg.Action)
+	}
+	return nil
+}
+
+// handleInput relays an input action to the nearby players in the room as
+// playerAction, tagged with the sender's ID and current position
+func handleInput(p *Player, action string) {
+	p.stateMu.Lock()
+	p.markActive()
+	pos := Position{X: p.state.X, Y: p.state.Y, Z: p.state.Z}
+	p.stateMu.Unlock()
+
+	sendAll(playersNear(p, pos), WSMessage{Type: "playerAction", ID: p.ID, Action: action, Position: &pos})
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Admin scopes, each granting a group of admin endpoints
+const (
+	scopeRead     = "read"     // metrics, players, builds, audit, acks
+	scopeAnnounce = "announce" // announcements
+	scopeKick     = "kick"     // kicking and recoloring players
+	scopeDeploy   = "deploy"   // rebuilds
+	scopeOps      = "ops"      // drain, maintenance, peak reset
+	scopeAll      = "*"
+)
+
+// AdminToken is an operator's credential. The label names the operator in
+// the audit log.
+type AdminToken struct {
+	Label  string   `json:"label"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+func (t *AdminToken) allows(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, scopeAll)
+}
+
+// Admin tokens come from ADMIN_TOKEN (label "admin", all scopes),
+// ADMIN_TOKENS as comma-separated label:token:scope|scope entries, and
+// ADMIN_TOKENS_FILE, a JSON list of AdminToken. Admin endpoints are
+// disabled entirely when none are set.
+var adminTokens = loadAdminTokens()
+
+func loadAdminTokens() []AdminToken {
+	var tokens []AdminToken
+	if adminToken != "" {
+		tokens = append(tokens, AdminToken{Label: "admin", Token: adminToken, Scopes: []string{scopeAll}})
+	}
+
+	for i, entry := range strings.Split(os.Getenv("ADMIN_TOKENS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			// by position only, since a malformed entry may be just the token
+			log.Printf("Ignoring invalid ADMIN_TOKENS entry #%d", i+1)
+			continue
+		}
+		tokens = append(tokens, AdminToken{Label: parts[0], Token: parts[1], Scopes: strings.Split(parts[2], "|")})
+	}
+
+	if file := os.Getenv("ADMIN_TOKENS_FILE"); file != "" {
+		var fromFile []AdminToken
+		data, err := os.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, &fromFile)
+		}
+		if err != nil {
+			log.Printf("Failed to load %s: %v", file, err)
+		}
+		for _, t := range fromFile {
+			if t.Label == "" || t.Token == "" {
+				log.Printf("Ignoring admin token without label or token in %s", file)
+				continue
+			}
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// lookupAdmin returns the admin token the request's bearer token matches,
+// or nil. Every token is compared, in constant time, so timing doesn't
+// reveal which one was close.
+func lookupAdmin(r *http.Request) *AdminToken {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token, ok = dashboardToken(r)
+	}
+	if !ok || token == "" {
+		return nil
+	}
+	var match *AdminToken
+	for i := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminTokens[i].Token)) == 1 {
+			match = &adminTokens[i]
+		}
+	}
+	return match
+}
+
+// APIError is the body of /admin and /api error responses
+type APIError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// JSON_ERRORS=false reverts /admin and /api errors to plain text
+var jsonErrors = getEnvBool("JSON_ERRORS", true)
+
+// apiError replies with status and message, coded after the status text,
+// e.g. 405 is "method_not_allowed"
+func apiError(w http.ResponseWriter, message string, status int) {
+	if !jsonErrors {
+		http.Error(w, message, status)
+		return
+	}
+	var body APIError
+	body.Error.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	body.Error.Message = message
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// dashboardToken returns the token from Basic auth, the dashboard's
+// sign-in (any user name). Browsers resend Basic credentials on their own,
+// even from other sites' forms, so beyond reads they only count with the
+// dashboard's X-Requested-With header, which cross-site requests can't set.
+// WebSocket upgrades aren't reads here: any site may open one.
+func dashboardToken(r *http.Request) (string, bool) {
+	_, token, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	safe := (r.Method == http.MethodGet || r.Method == http.MethodHead) && !websocket.IsWebSocketUpgrade(r)
+	if !safe && r.Header.Get("X-Requested-With") != "dashboard" {
+		return "", false
+	}
+	return token, true
+}
+
+// requireAdmin checks the request's admin token for scope, replying 401
+// for no valid token and 403 for one without the scope
+func requireAdmin(w http.ResponseWriter, r *http.Request, scope string) bool {
+	t := lookupAdmin(r)
+	if t == nil {
+		apiError(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !t.allows(scope) {
+		apiError(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Announcement is an operator banner pushed to every connected player
+type Announcement struct {
+	Text    string
+	Level   string
+	Sent    time.Time
+	Expires time.Time
+}
+
+// Announcements replayed to new joiners, oldest first. By default only the
+// latest is kept, while its ttlSeconds lasts; one without a TTL clears it.
+// ANNOUNCE_HISTORY keeps the last that many instead, each for its TTL or
+// else ANNOUNCE_RETENTION, so joiners get recent context, as chat does
+// per room (see CHAT_HISTORY).
+var (
+	announceHistory   = max(getEnvInt("ANNOUNCE_HISTORY", 0), 0)
+	announceRetention = positiveDuration(getEnvDuration("ANNOUNCE_RETENTION", time.Hour), time.Hour)
+	announcements     []Announcement
+	announceMu        sync.Mutex
+)
+
+// keepAnnouncement records a for new joiners per ANNOUNCE_HISTORY
+func keepAnnouncement(a Announcement, ttl time.Duration) {
+	announceMu.Lock()
+	defer announceMu.Unlock()
+	if announceHistory == 0 {
+		announcements = nil
+		if ttl > 0 {
+			a.Expires = a.Sent.Add(ttl)
+			announcements = []Announcement{a}
+		}
+		return
+	}
+	if ttl <= 0 {
+		ttl = announceRetention
+	}
+	a.Expires = a.Sent.Add(ttl)
+	kept := append(unexpiredAnnouncements(a.Sent), a)
+	// copied so the evicted ones don't linger in the backing array
+	announcements = slices.Clone(kept[max(len(kept)-announceHistory, 0):])
+}
+
+// unexpiredAnnouncements drops expired announcements; callers hold announceMu
+func unexpiredAnnouncements(now time.Time) []Announcement {
+	return slices.DeleteFunc(announcements, func(a Announcement) bool {
+		return now.After(a.Expires)
+	})
+}
+
+// currentAnnouncements returns the announcements to replay to a new joiner
+func currentAnnouncements() []Announcement {
+	announceMu.Lock()
+	defer announceMu.Unlock()
+	announcements = unexpiredAnnouncements(time.Now())
+	return slices.Clone(announcements)
+}
+
+func announceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r, scopeAnnounce) {
+		return
+	}
+
+	var req struct {
+		Text  string `json:"text"`
+		Level string `json:"level"`
+		// TTLSeconds keeps the announcement around for new joiners (0 = live only)
+		TTLSeconds int `json:"ttlSeconds"`
+		// Ack asks clients to acknowledge it; unacked players get one retry
+		Ack bool `json:"ack"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Text == "" {
+		apiError(w, "Missing text", http.StatusBadRequest)
+		return
+	}
+	if req.Level == "" {
+		req.Level = "info"
+	}
+	if req.Level != "info" && req.Level != "warn" {
+		apiError(w, "Invalid level", http.StatusBadRequest)
+		return
+	}
+
+	keepAnnouncement(Announcement{Text: req.Text, Level: req.Level, Sent: time.Now()}, time.Duration(req.TTLSeconds)*time.Second)
+
+	audit(r, "announce", req.Text)
+	msg := WSMessage{Type: "announcement", Text: req.Text, Level: req.Level}
+	if req.Ack {
+		ackID, sent := sendReliable(connectedPlayers(), msg)
+		log.Printf("Announcement (%s, ack %d) sent to %d players: %s", req.Level, ackID, sent, req.Text)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			AckID uint64 `json:"ackId"`
+			Sent  int    `json:"sent"`
+		}{ackID, sent})
+		return
+	}
+
+	sent := broadcast(msg)
+	log.Printf("Announcement (%s) sent to %d players: %s", req.Level, sent, req.Text)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
+
+func colorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r, scopeKick) {
+		return
+	}
+
+	var req struct {
+		ID       uint64  `json:"id"`
+		ColorHue float64 `json:"colorHue"`
+		// TransitionMs overrides COLOR_TRANSITION for this change
+		TransitionMs *int64 `json:"transitionMs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.ColorHue < 0 || req.ColorHue >= 360 {
+		apiError(w, "Invalid colorHue", http.StatusBadRequest)
+		return
+	}
+
+	transition := colorTransition
+	if req.TransitionMs != nil {
+		if *req.TransitionMs < 0 {
+			apiError(w, "Invalid transitionMs", http.StatusBadRequest)
+			return
+		}
+		transition = time.Duration(*req.TransitionMs) * time.Millisecond
+	}
+
+	found := findPlayers(req.ID)
+	if len(found) == 0 {
+		apiError(w, "Player not found", http.StatusNotFound)
+		return
+	}
+	for _, player := range found {
+		setPlayerColor(player, req.ColorHue, transition)
+	}
+	log.Printf("Player %d recolored to %.1f", req.ID, req.ColorHue)
+	audit(r, "color", strconv.FormatUint(req.ID, 10))
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
+
+func kickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r, scopeKick) {
+		return
+	}
+
+	var req struct {
+		ID uint64 `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	found := findPlayers(req.ID)
+	if len(found) == 0 {
+		apiError(w, "Player not found", http.StatusNotFound)
+		return
+	}
+	for _, player := range found {
+		closeWithReason(player.conn, websocket.ClosePolicyViolation, leaveKicked)
+	}
+	disconnectPlayers(found, leaveKicked)
+	log.Printf("Player %d kicked", req.ID)
+	audit(r, "kick", strconv.FormatUint(req.ID, 10))
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
+
+// PlayerInfo is the admin view of a connected player
+type PlayerInfo struct {
+	ID            uint64      `json:"id"`
+	ColorHue      float64     `json:"colorHue"`
+	State         PlayerState `json:"state"`
+	BytesSent     uint64      `json:"bytesSent"`
+	BytesReceived uint64      `json:"bytesReceived"`
+	Team          string      `json:"team,omitempty"`
+	StateCount    int         `json:"stateCount"`
+	LastPing      time.Time   `json:"lastPing"`
+	LastActive    time.Time   `json:"lastActive"`
+	Queued        int         `json:"queued"` // frames waiting in the send queue
+	RTTMs         int64       `json:"rttMs,omitempty"`
+}
+
+func playerInfo(p *Player) PlayerInfo {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	return PlayerInfo{
+		ID:            p.ID,
+		ColorHue:      p.ColorHue,
+		State:         p.state,
+		BytesSent:     p.bytesSent.Load(),
+		BytesReceived: p.bytesReceived.Load(),
+		Team:          p.Team,
+		StateCount:    p.stateCount,
+		LastPing:      p.lastPing,
+		LastActive:    p.lastActive,
+		Queued:        len(p.send),
+		RTTMs:         time.Duration(p.rtt.Load()).Milliseconds(),
+	}
+}
+
+func playersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, scopeRead) {
+		return
+	}
+	list := connectedPlayers()
+	infos := make([]PlayerInfo, 0, len(list))
+	for _, player := range list {
+		infos = append(infos, playerInfo(player))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// playerHandler returns one connected player by ID, for debugging an avatar
+func playerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, scopeRead) {
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiError(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	found := findPlayers(id)
+	if len(found) == 0 {
+		apiError(w, "Player not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(playerInfo(found[0]))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnounceReachesConnectedClient(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &announcements, nil)
+	c := joinKey(t, "announce-key")
+
+	rec := adminDo(http.MethodPost, "/admin/announce", `{"text":"Maintenance at 5","level":"warn"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("announce: %d %s", rec.Code, rec.Body)
+	}
+	msg := c.expect("announcement")
+	if msg.Text != "Maintenance at 5" || msg.Level != "warn" {
+		t.Errorf("announcement = %q (%s), want %q (warn)", msg.Text, msg.Level, "Maintenance at 5")
+	}
+}
+
+func TestAnnounceWithTTLReachesNewJoiners(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &announcements, nil)
+
+	rec := adminDo(http.MethodPost, "/admin/announce", `{"text":"Welcome back","ttlSeconds":60}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("announce: %d %s", rec.Code, rec.Body)
+	}
+	c := joinKey(t, "late-joiner")
+	if msg := c.expect("announcement"); msg.Text != "Welcome back" || msg.Level != "info" {
+		t.Errorf("replayed announcement = %q (%s)", msg.Text, msg.Level)
+	}
+}
+
+func TestAnnounceRequiresAdmin(t *testing.T) {
+	withAdmin(t)
+	rec := serve(httptest.NewRequest(http.MethodPost, "/admin/announce", strings.NewReader(`{"text":"hi"}`)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: %d, want 401", rec.Code)
+	}
+}
+
+func TestColorChangeReachesPlayerAndLaterBroadcasts(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	withAdmin(t)
+	target := joinKey(t, "recolor-target")
+	other := joinKey(t, "recolor-observer")
+
+	rec := adminDo(http.MethodPost, "/admin/color", fmt.Sprintf(`{"id":%d,"colorHue":0,"transitionMs":0}`, target.id))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("color: %d %s", rec.Code, rec.Body)
+	}
+	for name, c := range map[string]*testClient{"target": target, "observer": other} {
+		msg := c.expect("colorChanged")
+		if msg.ID != target.id || msg.ColorHue == nil || *msg.ColorHue != 0 {
+			t.Errorf("%s: colorChanged for %d with hue %v", name, msg.ID, msg.ColorHue)
+		}
+	}
+
+	broadcastTick()
+	state, ok := other.expect("players").Players[target.id]
+	if !ok {
+		t.Fatal("target missing from the players frame")
+	}
+	if state.ColorHue != 0 {
+		t.Errorf("broadcast hue = %v, want 0", state.ColorHue)
+	}
+	p := findPlayers(target.id)[0]
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	if p.ColorHue != 0 {
+		t.Errorf("Player.ColorHue = %v, want 0", p.ColorHue)
+	}
+}
+
+func TestAcknowledgedAnnouncement(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &announcements, nil)
+	setVar(t, &ackTimeout, 50*time.Millisecond)
+	setVar(t, &pendingAcks, make(map[uint64]map[uint64]*pendingAck))
+	setVar(t, &deliveries, make(map[uint64]*Delivery))
+	setVar(t, &deliveryOrder, nil)
+	acker, silent := joinKey(t, "acker"), joinKey(t, "silent")
+
+	rec := adminDo(http.MethodPost, "/admin/announce", `{"text":"Restart soon","ack":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("announce: %d %s", rec.Code, rec.Body)
+	}
+	var sent struct {
+		AckID flexID `json:"ackId"`
+		Sent  int    `json:"sent"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&sent); err != nil || sent.AckID == 0 || sent.Sent != 2 {
+		t.Fatalf("announce response %+v, %v", sent, err)
+	}
+	msg := acker.expect("announcement")
+	if msg.AckID != sent.AckID {
+		t.Fatalf("announcement ackId %d, want %d", msg.AckID, sent.AckID)
+	}
+	acker.send(fmt.Sprintf(`{"type":"ack","ackId":%d}`, msg.AckID))
+
+	// only the client that didn't ack gets the retry
+	silent.expect("announcement")
+	if retry := silent.expect("announcement"); retry.AckID != sent.AckID {
+		t.Errorf("retry ackId %d, want %d", retry.AckID, sent.AckID)
+	}
+	acker.expectNone("announcement", 100*time.Millisecond)
+
+	var d Delivery
+	waitFor(t, "the delivery to settle", func() bool {
+		rec := adminDo(http.MethodGet, fmt.Sprintf("/admin/acks?id=%d", sent.AckID), "")
+		return json.NewDecoder(rec.Body).Decode(&d) == nil && d.Lost == 1
+	})
+	if d.Sent != 2 || d.Acked != 1 || d.Retried != 1 {
+		t.Errorf("delivery = %+v, want 2 sent, 1 acked, 1 retried and lost", d)
+	}
+}
+
+func TestKickIsAudited(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &auditLog, nil)
+	setVar(t, &auditFile, "")
+	c := joinKey(t, "kicked-key")
+
+	before := time.Now().UTC()
+	if rec := adminDo(http.MethodPost, "/admin/kick", fmt.Sprintf(`{"id":%d}`, c.id)); rec.Code != http.StatusOK {
+		t.Fatalf("kick: %d %s", rec.Code, rec.Body)
+	}
+	rec := adminDo(http.MethodGet, "/admin/audit", "")
+	var entries []AuditEntry
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil || len(entries) != 1 {
+		t.Fatalf("audit = %+v, %v; want one entry", entries, err)
+	}
+	e := entries[0]
+	if e.Action != "kick" || e.Target != fmt.Sprint(c.id) || e.Admin != "tester" || e.IP != "192.0.2.1" {
+		t.Errorf("entry = %+v, want a kick of %d by tester from 192.0.2.1", e, c.id)
+	}
+	if e.Time.Before(before.Add(-time.Second)) || e.Time.After(time.Now().Add(time.Second)) {
+		t.Errorf("entry time %v, want around %v", e.Time, before)
+	}
+}
+
+func TestScopedTokenAnnouncesButCannotDeploy(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &announcements, nil)
+	setVar(t, &auditLog, nil)
+	setVar(t, &auditFile, "")
+	setVar(t, &adminToken, "")
+	t.Setenv("ADMIN_TOKENS", "comms:announce-secret:announce, malformed-secret-token")
+	logs := captureLog(t)
+	setVar(t, &adminTokens, loadAdminTokens())
+	if len(adminTokens) != 1 {
+		t.Fatalf("loaded %d tokens, want only the valid one", len(adminTokens))
+	}
+	if strings.Contains(logs.String(), "malformed-secret-token") {
+		t.Errorf("malformed entry logged verbatim: %s", logs)
+	}
+
+	do := func(path, body string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer announce-secret")
+		return serve(req).Code
+	}
+	if code := do("/admin/announce", `{"text":"hi"}`); code != http.StatusOK {
+		t.Errorf("announce: %d, want 200", code)
+	}
+	if code := do("/admin/rebuild", ""); code != http.StatusForbidden {
+		t.Errorf("rebuild: %d, want 403", code)
+	}
+	if len(auditLog) != 1 || auditLog[0].Admin != "comms" || auditLog[0].Action != "announce" {
+		t.Errorf("audit = %+v, want one announce by comms", auditLog)
+	}
+}
+
+func TestPlayerLookupByID(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	c := joinKey(t, "inspected")
+	c.moveTo(4)
+
+	rec := adminDo(http.MethodGet, fmt.Sprintf("/api/players/%d", c.id), "")
+	var info PlayerInfo
+	if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&info) != nil {
+		t.Fatalf("found: %d %s", rec.Code, rec.Body)
+	}
+	if info.ID != c.id || info.State.X != 4 || info.StateCount != 1 {
+		t.Errorf("info = %+v, want player %d at x=4 after one state", info, c.id)
+	}
+
+	for path, want := range map[string]int{
+		fmt.Sprintf("/api/players/%d", c.id+1000): http.StatusNotFound,
+		"/api/players/nobody":                     http.StatusBadRequest,
+	} {
+		if rec := adminDo(http.MethodGet, path, ""); rec.Code != want {
+			t.Errorf("GET %s: %d, want %d", path, rec.Code, want)
+		}
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/players/%d", c.id), nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: %d, want 401", rec.Code)
+	}
+}
+
+func TestUnauthorizedAdminCallGetsJSONError(t *testing.T) {
+	withAdmin(t)
+	setVar(t, &jsonErrors, true)
+	rec := serve(httptest.NewRequest(http.MethodGet, "/admin/metrics", nil))
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d (%s), want 401 as JSON", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body APIError
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != "unauthorized" || body.Error.Message != "Unauthorized" {
+		t.Errorf("error = %+v, want code unauthorized", body.Error)
+	}
+
+	// static 404s stay plain
+	withDist(t, map[string]string{"index.html": "<html></html>"})
+	setVar(t, &spaFallback, false)
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/missing", nil)); rec.Code != http.StatusNotFound || strings.Contains(rec.Header().Get("Content-Type"), "json") {
+		t.Errorf("static 404: %d (%s), want a plain 404", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
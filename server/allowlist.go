@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WEBHOOK_ALLOWED_IPS restricts the webhook to these sources, as a
+// comma-separated list of IPs and CIDRs. The entry "github" adds GitHub's
+// published hook ranges, refreshed every WEBHOOK_ALLOWED_REFRESH. Unset
+// allows any source (the signature is still checked).
+var (
+	webhookAllowSpec    = getEnv("WEBHOOK_ALLOWED_IPS", "")
+	webhookAllowRefresh = positiveDuration(getEnvDuration("WEBHOOK_ALLOWED_REFRESH", time.Hour), time.Hour)
+	githubMetaURL       = "https://api.github.com/meta"
+)
+
+var (
+	webhookStatic []netip.Prefix
+	webhookGitHub []netip.Prefix // last fetched hook ranges
+	useGitHubIPs  bool
+	allowMu       sync.RWMutex
+)
+
+// startWebhookAllowList parses WEBHOOK_ALLOWED_IPS and starts refreshing
+// GitHub's ranges if requested
+func startWebhookAllowList() {
+	for _, entry := range strings.Split(webhookAllowSpec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "github" {
+			useGitHubIPs = true
+			continue
+		}
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid webhook allow-list entry %q", entry)
+			continue
+		}
+		webhookStatic = append(webhookStatic, prefix)
+	}
+
+	if useGitHubIPs {
+		go func() {
+			for {
+				if err := refreshGitHubRanges(); err != nil {
+					log.Printf("Failed to refresh GitHub hook ranges: %v", err)
+				}
+				time.Sleep(webhookAllowRefresh)
+			}
+		}()
+	}
+}
+
+// parsePrefix accepts a CIDR or a single IP
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func refreshGitHubRanges() error {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(githubMetaURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	var meta struct {
+		Hooks []string `json:"hooks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return err
+	}
+	var ranges []netip.Prefix
+	for _, cidr := range meta.Hooks {
+		if prefix, err := parsePrefix(cidr); err == nil {
+			ranges = append(ranges, prefix)
+		}
+	}
+	if len(ranges) == 0 {
+		return fmt.Errorf("no hook ranges in response")
+	}
+
+	allowMu.Lock()
+	webhookGitHub = ranges
+	allowMu.Unlock()
+	log.Printf("Loaded %d GitHub hook ranges", len(ranges))
+	return nil
+}
+
+// webhookSourceAllowed reports whether ip may call the webhook. With an
+// allow-list configured, unknown or unparsable sources are refused; that
+// includes everything until GitHub's ranges have been fetched once.
+func webhookSourceAllowed(ip string) bool {
+	if webhookAllowSpec == "" {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	allowMu.RLock()
+	defer allowMu.RUnlock()
+	for _, list := range [][]netip.Prefix{webhookStatic, webhookGitHub} {
+		for _, prefix := range list {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ASSET_GZIP compresses dist files on their first request and serves the
+// cached .gz to clients accepting gzip, so the build needn't emit them.
+// Files under ASSET_GZIP_MIN_SIZE or over ASSET_GZIP_MAX_FILE are served
+// as is. The cache lives in ASSET_GZIP_CACHE_DIR and is cleared when it
+// would outgrow ASSET_GZIP_CACHE_BYTES; stale entries from earlier builds
+// go that way too, since entries are keyed by size and modification time.
+// Clearing only removes the files the cache wrote, so the directory may be
+// shared.
+var (
+	assetGzip           = getEnvBool("ASSET_GZIP", false)
+	assetGzipMinSize    = int64(getEnvInt("ASSET_GZIP_MIN_SIZE", 1024))
+	assetGzipMaxFile    = int64(getEnvInt("ASSET_GZIP_MAX_FILE", 32<<20))
+	assetGzipLevel      = getEnvInt("ASSET_GZIP_LEVEL", gzip.BestCompression)
+	assetGzipCacheDir   = getEnv("ASSET_GZIP_CACHE_DIR", filepath.Join(os.TempDir(), "masked-garden-gzip"))
+	assetGzipCacheBytes = int64(getEnvInt("ASSET_GZIP_CACHE_BYTES", 256<<20))
+)
+
+func init() {
+	if assetGzipLevel < gzip.HuffmanOnly || assetGzipLevel > gzip.BestCompression {
+		log.Printf("Invalid ASSET_GZIP_LEVEL=%d, using best compression", assetGzipLevel)
+		assetGzipLevel = gzip.BestCompression
+	}
+}
+
+// Formats that are already compressed gain nothing from gzip
+var incompressible = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true,
+	".woff": true, ".woff2": true, ".mp3": true, ".ogg": true, ".mp4": true, ".webm": true,
+	".zip": true, ".gz": true, ".br": true, ".ktx2": true,
+}
+
+// gzipCacheFile matches the entries and temp files the cache writes
+var gzipCacheFile = regexp.MustCompile(`^([0-9a-f]{32}\.gz|gzip-[0-9]+\.tmp)$`)
+
+var (
+	gzipCacheOnce  sync.Once
+	gzipCacheMu    sync.Mutex   // serializes wiping the cache
+	gzipCacheBytes atomic.Int64 // bytes written since the last wipe
+)
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveGzipped serves the request's dist file gzipped from the cache,
+// reporting false when it should be served as is instead
+func serveGzipped(w http.ResponseWriter, r *http.Request) bool {
+	if !assetGzip || (r.Method != http.MethodGet && r.Method != http.MethodHead) || !acceptsGzip(r) {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(r.URL.Path))
+	if incompressible[ext] {
+		return false
+	}
+	name := filepath.Join(distDir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	info, err := os.Stat(name)
+	if err != nil || !info.Mode().IsRegular() || info.Size() < assetGzipMinSize || info.Size() > assetGzipMaxFile {
+		return false
+	}
+
+	cached, err := gzipCached(name, info)
+	if err != nil {
+		log.Printf("Failed to gzip %s: %v", name, err)
+		return false
+	}
+	f, err := os.Open(cached)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	// the type must come from the original, not sniffed from gzip bytes
+	withContentType(w, r)
+	if w.Header().Get("Content-Type") == "" {
+		typ := mime.TypeByExtension(ext)
+		if typ == "" {
+			typ = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", typ)
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	r.Header.Del("Range") // ranges would index the compressed bytes
+	http.ServeContent(w, r, name, info.ModTime(), f)
+	return true
+}
+
+// gzipCached returns the cache path of name's gzipped contents,
+// compressing it first if this version isn't cached yet
+func gzipCached(name string, info os.FileInfo) (string, error) {
+	gzipCacheOnce.Do(func() {
+		clearGzipCache() // entries from a previous run aren't counted
+	})
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d", name, info.Size(), info.ModTime().UnixNano(), assetGzipLevel)))
+	cached := filepath.Join(assetGzipCacheDir, hex.EncodeToString(key[:16])+".gz")
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+
+	if gzipCacheBytes.Load()+info.Size() > assetGzipCacheBytes {
+		gzipCacheMu.Lock()
+		if gzipCacheBytes.Load()+info.Size() > assetGzipCacheBytes {
+			log.Printf("Gzip cache over %d bytes, clearing it", assetGzipCacheBytes)
+			clearGzipCache()
+			gzipCacheBytes.Store(0)
+		}
+		gzipCacheMu.Unlock()
+	}
+	if err := os.MkdirAll(assetGzipCacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	src, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	// concurrent first requests each write their own temp file; the
+	// renames leave identical contents either way
+	tmp, err := os.CreateTemp(assetGzipCacheDir, "gzip-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	gz, _ := gzip.NewWriterLevel(tmp, assetGzipLevel)
+	if _, err := io.Copy(gz, src); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	size, _ := tmp.Seek(0, io.SeekCurrent)
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), cached); err != nil {
+		return "", err
+	}
+	gzipCacheBytes.Add(size)
+	return cached, nil
+}
+
+// clearGzipCache removes the cache's own files from ASSET_GZIP_CACHE_DIR,
+// leaving anything else there alone
+func clearGzipCache() {
+	entries, err := os.ReadDir(assetGzipCacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && gzipCacheFile.MatchString(entry.Name()) {
+			os.Remove(filepath.Join(assetGzipCacheDir, entry.Name()))
+		}
+	}
+}
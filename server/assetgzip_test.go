@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withGzipCache enables ASSET_GZIP with a fresh cache in dir
+func withGzipCache(t *testing.T, dir string) {
+	t.Helper()
+	setVar(t, &assetGzip, true)
+	setVar(t, &assetGzipMinSize, 16)
+	setVar(t, &assetGzipCacheDir, dir)
+	gzipCacheOnce = sync.Once{}
+	gzipCacheBytes.Store(0)
+	t.Cleanup(func() { gzipCacheBytes.Store(0) })
+}
+
+func getGzipped(t *testing.T, path string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := serve(req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("GET %s: %d, encoding %q", path, rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func cacheEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.gz"))
+	return matches
+}
+
+func TestAssetGzipCachesOnFirstRequest(t *testing.T) {
+	script := strings.Repeat("console.log('masked garden');\n", 100)
+	withDist(t, map[string]string{"index.html": "<html></html>", "app.js": script})
+	cache := t.TempDir()
+	withGzipCache(t, cache)
+
+	if got := getGzipped(t, "/app.js"); got != script {
+		t.Fatalf("first response decodes to %d bytes, want the script", len(got))
+	}
+	entries := cacheEntries(t, cache)
+	if len(entries) != 1 {
+		t.Fatalf("cache holds %v after the first request, want one entry", entries)
+	}
+
+	// the second request is served from the cached entry, not recompressed
+	var marked bytes.Buffer
+	gz := gzip.NewWriter(&marked)
+	gz.Write([]byte("from cache"))
+	gz.Close()
+	if err := os.WriteFile(entries[0], marked.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := getGzipped(t, "/app.js"); got != "from cache" {
+		t.Errorf("second response = %d bytes, want the cached entry", len(got))
+	}
+}
+
+func TestAssetGzipClearsOnlyItsOwnFiles(t *testing.T) {
+	withDist(t, map[string]string{
+		"index.html": "<html></html>",
+		"a.js":       strings.Repeat("a", 4096),
+		"b.js":       strings.Repeat("b", 4096),
+	})
+	shared := t.TempDir()
+	unrelated := filepath.Join(shared, "operator-notes.txt")
+	os.WriteFile(unrelated, []byte("keep me"), 0644)
+	os.Mkdir(filepath.Join(shared, "subdir"), 0755)
+	withGzipCache(t, shared)
+	setVar(t, &assetGzipCacheBytes, 4096) // a second entry overflows it
+
+	getGzipped(t, "/a.js")
+	getGzipped(t, "/b.js")
+	if entries := cacheEntries(t, shared); len(entries) != 1 {
+		t.Errorf("cache holds %v, want only the entry written after clearing", entries)
+	}
+	for _, keep := range []string{unrelated, filepath.Join(shared, "subdir")} {
+		if _, err := os.Stat(keep); err != nil {
+			t.Errorf("clearing the cache removed %s: %v", keep, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one admin action
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Admin  string    `json:"admin"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	IP     string    `json:"ip"`
+}
+
+// Recent admin actions, oldest first, kept in memory for /admin/audit and
+// appended as JSON lines to AUDIT_FILE if set (encrypted with AUDIT_KEY)
+var (
+	auditLog     []AuditEntry
+	auditMu      sync.Mutex
+	auditHistory = getEnvInt("AUDIT_HISTORY", 200)
+	auditFile    = os.Getenv("AUDIT_FILE")
+)
+
+// adminIdentity names the operator behind an authenticated admin request
+func adminIdentity(r *http.Request) string {
+	if t := lookupAdmin(r); t != nil {
+		return t.Label
+	}
+	return "unknown"
+}
+
+// audit records an admin action taken by the request's operator
+func audit(r *http.Request, action, target string) {
+	entry := AuditEntry{
+		Time:   time.Now().UTC(),
+		Admin:  adminIdentity(r),
+		Action: action,
+		Target: target,
+		IP:     clientIP(r),
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditLog = append(auditLog, entry)
+	if len(auditLog) > auditHistory {
+		auditLog = auditLog[len(auditLog)-auditHistory:]
+	}
+	if auditFile != "" {
+		appendAudit(entry)
+	}
+	publishTelemetry(TelemetryEvent{Type: "audit", Audit: &entry})
+}
+
+// appendAudit writes entry to AUDIT_FILE; callers hold auditMu
+func appendAudit(entry AuditEntry) {
+	f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open audit log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	line, _ := json.Marshal(entry)
+	if auditSealer != nil {
+		sealed, err := auditSealer.seal(line)
+		if err != nil {
+			log.Printf("Failed to encrypt audit entry: %v", err)
+			return
+		}
+		line = []byte(sealed)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// readAuditLine parses a line of AUDIT_FILE, decrypting it with AUDIT_KEY
+// if set
+func readAuditLine(line string) (AuditEntry, error) {
+	var entry AuditEntry
+	data := []byte(line)
+	if auditSealer != nil {
+		var err error
+		if data, err = auditSealer.open(line); err != nil {
+			return entry, err
+		}
+	}
+	err := json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// loadAudit restores the most recent entries of AUDIT_FILE after a restart
+func loadAudit() {
+	if auditFile == "" {
+		return
+	}
+	f, err := os.Open(auditFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to load audit log: %v", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry, err := readAuditLine(scanner.Text())
+		if err != nil {
+			log.Printf("Skipping unreadable audit entry: %v", err)
+			continue
+		}
+		auditLog = append(auditLog, entry)
+		if len(auditLog) > auditHistory {
+			auditLog = auditLog[1:]
+		}
+	}
+}
+
+// auditHandler lists recent admin actions, newest first
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, scopeRead) {
+		return
+	}
+	auditMu.Lock()
+	entries := make([]AuditEntry, len(auditLog))
+	for i, entry := range auditLog {
+		entries[len(auditLog)-1-i] = entry
+	}
+	auditMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// capBatch lets the server coalesce messages queued within COALESCE_WINDOW
+// of each other into one batch frame, {"type":"batch","messages":[...]},
+// cutting per-frame overhead when several events land at once (a join
+// brings playerCount, snapshot and more). 0 disables coalescing.
+const capBatch = "batch"
+
+var coalesceWindow = getEnvDuration("COALESCE_WINDOW", 0)
+
+// Frames per batch at most, so one batch can't grow without bound
+const maxBatch = 64
+
+// coalesce gathers the text frames that follow first within the window.
+// It returns the frames to write: a single batch, plus any non-text frame
+// that ended the gathering, and how many queued frames they take up. ok is
+// false if the player closed meanwhile.
+func (p *Player) coalesce(first outFrame) (frames []outFrame, taken int, ok bool) {
+	pending := [][]byte{first.data}
+	var tail []outFrame
+
+	timer := time.NewTimer(coalesceWindow)
+	defer timer.Stop()
+gather:
+	for len(pending) < maxBatch {
+		select {
+		case <-p.done:
+			return nil, 0, false
+		case <-timer.C:
+			break gather
+		case frame := <-p.send:
+			if frame.messageType != websocket.TextMessage {
+				tail = append(tail, frame)
+				break gather
+			}
+			pending = append(pending, frame.data)
+		}
+	}
+
+	taken = len(pending) + len(tail)
+	if len(pending) == 1 {
+		return append([]outFrame{first}, tail...), taken, true
+	}
+	messages := make([]json.RawMessage, len(pending))
+	for i, data := range pending {
+		messages[i] = data
+	}
+	data, _ := json.Marshal(WSMessage{Type: "batch", Messages: messages})
+	return append([]outFrame{{websocket.TextMessage, data}}, tail...), taken, true
+}
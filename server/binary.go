@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+)
+
+// capBinary asks for players frames as binary WebSocket messages, with
+// each player referred to by a small per-client index instead of its
+// 8-byte actor ID. Indexes are announced in the frame that first uses
+// them and are reused after their player leaves.
+//
+// Frame layout, varints as in encoding/binary, floats as little-endian
+// float32:
+//
+//	byte      kind, 1 = players
+//	byte      flags, bit 0 = entries carry lightness
+//	uvarint   number of index announcements, then per announcement:
+//	          uvarint index, uvarint actor ID
+//	uvarint   number of entries, then per entry:
+//	          uvarint index, float32 x y z vx vy vz yaw hue [lightness]
+//
+// An announcement replaces whatever ID the index had before.
+const capBinary = "binary"
+
+const (
+	binaryKindPlayers = 1
+	binaryLightness   = 1 << 0
+)
+
+// indexTable maps actor IDs to one client's compact indexes. Only the
+// client's frame sends use it, one at a time, so it isn't locked.
+type indexTable struct {
+	byID    map[uint64]*indexEntry
+	free    []uint64
+	next    uint64
+	pending []*indexEntry // announced by the last encoded frame
+}
+
+type indexEntry struct {
+	index     uint64
+	announced bool
+}
+
+func newIndexTable() *indexTable {
+	return &indexTable{byID: make(map[uint64]*indexEntry)}
+}
+
+// lookup returns id's entry, assigning a free index to a new ID
+func (t *indexTable) lookup(id uint64) *indexEntry {
+	if e, ok := t.byID[id]; ok {
+		return e
+	}
+	e := &indexEntry{}
+	if n := len(t.free); n > 0 {
+		e.index, t.free = t.free[n-1], t.free[:n-1]
+	} else {
+		e.index = t.next
+		t.next++
+	}
+	t.byID[id] = e
+	return e
+}
+
+// prune frees the indexes of players no longer in all
+func (t *indexTable) prune(all map[uint64]PlayerState) {
+	for id, e := range t.byID {
+		if _, ok := all[id]; !ok {
+			t.free = append(t.free, e.index)
+			delete(t.byID, id)
+		}
+	}
+}
+
+// announce marks the indexes announced by the last encoded frame as known
+// to the client, once the frame has been queued. Until then frames repeat
+// the announcements, so a skipped frame loses none.
+func (t *indexTable) announce() {
+	for _, e := range t.pending {
+		e.announced = true
+	}
+	t.pending = nil
+}
+
+// encode builds a binary players frame for states; all is every connected
+// player, whose departures free indexes for reuse
+func (t *indexTable) encode(states, all map[uint64]PlayerState) []byte {
+	t.prune(all)
+	ids := make([]uint64, 0, len(states))
+	lightness := false
+	for id, s := range states {
+		ids = append(ids, id)
+		lightness = lightness || s.Team != ""
+	}
+	slices.Sort(ids)
+
+	var flags byte
+	if lightness {
+		flags |= binaryLightness
+	}
+	var announcements []byte
+	t.pending = t.pending[:0]
+	for _, id := range ids {
+		if e := t.lookup(id); !e.announced {
+			announcements = binary.AppendUvarint(announcements, e.index)
+			announcements = binary.AppendUvarint(announcements, id)
+			t.pending = append(t.pending, e)
+		}
+	}
+
+	data := []byte{binaryKindPlayers, flags}
+	data = binary.AppendUvarint(data, uint64(len(t.pending)))
+	data = append(data, announcements...)
+	data = binary.AppendUvarint(data, uint64(len(ids)))
+	for _, id := range ids {
+		s := states[id]
+		data = binary.AppendUvarint(data, t.byID[id].index)
+		for _, v := range []float64{s.X, s.Y, s.Z, s.VX, s.VY, s.VZ, s.Yaw, s.ColorHue} {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(v)))
+		}
+		if lightness {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(s.Lightness)))
+		}
+	}
+	return data
+}
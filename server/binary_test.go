@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// binaryDecoder is the client side of binary players frames: it keeps the
+// index table the frames' announcements build up
+type binaryDecoder struct {
+	t   *testing.T
+	ids map[uint64]uint64 // index -> actor ID
+}
+
+func newBinaryDecoder(t *testing.T) *binaryDecoder {
+	return &binaryDecoder{t: t, ids: make(map[uint64]uint64)}
+}
+
+// decode returns the states in frame and how many announcements it had
+func (d *binaryDecoder) decode(frame []byte) (map[uint64]PlayerState, int) {
+	d.t.Helper()
+	r := bytes.NewReader(frame)
+	uvarint := func() uint64 {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			d.t.Fatalf("truncated frame: %v", err)
+		}
+		return v
+	}
+	float := func() float64 {
+		var bits uint32
+		if err := binary.Read(r, binary.LittleEndian, &bits); err != nil {
+			d.t.Fatalf("truncated frame: %v", err)
+		}
+		return float64(math.Float32frombits(bits))
+	}
+
+	kind, _ := r.ReadByte()
+	flags, _ := r.ReadByte()
+	if kind != binaryKindPlayers {
+		d.t.Fatalf("frame kind %d, want players", kind)
+	}
+	announced := int(uvarint())
+	for range announced {
+		index := uvarint()
+		d.ids[index] = uvarint()
+	}
+	states := make(map[uint64]PlayerState)
+	for n := uvarint(); n > 0; n-- {
+		index := uvarint()
+		id, ok := d.ids[index]
+		if !ok {
+			d.t.Fatalf("index %d was never announced", index)
+		}
+		var s PlayerState
+		for _, v := range []*float64{&s.X, &s.Y, &s.Z, &s.VX, &s.VY, &s.VZ, &s.Yaw, &s.ColorHue} {
+			*v = float()
+		}
+		if flags&binaryLightness != 0 {
+			s.Lightness = float()
+		}
+		states[id] = s
+	}
+	if r.Len() != 0 {
+		d.t.Fatalf("%d trailing bytes", r.Len())
+	}
+	return states, announced
+}
+
+func TestBinaryFrameRoundTrip(t *testing.T) {
+	states := map[uint64]PlayerState{
+		7:       {X: 1.5, Y: 2, Z: -3, VX: 0.25, Yaw: -1.5, ColorHue: 120},
+		1 << 40: {X: -8, VZ: 4, Yaw: 0.75, ColorHue: 300},
+	}
+	table, client := newIndexTable(), newBinaryDecoder(t)
+
+	first := table.encode(states, states)
+	table.announce()
+	got, announced := client.decode(first)
+	if announced != 2 {
+		t.Errorf("first frame announced %d indexes, want 2", announced)
+	}
+	for id, want := range states {
+		if got[id] != want {
+			t.Errorf("player %d decoded as %+v, want %+v", id, got[id], want)
+		}
+	}
+
+	second := table.encode(states, states)
+	table.announce()
+	if got, announced := client.decode(second); announced != 0 || len(got) != 2 {
+		t.Errorf("second frame announced %d and carried %d players, want 0 and 2", announced, len(got))
+	}
+	if len(second) >= len(first) {
+		t.Errorf("second frame %d bytes, want fewer than the first's %d", len(second), len(first))
+	}
+	if perEntry := (len(second) - 4) / 2; perEntry > 1+8*4 {
+		t.Errorf("%d bytes per entry, want a one-byte index and the floats", perEntry)
+	}
+}
+
+func TestBinaryIndexesRemappedOnJoinAndLeave(t *testing.T) {
+	table, client := newIndexTable(), newBinaryDecoder(t)
+	all := map[uint64]PlayerState{1: {X: 1}, 2: {X: 2}, 3: {X: 3}}
+	client.decode(table.encode(all, all))
+	table.announce()
+	freed := table.byID[2].index
+
+	// 2 leaves and 4 joins, taking over 2's index
+	delete(all, 2)
+	all[4] = PlayerState{X: 4}
+	got, announced := client.decode(table.encode(all, all))
+	table.announce()
+	if announced != 1 || table.byID[4].index != freed {
+		t.Errorf("join announced %d indexes, 4 got index %d; want 1 and the freed %d", announced, table.byID[4].index, freed)
+	}
+	for id, want := range map[uint64]float64{1: 1, 3: 3, 4: 4} {
+		if got[id].X != want {
+			t.Errorf("player %d at x=%v, want %v", id, got[id].X, want)
+		}
+	}
+	if _, ok := got[2]; ok {
+		t.Error("departed player 2 decoded from its reused index")
+	}
+}
+
+func TestBinaryAnnouncementsRepeatUntilQueued(t *testing.T) {
+	table, client := newIndexTable(), newBinaryDecoder(t)
+	all := map[uint64]PlayerState{5: {X: 5}}
+	table.encode(all, all) // skipped, never reached the client
+
+	got, announced := client.decode(table.encode(all, all))
+	if announced != 1 || got[5].X != 5 {
+		t.Errorf("frame after a skipped one announced %d, decoded %v", announced, got)
+	}
+}
+
+func TestBinaryClientGetsBinaryFrames(t *testing.T) {
+	resetPlayers(t)
+	c := join(t, `{"type":"hello","publicKey":"binary-client","capabilities":["binary"]}`)
+	other := joinKey(t, "binary-neighbor")
+	other.moveTo(3)
+
+	broadcastTick()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		messageType, data, err := c.read(time.Until(deadline))
+		if err != nil {
+			t.Fatalf("waiting for a binary frame: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		got, _ := newBinaryDecoder(t).decode(data)
+		if len(got) != 1 || got[other.id].X != 3 {
+			t.Errorf("binary frame has %v, want %d at x=3", got, other.id)
+		}
+		return
+	}
+}
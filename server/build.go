@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildRecord is one run of the deploy pipeline
+type BuildRecord struct {
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMs int64     `json:"durationMs"`
+	Success    bool      `json:"success"`
+	Commit     string    `json:"commit,omitempty"`
+	Step       string    `json:"step,omitempty"`   // step that failed
+	Output     string    `json:"output,omitempty"` // redacted tail of the last step's output
+}
+
+const maxBuildOutput = 4096
+
+// Bounded history of recent builds, oldest first
+var (
+	buildHistory    []BuildRecord
+	buildHistoryMu  sync.RWMutex
+	maxBuildHistory = max(getEnvInt("BUILD_HISTORY", 20), 0)
+)
+
+func recordBuild(rec *BuildRecord) {
+	rec.End = time.Now()
+	rec.DurationMs = rec.End.Sub(rec.Start).Milliseconds()
+
+	buildHistoryMu.Lock()
+	defer buildHistoryMu.Unlock()
+	buildHistory = append(buildHistory, *rec)
+	if len(buildHistory) > maxBuildHistory {
+		buildHistory = buildHistory[len(buildHistory)-maxBuildHistory:]
+	}
+	done := *rec
+	publishTelemetry(TelemetryEvent{Type: "build", Build: &done})
+}
+
+// buildLogf logs a deploy step and streams it, redacted, to /admin/ws
+func buildLogf(format string, args ...any) {
+	line := fmt.Sprintf(format, args...)
+	log.Print(line)
+	publishTelemetry(TelemetryEvent{Type: "buildLog", Line: redactSecrets(line)})
+}
+
+// recentBuilds returns the build history, newest first
+func recentBuilds() []BuildRecord {
+	buildHistoryMu.RLock()
+	defer buildHistoryMu.RUnlock()
+	out := make([]BuildRecord, len(buildHistory))
+	for i, rec := range buildHistory {
+		out[len(buildHistory)-1-i] = rec
+	}
+	return out
+}
+
+// truncateOutput keeps the tail of command output, where errors usually
+// are, with secrets redacted so it is safe to return over HTTP. Redacting
+// comes first: a secret cut in half by the truncation would no longer match.
+func truncateOutput(output []byte) string {
+	s := redactSecrets(string(output))
+	if len(s) > maxBuildOutput {
+		s = s[len(s)-maxBuildOutput:]
+	}
+	return s
+}
+
+// Common credential shapes that may show up in git or pnpm output
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{20,}`), "[REDACTED]"},
+	{regexp.MustCompile(`github_pat_[A-Za-z0-9_]{20,}`), "[REDACTED]"},
+	{regexp.MustCompile(`AKIA[0-9A-Z]{16}`), "[REDACTED]"},
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(?i)((?:token|secret|password|passwd|api[_-]?key)\s*[=:]\s*)\S+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(https?://)[^/\s:@]+:[^/\s@]+@`), "${1}[REDACTED]@"}, // credentials in URLs
+}
+
+// redactSecrets strips configured secrets and anything that looks like a token
+func redactSecrets(s string) string {
+	known := []string{secret, prevSecret, adminToken}
+	for _, t := range adminTokens {
+		known = append(known, t.Token)
+	}
+	for _, known := range known {
+		if known != "" {
+			s = strings.ReplaceAll(s, known, "[REDACTED]")
+		}
+	}
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// BUILD_OUTPUT_IN_RESPONSE includes the redacted output tail in admin
+// rebuild responses, to debug failed deploys without SSH
+var buildOutputInResponse = getEnvBool("BUILD_OUTPUT_IN_RESPONSE", false)
+
+// runBuild fetches, resets to origin/main and rebuilds the game, then
+// notifies clients of the new build time
+func runBuild() BuildRecord {
+	rec := BuildRecord{Start: time.Now()}
+	fail := func(step string, err error, output []byte) BuildRecord {
+		buildLogf("%s failed: %v\n%s", step, err, output)
+		rec.Step = step
+		rec.Output = truncateOutput(output)
+		recordBuild(&rec)
+		return rec
+	}
+
+	// without the tools a reset would leave the repo changed and unbuilt
+	if err := checkBuildTools(); err != nil {
+		return fail("Build tools", err, []byte(err.Error()))
+	}
+
+	buildLogf("Fetching latest changes...")
+	cmd := exec.Command("git", "-C", repoDir, "fetch", "origin")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fail("Git fetch", err, output)
+	}
+	buildLogf("Git fetch succeeded:\n%s", output)
+
+	buildLogf("Resetting to origin/main...")
+	cmd = exec.Command("git", "-C", repoDir, "reset", "--hard", "origin/main")
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		return fail("Git reset", err, output)
+	}
+	buildLogf("Git reset succeeded:\n%s", output)
+
+	rec.Commit = currentCommit()
+
+	if deployTestCmd != "" {
+		buildLogf("Running tests...")
+		output, err = runTests()
+		if err != nil {
+			rollbackRepo(currentBuild().Commit)
+			return fail("Test", err, output)
+		}
+		buildLogf("Tests passed")
+	}
+
+	var release string
+	if atomicDist {
+		release = filepath.Join(releasesDir, rec.Start.UTC().Format("20060102T150405"))
+	}
+
+	buildLogf("Rebuilding...")
+	output, err = buildGame(release)
+	if err != nil {
+		if release != "" {
+			os.RemoveAll(release)
+		}
+		return fail("Build", err, output)
+	}
+	buildLogf("Build succeeded")
+	if release != "" {
+		if err := swapDist(release); err != nil {
+			return fail("Swap", err, nil)
+		}
+		pruneReleases()
+	}
+	rec.Success = true
+	rec.Output = truncateOutput(output)
+	recordBuild(&rec)
+
+	// Update build time and notify all clients
+	setBuild(BuildInfo{Time: time.Now(), Commit: rec.Commit})
+	broadcastBuildTime()
+	checkOutdated(connectedPlayers())
+	return rec
+}
+
+// One build runs at a time. A push during a build is dropped, or with
+// BUILD_QUEUE_PENDING queued: pushes collapse into a single pending
+// rebuild, run when the current build finishes to pick up the newest commit.
+var (
+	buildQueuePending = getEnvBool("BUILD_QUEUE_PENDING", false)
+	buildSlotMu       sync.Mutex // guards buildRunning and buildPending
+	buildRunning      bool
+	buildPending      bool
+)
+
+// claimBuild takes the build slot, or reports false if a build is running,
+// queueing a rebuild if queue is set and BUILD_QUEUE_PENDING is on
+func claimBuild(queue bool) bool {
+	buildSlotMu.Lock()
+	defer buildSlotMu.Unlock()
+	if buildRunning {
+		if queue && buildQueuePending {
+			buildPending = true
+		}
+		return false
+	}
+	buildRunning = true
+	return true
+}
+
+// releaseBuild frees the build slot, or hands it to the pending rebuild
+func releaseBuild() {
+	buildSlotMu.Lock()
+	pending := buildPending
+	buildPending = false
+	buildRunning = pending
+	buildSlotMu.Unlock()
+	if pending {
+		go func() {
+			buildLogf("Running the rebuild queued during the last build")
+			runBuild()
+			releaseBuild()
+		}()
+	}
+}
+
+// pushBuild starts a build for a webhook push, in the background
+func pushBuild() {
+	if !claimBuild(true) {
+		if buildQueuePending {
+			log.Println("Build already running, rebuild queued")
+		} else {
+			log.Println("Build already running, push ignored")
+		}
+		return
+	}
+	go func() {
+		runBuild()
+		releaseBuild()
+	}()
+}
+
+// BUILD_ON_START runs the deploy pipeline once at boot, before serving,
+// so a fresh server doesn't serve a stale or missing dist until a push
+var buildOnStart = getEnvBool("BUILD_ON_START", false)
+
+// startupBuild runs the BUILD_ON_START build; a failure is logged and the
+// server starts with whatever dist there is
+func startupBuild() {
+	if !buildOnStart || !claimBuild(false) {
+		return
+	}
+	defer releaseBuild()
+	log.Println("Building on start...")
+	if rec := runBuild(); rec.Success {
+		log.Printf("Startup build succeeded in %dms (commit %s)", rec.DurationMs, rec.Commit)
+	} else {
+		log.Printf("Startup build failed at %s, serving the existing dist", rec.Step)
+	}
+}
+
+// BuildInfo is the deployed build. Its fields only change together, under
+// buildMu, so readers never pair one build's time with another's commit.
+type BuildInfo struct {
+	Time   time.Time
+	Commit string // game commit, "" if unknown
+}
+
+func (b BuildInfo) TimeString() string {
+	return b.Time.UTC().Format(time.RFC3339)
+}
+
+func currentBuild() BuildInfo {
+	buildMu.RLock()
+	defer buildMu.RUnlock()
+	return deployed
+}
+
+func setBuild(info BuildInfo) {
+	buildMu.Lock()
+	deployed = info
+	buildMu.Unlock()
+}
+
+// currentCommit returns the checked out commit of the game repo, or "" if unknown
+func currentCommit() string {
+	sha, err := exec.Command("git", "-C", repoDir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(sha))
+}
+
+type VersionInfo struct {
+	GoVersion      string `json:"goVersion,omitempty"`
+	ServerRevision string `json:"serverRevision,omitempty"`
+	ServerTime     string `json:"serverTime,omitempty"`
+	ServerModified bool   `json:"serverModified,omitempty"`
+	Commit         string `json:"commit"`
+	BuildTime      string `json:"buildTime"`
+}
+
+// versionHandler reports what is actually running: the server binary's VCS
+// stamp and the deployed game commit
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	var info VersionInfo
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.GoVersion = bi.GoVersion
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.ServerRevision = s.Value
+			case "vcs.time":
+				info.ServerTime = s.Value
+			case "vcs.modified":
+				info.ServerModified = s.Value == "true"
+			}
+		}
+	}
+
+	build := currentBuild()
+	info.Commit = build.Commit
+	info.BuildTime = build.TimeString()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func buildsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, scopeRead) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recentBuilds())
+}
+
+// rebuildHandler runs the deploy pipeline synchronously and reports the result
+func rebuildHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r, scopeDeploy) {
+		return
+	}
+
+	if !claimBuild(false) {
+		apiError(w, "Build already running", http.StatusConflict)
+		return
+	}
+	audit(r, "rebuild", "")
+	rec := runBuild()
+	releaseBuild()
+	if !buildOutputInResponse {
+		rec.Output = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !rec.Success {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(rec)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Chat relays a player's text to everyone in its room, at most one message
+// per CHAT_INTERVAL per player and CHAT_MAX_LENGTH characters each. Each
+// room keeps its last CHAT_HISTORY messages, each for CHAT_RETENTION, and
+// replays them to joiners for context, so memory stays bounded by
+// CHAT_HISTORY per room. CHAT_HISTORY=0 keeps none.
+var (
+	chatMaxLength = max(getEnvInt("CHAT_MAX_LENGTH", 200), 1)
+	chatInterval  = getEnvDuration("CHAT_INTERVAL", time.Second)
+	chatHistory   = max(getEnvInt("CHAT_HISTORY", 20), 0)
+	chatRetention = positiveDuration(getEnvDuration("CHAT_RETENTION", time.Hour), time.Hour)
+)
+
+// ChatMessage is a chat line as kept for replay
+type ChatMessage struct {
+	ID   uint64
+	Text string
+	Sent time.Time
+}
+
+// chatLog is a room's recent chat, oldest first
+type chatLog struct {
+	mu       sync.Mutex
+	messages []ChatMessage
+}
+
+// add keeps m, evicting expired messages and those past CHAT_HISTORY
+func (l *chatLog) add(m ChatMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if chatHistory == 0 {
+		l.messages = nil
+		return
+	}
+	kept := append(l.unexpired(m.Sent), m)
+	// copied so the evicted ones don't linger in the backing array
+	l.messages = slices.Clone(kept[max(len(kept)-chatHistory, 0):])
+}
+
+// unexpired drops messages older than CHAT_RETENTION; callers hold mu
+func (l *chatLog) unexpired(now time.Time) []ChatMessage {
+	return slices.DeleteFunc(l.messages, func(m ChatMessage) bool {
+		return now.Sub(m.Sent) > chatRetention
+	})
+}
+
+// recent returns the messages to replay to a joiner
+func (l *chatLog) recent() []ChatMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = l.unexpired(time.Now())
+	return slices.Clone(l.messages)
+}
+
+func validateChat(msg *WSMessage) error {
+	if strings.TrimSpace(msg.Text) == "" {
+		return errors.New("chat: empty text")
+	}
+	if !utf8.ValidString(msg.Text) {
+		return errors.New("chat: invalid UTF-8")
+	}
+	if n := utf8.RuneCountInString(msg.Text); n > chatMaxLength {
+		return fmt.Errorf("chat: %d characters, at most %d allowed", n, chatMaxLength)
+	}
+	return nil
+}
+
+// handleChat relays a chat message to p's room, sender included, and keeps
+// it for joiners. Messages over the rate limit are dropped.
+func handleChat(p *Player, text string) {
+	now := time.Now()
+	if now.Sub(p.lastChat) < chatInterval {
+		return
+	}
+	p.lastChat = now
+
+	p.room.chat.add(ChatMessage{ID: p.ID, Text: text, Sent: now})
+	p.room.broadcast(WSMessage{Type: "chat", ID: p.ID, Text: text})
+}
+
+// sendChatHistory replays p's room's recent chat to p
+func sendChatHistory(p *Player) {
+	for _, m := range p.room.chat.recent() {
+		p.Send(WSMessage{Type: "chat", ID: m.ID, Text: m.Text, SentAt: m.Sent.UTC().Format(time.RFC3339)})
+	}
+}
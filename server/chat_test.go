@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinerGetsRecentChatUpToLimit(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &rooms, newRooms("lobby", ""))
+	setVar(t, &chatHistory, 3)
+	setVar(t, &chatInterval, 0)
+	talker := joinKey(t, "talker")
+	listener := joinKey(t, "listener")
+
+	for i := 1; i <= 5; i++ {
+		talker.send(fmt.Sprintf(`{"type":"chat","text":"message %d"}`, i))
+		if msg := listener.expect("chat"); msg.ID != talker.id || msg.Text != fmt.Sprintf("message %d", i) || msg.SentAt != "" {
+			t.Fatalf("live chat = %+v", msg)
+		}
+	}
+
+	late := dial(t)
+	late.send(`{"type":"hello","publicKey":"late-joiner"}`)
+	for i := 3; i <= 5; i++ {
+		msg := late.expect("chat")
+		if msg.Text != fmt.Sprintf("message %d", i) || msg.ID != talker.id || msg.SentAt == "" {
+			t.Errorf("replayed chat = %+v, want message %d with its time", msg, i)
+		}
+	}
+	late.expectNone("chat", 50*time.Millisecond)
+
+	// chat stays in its room
+	joinRoom(t, "lobby-joiner", "lobby").expectNone("chat", 50*time.Millisecond)
+}
+
+func TestChatHistoryExpiresAndIsRateLimited(t *testing.T) {
+	setVar(t, &chatHistory, 10)
+	setVar(t, &chatRetention, time.Minute)
+	var log chatLog
+	log.add(ChatMessage{ID: 1, Text: "old", Sent: time.Now().Add(-2 * time.Minute)})
+	log.add(ChatMessage{ID: 2, Text: "new", Sent: time.Now()})
+	if got := log.recent(); len(got) != 1 || got[0].Text != "new" {
+		t.Errorf("history = %+v, want only the unexpired message", got)
+	}
+
+	resetPlayers(t)
+	setVar(t, &rooms, newRooms("", ""))
+	setVar(t, &chatInterval, time.Minute)
+	talker := joinKey(t, "fast-talker")
+	listener := joinKey(t, "rate-listener")
+	talker.send(`{"type":"chat","text":"first"}`)
+	talker.send(`{"type":"chat","text":"too soon"}`)
+	if msg := listener.expect("chat"); msg.Text != "first" {
+		t.Errorf("chat = %q, want first", msg.Text)
+	}
+	listener.expectNone("chat", 50*time.Millisecond)
+}
+
+func TestValidateChat(t *testing.T) {
+	setVar(t, &chatMaxLength, 10)
+	for text, valid := range map[string]bool{
+		"hi":                    true,
+		strings.Repeat("é", 10): true,
+		"":                      false,
+		"   ":                   false,
+		strings.Repeat("a", 11): false,
+		"\xff":                  false,
+	} {
+		if err := validateChat(&WSMessage{Type: "chat", Text: text}); (err == nil) != valid {
+			t.Errorf("%q: error %v, want valid=%v", text, err, valid)
+		}
+	}
+}
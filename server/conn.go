@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is the message transport a player session runs over. In production
+// it is a *websocket.Conn; tests drive the protocol over an in-memory one
+// (memConn) without TCP.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPingHandler(h func(appData string) error)
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+var _ Conn = (*websocket.Conn)(nil)
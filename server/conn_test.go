@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type memFrame struct {
+	messageType int
+	data        []byte
+}
+
+// memConn is one end of an in-memory connection. Closing either end closes
+// both, like a socket; a close control frame reaches the peer as a
+// *websocket.CloseError, as it would over the wire.
+type memConn struct {
+	in     chan memFrame
+	out    chan memFrame
+	closed chan struct{}
+	once   *sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	readLimit    int64
+	pingHandler  func(appData string) error
+	pongHandler  func(appData string) error
+}
+
+const memConnBuffer = 256
+
+// newMemConnPair returns two connected in-memory ends: one for servePlayer,
+// one acting as the client
+func newMemConnPair() (server, client *memConn) {
+	a := make(chan memFrame, memConnBuffer)
+	b := make(chan memFrame, memConnBuffer)
+	closed := make(chan struct{})
+	once := &sync.Once{}
+	server = &memConn{in: a, out: b, closed: closed, once: once}
+	client = &memConn{in: b, out: a, closed: closed, once: once}
+	return server, client
+}
+
+type memTimeoutError struct{}
+
+func (memTimeoutError) Error() string   { return "memconn: i/o timeout" }
+func (memTimeoutError) Timeout() bool   { return true }
+func (memTimeoutError) Temporary() bool { return true }
+
+var _ net.Error = memTimeoutError{}
+
+func (c *memConn) ReadMessage() (int, []byte, error) {
+	c.mu.Lock()
+	deadline, limit := c.readDeadline, c.readLimit
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		var frame memFrame
+		// Frames already queued are delivered even if the conn has since closed
+		select {
+		case frame = <-c.in:
+		default:
+			select {
+			case frame = <-c.in:
+			case <-c.closed:
+				return 0, nil, net.ErrClosed
+			case <-timeout:
+				return 0, nil, memTimeoutError{}
+			}
+		}
+		if handled, err := c.control(frame); err != nil {
+			return 0, nil, err
+		} else if !handled {
+			return c.deliver(frame, limit)
+		}
+	}
+}
+
+// control runs the handler of a ping or pong frame, which like in gorilla
+// never reaches the reader; other frames aren't handled
+func (c *memConn) control(frame memFrame) (bool, error) {
+	c.mu.Lock()
+	ping, pong := c.pingHandler, c.pongHandler
+	c.mu.Unlock()
+	switch frame.messageType {
+	case websocket.PingMessage:
+		if ping != nil {
+			return true, ping(string(frame.data))
+		}
+		return true, nil // the default handler's pong is a no-op here
+	case websocket.PongMessage:
+		if pong != nil {
+			return true, pong(string(frame.data))
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (c *memConn) deliver(frame memFrame, limit int64) (int, []byte, error) {
+	if frame.messageType == websocket.CloseMessage {
+		return 0, nil, closeError(frame.data)
+	}
+	if limit > 0 && int64(len(frame.data)) > limit {
+		return 0, nil, websocket.ErrReadLimit
+	}
+	return frame.messageType, frame.data, nil
+}
+
+// closeError decodes a close frame payload the way gorilla reports it
+func closeError(data []byte) error {
+	ce := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+	if len(data) >= 2 {
+		ce.Code = int(data[0])<<8 | int(data[1])
+		ce.Text = string(data[2:])
+	}
+	return ce
+}
+
+func (c *memConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case c.out <- memFrame{messageType, append([]byte(nil), data...)}:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// WriteControl delivers close and pong frames to the peer. Pings are
+// answered instantly, as if by the peer.
+func (c *memConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.CloseMessage, websocket.PongMessage:
+		return c.WriteMessage(messageType, data)
+	case websocket.PingMessage:
+		c.mu.Lock()
+		h := c.pongHandler
+		c.mu.Unlock()
+		if h != nil {
+			return h(string(data))
+		}
+	}
+	return nil
+}
+
+func (c *memConn) SetPingHandler(h func(appData string) error) {
+	c.mu.Lock()
+	c.pingHandler = h
+	c.mu.Unlock()
+}
+
+func (c *memConn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	c.pongHandler = h
+	c.mu.Unlock()
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *memConn) SetReadLimit(limit int64) {
+	c.mu.Lock()
+	c.readLimit = limit
+	c.mu.Unlock()
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
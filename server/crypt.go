@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+)
+
+// sealer encrypts records at rest with AES-256-GCM. Each sealed record is
+// base64(nonce || ciphertext), so it fits on one line of a log file.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// newSealer takes a 32-byte key, hex or base64 encoded
+func newSealer(encoded string) (*sealer, error) {
+	key, ok := decodeKey(encoded)
+	if !ok || len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes, hex or base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead}, nil
+}
+
+func (s *sealer) seal(plain []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func (s *sealer) open(sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("sealed record too short")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// AUDIT_KEY encrypts AUDIT_FILE entries at rest, one sealed entry per line
+var auditSealer = loadSealer("AUDIT_KEY")
+
+func loadSealer(env string) *sealer {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil
+	}
+	s, err := newSealer(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", env, err)
+	}
+	return s
+}
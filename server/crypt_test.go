@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAuditKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestEncryptedAuditEntries(t *testing.T) {
+	s, err := newSealer(testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, &auditSealer, s)
+	setVar(t, &auditFile, filepath.Join(t.TempDir(), "audit.log"))
+	setVar(t, &auditLog, nil)
+	withAdmin(t)
+	audit(httptest.NewRequest(http.MethodPost, "/admin/kick", nil), "kick", "secret-target")
+
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("no audit entry written")
+	}
+	line := scanner.Text()
+	if strings.Contains(line, "secret-target") || strings.Contains(line, "kick") {
+		t.Errorf("audit entry stored in the clear: %s", line)
+	}
+
+	entry, err := readAuditLine(line)
+	if err != nil || entry.Action != "kick" || entry.Target != "secret-target" {
+		t.Errorf("decrypted %+v, %v", entry, err)
+	}
+	auditSealer = nil
+	if _, err := readAuditLine(line); err == nil {
+		t.Error("entry parsed without the key")
+	}
+	other, _ := newSealer(strings.Repeat("ab", 32))
+	auditSealer = other
+	if _, err := readAuditLine(line); err == nil {
+		t.Error("entry opened with the wrong key")
+	}
+}
+
+func TestSealerRejectsUnencodedKeys(t *testing.T) {
+	for _, key := range []string{
+		"a passphrase of exactly 32 chars", // 32 bytes, but not hex or base64
+		"0001020304",                       // too short
+	} {
+		if _, err := newSealer(key); err == nil {
+			t.Errorf("newSealer(%q) accepted", key)
+		}
+	}
+}
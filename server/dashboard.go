@@ -0,0 +1,38 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// The operator dashboard at /admin/ is a single page calling the admin
+// API. Browsers can't attach a bearer token to a page load, so it signs
+// in with HTTP Basic auth instead, an admin token as the password.
+//
+//go:embed dashboard/index.html
+var dashboardFS embed.FS
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	t := lookupAdmin(r)
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !t.allows(scopeRead) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	page, _ := dashboardFS.ReadFile("dashboard/index.html")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(page)
+}
+
+// dashboardRedirect sends /admin to /admin/, relative to the request so a
+// BASE_PATH prefix is kept, so the page's relative API URLs resolve
+func dashboardRedirect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Location", "admin/")
+	w.WriteHeader(http.StatusMovedPermanently)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboardRequiresAuth(t *testing.T) {
+	withAdmin(t)
+	rec := serve(httptest.NewRequest(http.MethodGet, "/admin/", nil))
+	if rec.Code != http.StatusUnauthorized || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Errorf("without credentials: %d (%q), want 401 with a Basic challenge", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	req.SetBasicAuth("admin", "wrong-token")
+	if rec := serve(req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d, want 401", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	req.SetBasicAuth("admin", testAdminToken)
+	rec = serve(req)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("signed in: %d (%s), want the page", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "<title>The Masked Garden admin</title>") {
+		t.Errorf("served %.100q, want the embedded dashboard", rec.Body)
+	}
+
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/admin", nil)); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "admin/" {
+		t.Errorf("/admin: %d to %q, want a redirect to admin/", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestDashboardNeedsReadScope(t *testing.T) {
+	withAdmin(t, scopeAnnounce)
+	req := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	req.SetBasicAuth("admin", testAdminToken)
+	if rec := serve(req); rec.Code != http.StatusForbidden {
+		t.Errorf("announce-only token: %d, want 403", rec.Code)
+	}
+}
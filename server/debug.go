@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Per-player frame logging, switched on for one player at a time through
+// /admin/debug to diagnose a laggy client without logging everyone. It
+// switches itself off after the requested duration, at most maxDebugFor.
+const maxDebugFor = 10 * time.Minute
+
+// debugging reports whether p's frames are being logged
+func (p *Player) debugging() bool {
+	until := p.debugUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// debugFrame logs one frame of p's traffic
+func (p *Player) debugFrame(direction string, data []byte) {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(data, &msg)
+	log.Printf("Player %d %s %q: %d bytes, queue %d/%d", p.ID, direction, msg.Type, len(data), len(p.send), cap(p.send))
+}
+
+// debugHandler enables frame logging for a player: {"id", "seconds"}
+func debugHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r, scopeOps) {
+		return
+	}
+
+	var req struct {
+		ID      uint64 `json:"id"`
+		Seconds int    `json:"seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Seconds <= 0 {
+		req.Seconds = 60
+	}
+	duration := min(time.Duration(req.Seconds)*time.Second, maxDebugFor)
+
+	found := findPlayers(req.ID)
+	if len(found) == 0 {
+		apiError(w, "Player not found", http.StatusNotFound)
+		return
+	}
+	until := time.Now().Add(duration)
+	for _, player := range found {
+		player.debugUntil.Store(until.UnixNano())
+	}
+	log.Printf("Logging frames of player %d for %s", req.ID, duration)
+	audit(r, "debug", strconv.FormatUint(req.ID, 10))
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugLogsOnlyThatPlayersFrames(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &auditFile, "")
+	watched, other := joinKey(t, "debug-watched"), joinKey(t, "debug-other")
+	logs := captureLog(t)
+
+	if rec := adminDo(http.MethodPost, "/admin/debug", fmt.Sprintf(`{"id":%d,"seconds":30}`, watched.id)); rec.Code != http.StatusOK {
+		t.Fatalf("debug: %d %s", rec.Code, rec.Body)
+	}
+	for _, c := range []*testClient{watched, other} {
+		c.send(`{"type":"ping"}`)
+		c.expect("pong")
+	}
+	for _, want := range []string{
+		fmt.Sprintf(`Player %d in "ping"`, watched.id),
+		fmt.Sprintf(`Player %d out "pong"`, watched.id),
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log is missing %q:\n%s", want, logs)
+		}
+	}
+	if strings.Contains(logs.String(), fmt.Sprintf("Player %d in", other.id)) {
+		t.Errorf("other player's frames logged:\n%s", logs)
+	}
+
+	// once the duration is up, logging stops by itself
+	findPlayers(watched.id)[0].debugUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	before := strings.Count(logs.String(), fmt.Sprintf("Player %d ", watched.id))
+	watched.send(`{"type":"ping"}`)
+	watched.expect("pong")
+	if after := strings.Count(logs.String(), fmt.Sprintf("Player %d ", watched.id)); after != before {
+		t.Errorf("frames still logged after expiry:\n%s", logs)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// DEDUPE_STATES leaves players whose state hasn't changed since they were
+// last sent out of players frames, so idle players cost nothing per tick.
+// Every DEDUPE_KEYFRAME a tick sends everyone again (a keyframe), for
+// viewers that missed a frame or just came into range. As with dead
+// reckoning, clients must merge players frames.
+var (
+	dedupeStates   = getEnvBool("DEDUPE_STATES", false)
+	dedupeKeyframe = positiveDuration(getEnvDuration("DEDUPE_KEYFRAME", 2*time.Second), 2*time.Second)
+)
+
+// dedupeState is what a room's ticks last sent: the state per player ID,
+// and when the last keyframe went out
+type dedupeState struct {
+	mu           sync.Mutex
+	lastSent     map[uint64]PlayerState
+	lastKeyframe time.Time
+}
+
+// dropUnchanged returns the states that changed since they were last
+// sent, or all of them on a keyframe tick
+func (d *dedupeState) dropUnchanged(states map[uint64]PlayerState, t time.Time) map[uint64]PlayerState {
+	if !dedupeStates {
+		return states
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t.Sub(d.lastKeyframe) >= dedupeKeyframe {
+		d.lastKeyframe = t
+		d.lastSent = maps.Clone(states)
+		return states
+	}
+	changed := make(map[uint64]PlayerState, len(states))
+	for id, state := range states {
+		if last, ok := d.lastSent[id]; ok && sameState(last, state) {
+			continue
+		}
+		changed[id] = state
+		d.lastSent[id] = state
+	}
+	for id := range d.lastSent {
+		if _, ok := states[id]; !ok {
+			delete(d.lastSent, id) // left
+		}
+	}
+	return changed
+}
+
+// sameState compares states by value, cube included
+func sameState(a, b PlayerState) bool {
+	ca, cb := a.Cube, b.Cube
+	a.Cube, b.Cube = nil, nil
+	if a != b || (ca == nil) != (cb == nil) {
+		return false
+	}
+	return ca == nil || *ca == *cb
+}
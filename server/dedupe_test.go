@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdlePlayerReturnsOnlyInKeyframes(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &rooms, newRooms("", ""))
+	setVar(t, &dedupeStates, true)
+	setVar(t, &dedupeKeyframe, 200*time.Millisecond)
+	viewer := joinKey(t, "dedupe-viewer")
+	mover := joinKey(t, "dedupe-mover")
+	idle, _ := newMemConnPair()
+	addPlayer(t, 3001, idle, 5)
+	mover.moveTo(1)
+
+	broadcastTick() // the first tick is a keyframe
+	if got := viewer.expect("players").Players; len(got) != 2 {
+		t.Fatalf("keyframe has %v, want the mover and the idle player", got)
+	}
+
+	mover.moveTo(2)
+	broadcastTick()
+	got := viewer.expect("players").Players
+	if _, ok := got[3001]; ok {
+		t.Error("idle player sent again before the keyframe")
+	}
+	if got[mover.id].X != 2 {
+		t.Errorf("mover at %v, want x=2", got[mover.id])
+	}
+
+	time.Sleep(dedupeKeyframe)
+	broadcastTick()
+	if got := viewer.expect("players").Players; got[3001].X != 5 || len(got) != 2 {
+		t.Errorf("keyframe has %v, want everyone again", got)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiagReport is what clients POST to /api/diag. It carries no identity,
+// only what helps tie client versions to performance problems.
+type DiagReport struct {
+	FPS       float64 `json:"fps"`
+	LatencyMs float64 `json:"latencyMs"`
+	Build     string  `json:"build,omitempty"`  // client bundle hash
+	Commit    string  `json:"commit,omitempty"` // game commit the client was built from
+}
+
+// Per IP, at most DIAG_RATE reports per second with bursts of DIAG_BURST
+var (
+	diagRate     = getEnvFloat("DIAG_RATE", 0.1)
+	diagBurst    = getEnvInt("DIAG_BURST", 3)
+	diagMaxBytes = int64(getEnvInt("DIAG_MAX_BYTES", 2048))
+)
+
+// Distinct builds and commits tracked; the rest are counted as "other"
+const maxDiagVersions = 100
+
+var versionPattern = regexp.MustCompile(`^[0-9A-Za-z._-]{1,64}$`)
+
+// Histogram counts values into buckets by upper bound; the last bucket
+// counts everything above the highest bound
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+}
+
+func newHistogram(bounds ...float64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(v float64) {
+	i := 0
+	for i < len(h.Bounds) && v > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+}
+
+// DiagStats aggregates the reports received since startup
+type DiagStats struct {
+	Reports   uint64            `json:"reports"`
+	Stale     uint64            `json:"stale"` // from a commit other than the deployed one
+	FPS       Histogram         `json:"fps"`
+	LatencyMs Histogram         `json:"latencyMs"`
+	Builds    map[string]uint64 `json:"builds"`
+	Commits   map[string]uint64 `json:"commits"`
+}
+
+var (
+	diagMu    sync.Mutex
+	diagStats = DiagStats{
+		FPS:       newHistogram(15, 30, 45, 60, 90, 120),
+		LatencyMs: newHistogram(25, 50, 100, 200, 400, 800),
+		Builds:    make(map[string]uint64),
+		Commits:   make(map[string]uint64),
+	}
+	diagLimiters = make(map[string]*rateLimiter)
+	diagSwept    time.Time // last eviction of refilled limiters
+)
+
+func validateDiag(d *DiagReport) error {
+	if math.IsNaN(d.FPS) || d.FPS < 0 || d.FPS > 1000 {
+		return errors.New("invalid fps")
+	}
+	if math.IsNaN(d.LatencyMs) || d.LatencyMs < 0 || d.LatencyMs > 60000 {
+		return errors.New("invalid latencyMs")
+	}
+	if d.Build != "" && !versionPattern.MatchString(d.Build) {
+		return errors.New("invalid build")
+	}
+	if d.Commit != "" && !versionPattern.MatchString(d.Commit) {
+		return errors.New("invalid commit")
+	}
+	return nil
+}
+
+// refilled reports whether a bucket idle since last is full again
+func refilled(last, now time.Time) bool {
+	return now.Sub(last).Seconds()*diagRate >= float64(diagBurst)
+}
+
+// allowDiag applies the per-IP report rate; callers hold diagMu. Once per
+// refill window, the buckets that refilled are dropped: they carry no
+// state, so the map only holds the IPs that reported within a window.
+func allowDiag(ip string, now time.Time) bool {
+	if refilled(diagSwept, now) {
+		for key, l := range diagLimiters {
+			if refilled(l.last, now) {
+				delete(diagLimiters, key)
+			}
+		}
+		diagSwept = now
+	}
+	l := diagLimiters[ip]
+	if l == nil {
+		l = newRateLimiter(diagRate, diagBurst)
+		diagLimiters[ip] = l
+	}
+	return l.allow(now)
+}
+
+// Abbreviated commits match by prefix only from this length, like git's
+// short hashes; shorter ones have to match exactly
+const minCommitPrefix = 7
+
+// staleCommit reports whether a client's commit, full or abbreviated,
+// differs from the deployed one
+func staleCommit(commit string) bool {
+	deployed := currentBuild().Commit
+	if commit == "" || deployed == "" || commit == deployed {
+		return false
+	}
+	short, full := commit, deployed
+	if len(short) > len(full) {
+		short, full = full, short
+	}
+	return len(short) < minCommitPrefix || !strings.HasPrefix(full, short)
+}
+
+// countVersion counts v in m, or under "other" once m is full
+func countVersion(m map[string]uint64, v string) {
+	if v == "" {
+		v = "unknown"
+	}
+	if _, ok := m[v]; !ok && len(m) >= maxDiagVersions {
+		v = "other"
+	}
+	m[v]++
+}
+
+func recordDiag(d DiagReport) {
+	stale := staleCommit(d.Commit)
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	diagStats.Reports++
+	if stale {
+		diagStats.Stale++
+	}
+	diagStats.FPS.observe(d.FPS)
+	diagStats.LatencyMs.observe(d.LatencyMs)
+	countVersion(diagStats.Builds, d.Build)
+	countVersion(diagStats.Commits, d.Commit)
+}
+
+func currentDiagStats() DiagStats {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	out := diagStats
+	out.FPS.Counts = append([]uint64(nil), diagStats.FPS.Counts...)
+	out.LatencyMs.Counts = append([]uint64(nil), diagStats.LatencyMs.Counts...)
+	out.Builds = maps.Clone(diagStats.Builds)
+	out.Commits = maps.Clone(diagStats.Commits)
+	return out
+}
+
+// diagHandler accepts one client diagnostics report
+func diagHandler(w http.ResponseWriter, r *http.Request) {
+	diagMu.Lock()
+	allowed := allowDiag(clientIP(r), time.Now())
+	diagMu.Unlock()
+	if !allowed {
+		apiError(w, "Too many reports", http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, diagMaxBytes)
+	var report DiagReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apiError(w, "Payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		apiError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateDiag(&report); err != nil {
+		apiError(w, fmt.Sprintf("Invalid report: %v", err), http.StatusBadRequest)
+		return
+	}
+	recordDiag(report)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postDiag(body, ip string) int {
+	req := httptest.NewRequest(http.MethodPost, "/api/diag", strings.NewReader(body))
+	req.RemoteAddr = ip + ":1234"
+	return serve(req).Code
+}
+
+func TestDiagnosticsAggregated(t *testing.T) {
+	withAdmin(t)
+	setVar(t, &diagStats, DiagStats{
+		FPS:       newHistogram(30, 60),
+		LatencyMs: newHistogram(50, 100),
+		Builds:    make(map[string]uint64),
+		Commits:   make(map[string]uint64),
+	})
+	setVar(t, &diagLimiters, make(map[string]*rateLimiter))
+	setVar(t, &diagBurst, 3)
+	setVar(t, &deployed, BuildInfo{Commit: "abc1234def"})
+
+	for _, body := range []string{
+		`{"fps":24,"latencyMs":40,"build":"b1","commit":"abc1234"}`,
+		`{"fps":59,"latencyMs":80,"build":"b1","commit":"abc1234"}`,
+		`{"fps":120,"latencyMs":300,"build":"b0","commit":"0ld0000"}`,
+	} {
+		if code := postDiag(body, "198.51.100.1"); code != http.StatusNoContent {
+			t.Fatalf("POST %s: %d", body, code)
+		}
+	}
+
+	var m Metrics
+	json.NewDecoder(adminDo(http.MethodGet, "/admin/metrics", "").Body).Decode(&m)
+	d := m.Diag
+	if d.Reports != 3 || d.Stale != 1 {
+		t.Errorf("%d reports, %d stale; want 3 with 1 stale", d.Reports, d.Stale)
+	}
+	if !slices.Equal(d.FPS.Counts, []uint64{1, 1, 1}) || !slices.Equal(d.LatencyMs.Counts, []uint64{1, 1, 1}) {
+		t.Errorf("histograms fps %v, latency %v; want one report per bucket", d.FPS.Counts, d.LatencyMs.Counts)
+	}
+	if d.Builds["b1"] != 2 || d.Commits["0ld0000"] != 1 {
+		t.Errorf("builds %v, commits %v", d.Builds, d.Commits)
+	}
+
+	// the IP's burst is used up; others can still report
+	if code := postDiag(`{"fps":60}`, "198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("report past the burst: %d, want 429", code)
+	}
+	if code := postDiag(`{"fps":60,"build":"`+strings.Repeat("x", 4096)+`"}`, "198.51.100.2"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized report: %d, want 413", code)
+	}
+}
+
+func TestStaleCommitNeedsSevenCharacterPrefix(t *testing.T) {
+	setVar(t, &deployed, BuildInfo{Commit: "abc1234def5678"})
+	for commit, want := range map[string]bool{
+		"":               false,
+		"abc1234def5678": false,
+		"abc1234":        false,
+		"abc123":         true,
+		"a":              true,
+		"abd1234":        true,
+	} {
+		if got := staleCommit(commit); got != want {
+			t.Errorf("staleCommit(%q) = %v, want %v", commit, got, want)
+		}
+	}
+
+	// a short deployed commit matches exactly too
+	deployed.Commit = "a"
+	if !staleCommit("abc1234") || staleCommit("a") {
+		t.Error("a one-character deployed commit matched by prefix")
+	}
+}
+
+func TestRefilledDiagLimitersEvicted(t *testing.T) {
+	setVar(t, &diagLimiters, make(map[string]*rateLimiter))
+	setVar(t, &diagSwept, time.Time{})
+	setVar(t, &diagRate, 0.1)
+	setVar(t, &diagBurst, 3)
+	window := 30 * time.Second // for the burst to refill at the rate
+
+	start := time.Now()
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		allowDiag(ip, start)
+	}
+	allowDiag("198.51.100.4", start.Add(window/2))
+	if len(diagLimiters) != 4 {
+		t.Fatalf("%d limiters within the window, want 4", len(diagLimiters))
+	}
+
+	allowDiag("198.51.100.5", start.Add(window))
+	if len(diagLimiters) != 2 || diagLimiters["198.51.100.4"] == nil {
+		t.Errorf("%d limiters after the window, want only .4 and .5", len(diagLimiters))
+	}
+}
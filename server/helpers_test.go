@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// setVar sets *p to v for the rest of the test
+func setVar[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() {
+		quiesce(t)
+		*p = old
+	})
+}
+
+// Teardowns that must run before any of the test's globals are restored,
+// by test
+var teardowns sync.Map
+
+// quiesce runs t's teardown, if it has one left
+func quiesce(t *testing.T) {
+	if teardown, ok := teardowns.LoadAndDelete(t); ok {
+		teardown.(func())()
+	}
+}
+
+// resetPlayers gives the test an empty player set. Player counts go out
+// right away instead of debounced. When the test ends, before any global
+// is restored, its players are closed, their sessions and write pumps
+// waited out and the timers still pending stopped, so nothing touches the
+// globals while they're restored.
+func resetPlayers(t *testing.T) {
+	t.Helper()
+	setVar(t, &players, newPlayerSet(4))
+	setVar(t, &playerCountDebounce, 0)
+	setVar(t, &pendingLeaves, make(map[leaveKey]*time.Timer))
+	// the pending flags stay set for the timers stopped at the end
+	setVar(t, &playerCountPending, false)
+	setVar(t, &peakSavePending, false)
+	timers := &timerSet{}
+	setVar(t, &afterFunc, timers.afterFunc)
+	teardowns.Store(t, func() {
+		for _, p := range players.Snapshot() {
+			p.close()
+		}
+		sessions.Wait()
+		writePumps.Wait()
+		timers.stop()
+	})
+	// registered last, so it runs first when no other global was set since
+	t.Cleanup(func() { quiesce(t) })
+}
+
+// timerSet starts timers like time.AfterFunc and keeps track of them
+type timerSet struct {
+	mu      sync.Mutex
+	timers  []*setTimer
+	stopped bool
+	firing  sync.WaitGroup // timers that may still run
+}
+
+type setTimer struct {
+	timer   *time.Timer
+	started bool // guarded by the set's mu
+	dropped bool // guarded by the set's mu
+}
+
+func (s *timerSet) afterFunc(d time.Duration, f func()) *time.Timer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &setTimer{dropped: s.stopped}
+	if !st.dropped {
+		s.firing.Add(1)
+		s.timers = append(s.timers, st)
+	}
+	st.timer = time.AfterFunc(d, func() {
+		s.mu.Lock()
+		run := !st.dropped
+		st.started = run
+		s.mu.Unlock()
+		if run {
+			defer s.firing.Done()
+			f()
+		}
+	})
+	return st.timer
+}
+
+// stop drops the timers that haven't fired, including any started later,
+// and waits for those already running
+func (s *timerSet) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for _, st := range s.timers {
+		if !st.started {
+			st.dropped = true
+			st.timer.Stop()
+			s.firing.Done()
+		}
+	}
+	s.mu.Unlock()
+	s.firing.Wait()
+}
+
+// testClient is the client end of a player session served over memConn
+type testClient struct {
+	t       *testing.T
+	conn    *memConn
+	id      uint64
+	welcome WSMessage
+}
+
+const testTimeout = 2 * time.Second
+
+// dial starts a player session without sending anything; the session is
+// closed and waited for when the test ends
+func dial(t *testing.T) *testClient {
+	t.Helper()
+	server, client := newMemConnPair()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		servePlayer(server, "192.0.2.1", func() {})
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return &testClient{t: t, conn: client}
+}
+
+// join connects a client that sends hello (raw JSON) and waits for its welcome
+func join(t *testing.T, hello string) *testClient {
+	t.Helper()
+	c := dial(t)
+	c.send(hello)
+	c.welcome = c.expect("welcome")
+	c.id = c.welcome.ID
+	return c
+}
+
+// joinKey joins with a hello carrying publicKey
+func joinKey(t *testing.T, publicKey string) *testClient {
+	t.Helper()
+	return join(t, `{"type":"hello","publicKey":"`+publicKey+`"}`)
+}
+
+// hue returns the color hue the client was welcomed with
+func (c *testClient) hue() float64 {
+	c.t.Helper()
+	if c.welcome.ColorHue == nil {
+		c.t.Fatal("welcome without colorHue")
+	}
+	return *c.welcome.ColorHue
+}
+
+// send writes msg, a raw JSON string or a value to marshal, as a text frame
+func (c *testClient) send(msg any) {
+	c.t.Helper()
+	data, ok := msg.(string)
+	if !ok {
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		data = string(encoded)
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(data)); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+// read returns the next frame, or the error that ended the connection
+func (c *testClient) read(timeout time.Duration) (int, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	return c.conn.ReadMessage()
+}
+
+// expectRaw reads until a text message of type typ arrives and returns it
+func (c *testClient) expectRaw(typ string) []byte {
+	c.t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		messageType, data, err := c.read(time.Until(deadline))
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if messageType == websocket.TextMessage && messageTypeOf(data) == typ {
+			return data
+		}
+	}
+}
+
+// expect reads until a message of type typ arrives and decodes it
+func (c *testClient) expect(typ string) WSMessage {
+	c.t.Helper()
+	var msg WSMessage
+	if err := json.Unmarshal(c.expectRaw(typ), &msg); err != nil {
+		c.t.Fatalf("decoding %s: %v", typ, err)
+	}
+	return msg
+}
+
+// expectNone fails if a message of type typ arrives within d
+func (c *testClient) expectNone(typ string, d time.Duration) {
+	c.t.Helper()
+	deadline := time.Now().Add(d)
+	for {
+		messageType, data, err := c.read(time.Until(deadline))
+		if err != nil {
+			return
+		}
+		if messageType == websocket.TextMessage && messageTypeOf(data) == typ {
+			c.t.Fatalf("unexpected %s: %s", typ, data)
+		}
+	}
+}
+
+// closed reads until the connection ends and returns the close frame the
+// server sent, or nil if it closed without one
+func (c *testClient) closed() *websocket.CloseError {
+	c.t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		_, _, err := c.read(time.Until(deadline))
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if errors.As(err, &ce) {
+			return ce
+		}
+		var timeout memTimeoutError
+		if errors.As(err, &timeout) {
+			c.t.Fatal("connection still open")
+		}
+		return nil
+	}
+}
+
+func messageTypeOf(data []byte) string {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(data, &msg)
+	return msg.Type
+}
+
+// waitFor polls cond until it holds, failing the test after testTimeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+const testAdminToken = "test-admin-token"
+
+// withAdmin configures a single admin token labeled "tester" with scopes,
+// all of them if none are given
+func withAdmin(t *testing.T, scopes ...string) {
+	t.Helper()
+	if len(scopes) == 0 {
+		scopes = []string{scopeAll}
+	}
+	setVar(t, &adminTokens, []AdminToken{{Label: "tester", Token: testAdminToken, Scopes: scopes}})
+}
+
+// serve sends a request through the server's routes
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// adminDo sends an admin API request with the test admin token
+func adminDo(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return serve(req)
+}
+
+// logBuffer collects log output, safe to write from any goroutine
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog collects the log output of the rest of the test
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	var b logBuffer
+	log.SetOutput(&b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &b
+}
+
+// withDist serves a temporary dist directory holding files (path -> contents)
+func withDist(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setVar(t, &distDir, dir)
+	return dir
+}
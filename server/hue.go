@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Color changes are announced with a transition duration so clients can
+// animate the shift (COLOR_TRANSITION, 0 = instant). With
+// SERVER_HUE_TRANSITION the server also interpolates the hue it sends in
+// player states, for clients that just render what they get.
+var (
+	colorTransition     = getEnvDuration("COLOR_TRANSITION", time.Second)
+	serverHueTransition = getEnvBool("SERVER_HUE_TRANSITION", false)
+)
+
+// hueAt returns the hue p shows at t, partway through a transition if one
+// is running; callers hold stateMu
+func (p *Player) hueAt(t time.Time) float64 {
+	if !serverHueTransition || p.hueFor <= 0 {
+		return p.ColorHue
+	}
+	progress := float64(t.Sub(p.hueSince)) / float64(p.hueFor)
+	if progress >= 1 {
+		return p.ColorHue
+	}
+	return lerpHue(p.hueFrom, p.ColorHue, max(progress, 0))
+}
+
+// lerpHue interpolates between hues the short way around the color wheel
+func lerpHue(from, to, progress float64) float64 {
+	delta := math.Mod(to-from+540, 360) - 180
+	return math.Mod(from+delta*progress+360, 360)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestColorChangeCarriesTransition(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &colorTransition, 750*time.Millisecond)
+	setVar(t, &rooms, newRooms("arena", ""))
+	target := joinKey(t, "transition-target")
+	observer := joinKey(t, "transition-observer")
+	elsewhere := joinRoom(t, "transition-elsewhere", "arena")
+
+	for _, tc := range []struct {
+		body string
+		hue  float64
+		ms   int64
+	}{
+		{fmt.Sprintf(`{"id":%d,"colorHue":200}`, target.id), 200, 750},
+		{fmt.Sprintf(`{"id":%d,"colorHue":40,"transitionMs":2000}`, target.id), 40, 2000},
+	} {
+		if rec := adminDo(http.MethodPost, "/admin/color", tc.body); rec.Code != http.StatusOK {
+			t.Fatalf("color: %d %s", rec.Code, rec.Body)
+		}
+		msg := observer.expect("colorChanged")
+		if msg.ID != target.id || msg.ColorHue == nil || *msg.ColorHue != tc.hue || msg.TransitionMs != tc.ms {
+			t.Errorf("colorChanged %+v, want hue %v over %dms", msg, tc.hue, tc.ms)
+		}
+	}
+	elsewhere.expectNone("colorChanged", 50*time.Millisecond)
+}
+
+func TestServerInterpolatesHue(t *testing.T) {
+	setVar(t, &serverHueTransition, true)
+	start := time.Now()
+	p := &Player{}
+	p.ColorHue, p.hueFrom, p.hueSince, p.hueFor = 20, 340, start, time.Second
+
+	// 340 to 20 goes the short way, through 0
+	for _, tc := range []struct {
+		at   time.Duration
+		want float64
+	}{{0, 340}, {500 * time.Millisecond, 0}, {time.Second, 20}, {2 * time.Second, 20}} {
+		if got := p.hueAt(start.Add(tc.at)); math.Abs(got-tc.want) > 1e-9 && math.Abs(got-tc.want) < 360-1e-9 {
+			t.Errorf("hue at %v = %v, want %v", tc.at, got, tc.want)
+		}
+	}
+
+	serverHueTransition = false
+	if got := p.hueAt(start); got != 20 {
+		t.Errorf("hue without server interpolation = %v, want the target 20", got)
+	}
+}
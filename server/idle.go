@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Idle players (connected, but neither moving nor interacting; unchanged
+// states and pings keep the connection alive but aren't activity) get an
+// idleWarning after IDLE_WARNING and are disconnected IDLE_GRACE later
+// unless they become active. IDLE_WARNING=0 disables this.
+var (
+	idleWarning = getEnvDuration("IDLE_WARNING", 0)
+	idleGrace   = getEnvDuration("IDLE_GRACE", time.Minute)
+)
+
+// clock is the time source for idle tracking, swappable for a fake one
+var clock = time.Now
+
+// markActive resets the idle timer; callers hold stateMu
+func (p *Player) markActive() {
+	p.lastActive = clock()
+	p.idleWarned = false
+}
+
+// moved reports whether a new state is actual movement. Clients keep
+// sending unchanged states while standing still, which isn't activity.
+func moved(prev, next PlayerState) bool {
+	return prev.X != next.X || prev.Y != next.Y || prev.Z != next.Z
+}
+
+// checkIdle warns players idle past IDLE_WARNING and disconnects those
+// still idle after the grace period
+func checkIdle() {
+	if idleWarning <= 0 {
+		return
+	}
+	now := clock()
+	var idle []*Player
+	for _, player := range connectedPlayers() {
+		player.stateMu.Lock()
+		idleFor := now.Sub(player.lastActive)
+		warn := idleFor >= idleWarning && !player.idleWarned
+		if warn {
+			player.idleWarned = true
+		}
+		expired := player.idleWarned && idleFor >= idleWarning+idleGrace
+		player.stateMu.Unlock()
+
+		switch {
+		case expired:
+			idle = append(idle, player)
+		case warn:
+			player.Send(WSMessage{Type: "idleWarning", SecondsLeft: int(idleGrace.Seconds())})
+		}
+	}
+
+	for _, player := range idle {
+		log.Printf("Player %d idle, disconnecting", player.ID)
+		closeWithReason(player.conn, websocket.CloseNormalClosure, leaveIdle)
+	}
+	disconnectPlayers(idle, leaveIdle)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdlePlayerWarnedThenDisconnected(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &disconnectGrace, 0)
+	setVar(t, &idleWarning, time.Minute)
+	setVar(t, &idleGrace, 30*time.Second)
+	start := time.Now()
+	var elapsed atomic.Int64
+	setVar(t, &clock, func() time.Time { return start.Add(time.Duration(elapsed.Load())) })
+	advance := func(d time.Duration) {
+		elapsed.Add(int64(d))
+		checkIdle()
+	}
+	observer := joinKey(t, "idle-observer")
+	idler := joinKey(t, "idler")
+	// pings keep the connection alive but aren't activity
+	ping := func() {
+		idler.send(`{"type":"ping"}`)
+		idler.expect("pong")
+	}
+
+	advance(59 * time.Second)
+	ping()
+	idler.expectNone("idleWarning", 20*time.Millisecond)
+	advance(2 * time.Second)
+	if msg := idler.expect("idleWarning"); msg.SecondsLeft != 30 {
+		t.Errorf("warned with %d seconds left, want 30", msg.SecondsLeft)
+	}
+
+	// moving is activity
+	idler.moveTo(1)
+	observer.moveTo(1)
+	advance(40 * time.Second)
+	idler.expectNone("idleWarning", 20*time.Millisecond)
+
+	ping()
+	advance(25 * time.Second)
+	idler.expect("idleWarning")
+	ping()
+	observer.moveTo(2)
+	advance(31 * time.Second)
+	if ce := idler.closed(); ce == nil || ce.Text != leaveIdle {
+		t.Errorf("closed with %v, want %q", ce, leaveIdle)
+	}
+	if msg := observer.expect("playerLeft"); msg.ID != idler.id || msg.Reason != leaveIdle {
+		t.Errorf("playerLeft %d (%q), want %d (%q)", msg.ID, msg.Reason, idler.id, leaveIdle)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// Interest management: each player only receives states of players within
+// their view distance. Clients declare it in hello or a viewDistance
+// message, capped at MAX_VIEW_DISTANCE; VIEW_DISTANCE is the default for
+// clients that don't. 0 means unlimited.
+var (
+	defaultViewDistance = getEnvFloat("VIEW_DISTANCE", 0)
+	maxViewDistance     = getEnvFloat("MAX_VIEW_DISTANCE", 0)
+)
+
+// clampViewDistance applies the default and the server-side cap to a
+// client's requested view distance
+func clampViewDistance(d float64) float64 {
+	if d <= 0 {
+		d = defaultViewDistance
+	}
+	if maxViewDistance > 0 && (d <= 0 || d > maxViewDistance) {
+		d = maxViewDistance
+	}
+	return d
+}
+
+// inView reports whether other is within radius of self (0 = unlimited)
+func inView(self, other PlayerState, radius float64) bool {
+	if radius <= 0 {
+		return true
+	}
+	dx, dy, dz := other.X-self.X, other.Y-self.Y, other.Z-self.Z
+	return dx*dx+dy*dy+dz*dz <= radius*radius
+}
+
+func validateViewDistance(msg *WSMessage) error {
+	d := msg.ViewDistance
+	if math.IsNaN(d) || math.IsInf(d, 0) || d < 0 {
+		return errors.New("viewDistance: must be a non-negative number")
+	}
+	return nil
+}
+
+func setViewDistance(p *Player, d float64) {
+	p.stateMu.Lock()
+	p.viewDistance = clampViewDistance(d)
+	p.stateMu.Unlock()
+}
+
+// A client can focus interest on a point other than its avatar, e.g. where
+// a spectating camera looks: neighbors are then picked around the focus.
+// A focus message without a position goes back to the avatar.
+func validateFocus(msg *WSMessage) error {
+	if p := msg.Position; p != nil {
+		return checkCoords("focus", p.X, p.Y, p.Z)
+	}
+	return nil
+}
+
+func setFocus(p *Player, focus *Position) {
+	p.stateMu.Lock()
+	p.focus = focus
+	p.stateMu.Unlock()
+}
+
+// interestCenter is where p's neighbors are picked around: its focus if
+// set, otherwise its own state; callers hold p.stateMu
+func (p *Player) interestCenter(self PlayerState) PlayerState {
+	if p.focus == nil {
+		return self
+	}
+	return PlayerState{X: p.focus.X, Y: p.focus.Y, Z: p.focus.Z}
+}
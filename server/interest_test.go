@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSmallViewDistanceGetsFewerNeighbors(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &maxViewDistance, 500)
+	nearsighted := join(t, `{"type":"hello","publicKey":"nearsighted","viewDistance":10}`)
+	farsighted := join(t, `{"type":"hello","publicKey":"farsighted","viewDistance":1000}`)
+	nearsighted.moveTo(0)
+	farsighted.moveTo(0)
+	for i, x := range []float64{5, 50, 499, 600} { // the last past the server-side cap
+		server, _ := newMemConnPair()
+		addPlayer(t, uint64(1001+i), server, x)
+	}
+
+	broadcastTick()
+	if got := nearsighted.expect("players").Players; len(got) != 2 {
+		t.Errorf("view distance 10 sees %d players, want 2 (the other client and the one at 5)", len(got))
+	}
+	far := farsighted.expect("players").Players
+	if _, capped := far[1004]; len(far) != 4 || capped {
+		t.Errorf("view distance 1000, capped at 500, sees %v, want 4 players without 1004", far)
+	}
+
+	// a viewDistance message widens the radius for later ticks
+	nearsighted.send(`{"type":"viewDistance","viewDistance":100}`)
+	nearsighted.send(`{"type":"ping"}`)
+	nearsighted.expect("pong")
+	broadcastTick()
+	if got := nearsighted.expect("players").Players; len(got) != 3 {
+		t.Errorf("view distance 100 sees %d players, want 3 (the other client, at 5 and at 50)", len(got))
+	}
+}
+
+func TestFocusChangesNeighbors(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &maxViewDistance, 500)
+	spectator := join(t, `{"type":"hello","publicKey":"spectator","viewDistance":10}`)
+	spectator.moveTo(0)
+	for i, x := range []float64{5, 300} {
+		server, _ := newMemConnPair()
+		addPlayer(t, uint64(1001+i), server, x)
+	}
+
+	broadcastTick()
+	if got := spectator.expect("players").Players; len(got) != 1 || got[1001].X != 5 {
+		t.Errorf("around the avatar sees %v, want only 1001", got)
+	}
+
+	spectator.send(`{"type":"focus","position":{"x":300,"y":0,"z":0}}`)
+	spectator.send(`{"type":"ping"}`)
+	spectator.expect("pong")
+	broadcastTick()
+	if got := spectator.expect("players").Players; len(got) != 1 || got[1002].X != 300 {
+		t.Errorf("around the focus sees %v, want only 1002", got)
+	}
+
+	// a focus without a position goes back to the avatar
+	spectator.send(`{"type":"focus"}`)
+	spectator.send(`{"type":"ping"}`)
+	spectator.expect("pong")
+	broadcastTick()
+	if _, ok := spectator.expect("players").Players[1001]; !ok {
+		t.Error("unfocused client lost the neighbor at its avatar")
+	}
+}
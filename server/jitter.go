@@ -0,0 +1,51 @@
+package main
+
+import (
+	"maps"
+	"math/rand/v2"
+	"time"
+)
+
+// TICK_JITTER staggers players frames across the tick instead of queueing
+// them all at once: each player gets a fixed random phase within its
+// room's tick interval and its frame is queued that long after the tick,
+// which smooths the write and client CPU spikes. In exchange frames arrive
+// up to one interval later.
+var tickJitter = getEnvBool("TICK_JITTER", false)
+
+// tickPhase picks a new player's offset into a tick of the given
+// interval, 0 without jitter
+func tickPhase(interval time.Duration) time.Duration {
+	if !tickJitter {
+		return 0
+	}
+	return rand.N(interval)
+}
+
+// sendStaggered sends p a players frame of states once p's phase has
+// passed. The frame is built then, without the players that left
+// meanwhile: their playerLeft may already have gone out, and a frame
+// queued after it would bring them back.
+func sendStaggered(p *Player, states, all map[uint64]PlayerState) {
+	afterFunc(p.phase, func() {
+		p.staggerMu.Lock()
+		defer p.staggerMu.Unlock()
+		current := all
+		for id := range all {
+			if len(players.Lookup(id)) > 0 {
+				continue
+			}
+			if len(current) == len(all) {
+				current = maps.Clone(all) // all is shared by the tick's frames
+			}
+			delete(current, id)
+			delete(states, id)
+		}
+		if len(states) == 0 {
+			return
+		}
+		if sendPlayersFrame(p, states, current) {
+			disconnectPlayers([]*Player{p}, leaveError)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStaggeredFramesSpreadAcrossInterval(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &tickJitter, true)
+	setVar(t, &rooms, newRooms("arena", "arena=50ms"))
+	phases := make(map[time.Duration]bool)
+	for i := range 20 {
+		c := joinRoom(t, fmt.Sprintf("phase-%d", i), "arena")
+		phase := findPlayers(c.id)[0].phase
+		if phase < 0 || phase >= 50*time.Millisecond {
+			t.Fatalf("phase %v outside the arena's 50ms interval", phase)
+		}
+		phases[phase] = true
+	}
+	if len(phases) < 10 {
+		t.Errorf("20 players got only %d distinct phases", len(phases))
+	}
+	setVar(t, &tickJitter, false)
+
+	early, late := joinKey(t, "early-phase"), joinKey(t, "late-phase")
+	early.moveTo(0)
+	late.moveTo(1)
+	findPlayers(early.id)[0].phase = 0
+	findPlayers(late.id)[0].phase = 200 * time.Millisecond
+
+	start := time.Now()
+	broadcastTick()
+	early.expect("players")
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("unstaggered frame took %v", d)
+	}
+	late.expect("players")
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("frame with a 200ms phase arrived after %v", d)
+	}
+}
+
+func TestStaggeredFrameLeavesOutDepartedPlayers(t *testing.T) {
+	resetPlayers(t)
+	c := joinKey(t, "staggered-viewer")
+	c.moveTo(0)
+	findPlayers(c.id)[0].phase = 100 * time.Millisecond
+	stay, _ := newMemConnPair()
+	addPlayer(t, 2001, stay, 1)
+	gone, _ := newMemConnPair()
+	leaving := addPlayer(t, 2002, gone, 2)
+
+	broadcastTick()
+	disconnectPlayers([]*Player{leaving}, leaveLeft)
+	if msg := c.expect("playerLeft"); msg.ID != 2002 {
+		t.Fatalf("playerLeft for %d, want 2002", msg.ID)
+	}
+	got := c.expect("players").Players
+	if _, ghost := got[2002]; ghost || len(got) != 1 {
+		t.Errorf("delayed frame has %v, want only 2001", got)
+	}
+}
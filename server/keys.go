@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// decodePublicKey normalizes a public key to raw bytes. Clients send base64
+// (the web client's format), but base64url, hex and PEM (SPKI) are accepted
+// too. Unrecognized keys fall back to the bytes of the string itself.
+func decodePublicKey(publicKey string) []byte {
+	raw, _ := decodeKey(publicKey)
+	return raw
+}
+
+// decodeKey is decodePublicKey, also reporting whether the key was in a
+// recognized encoding rather than taken as is
+func decodeKey(publicKey string) ([]byte, bool) {
+	key := strings.TrimSpace(publicKey)
+
+	if strings.HasPrefix(key, "-----BEGIN") {
+		if raw, ok := decodePEMKey(key); ok {
+			return raw, true
+		}
+		return []byte(publicKey), false
+	}
+
+	// Hex first: a hex string is also valid base64, but typical base64 keys
+	// (with padding or odd length) are never valid hex
+	if isHex(key) {
+		if raw, err := hex.DecodeString(key); err == nil {
+			return raw, true
+		}
+	}
+
+	// Strict, so a string with stray trailing bits isn't taken as base64:
+	// lenient decoding drops them, and distinct strings would share a key
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding.Strict(),
+		base64.URLEncoding.Strict(),
+		base64.RawStdEncoding.Strict(),
+		base64.RawURLEncoding.Strict(),
+	} {
+		if raw, err := enc.DecodeString(key); err == nil {
+			return raw, true
+		}
+	}
+
+	return []byte(publicKey), false
+}
+
+// KEY_FORMAT, when set, requires hello public keys to decode to a valid
+// key of that type, so garbage keys don't each claim an actor ID: "p256"
+// (the web client's ECDSA keys, raw uncompressed point), "x25519" or
+// "ed25519" (32 bytes; only the length is checked). A client with an
+// invalid key joins with a session ID, as without a key, or is refused
+// with KEY_INVALID=reject.
+var (
+	keyFormat         = parseKeyFormat(getEnv("KEY_FORMAT", ""))
+	rejectInvalidKeys = getEnv("KEY_INVALID", "fallback") == "reject"
+)
+
+func parseKeyFormat(format string) string {
+	switch format = strings.ToLower(format); format {
+	case "", "p256", "x25519", "ed25519":
+		return format
+	}
+	reportInvalidEnv("KEY_FORMAT", format, "any")
+	return ""
+}
+
+// validatePublicKey checks a hello public key against KEY_FORMAT
+func validatePublicKey(publicKey string) error {
+	if keyFormat == "" {
+		return nil
+	}
+	raw, ok := decodeKey(publicKey)
+	if !ok {
+		return errors.New("unrecognized key encoding")
+	}
+	switch keyFormat {
+	case "p256":
+		_, err := ecdh.P256().NewPublicKey(raw)
+		return err
+	case "x25519":
+		_, err := ecdh.X25519().NewPublicKey(raw)
+		return err
+	default: // ed25519
+		if len(raw) != ed25519.PublicKeySize {
+			return fmt.Errorf("ed25519 key must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+		}
+		return nil
+	}
+}
+
+func isHex(s string) bool {
+	if s == "" || len(s)%2 != 0 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// decodePEMKey extracts the raw key from a PEM-encoded SPKI public key, in
+// the same form WebCrypto's "raw" export produces
+func decodePEMKey(key string) ([]byte, bool) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, false
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return block.Bytes, true
+	}
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return []byte(k), true
+	case *ecdsa.PublicKey:
+		if ek, err := k.ECDH(); err == nil {
+			return ek.Bytes(), true
+		}
+	}
+	return block.Bytes, true
+}
+
+// canonicalKey is the form public keys are stored under, so the same key
+// in different encodings maps to the same actor
+func canonicalKey(publicKey string) string {
+	return base64.StdEncoding.EncodeToString(decodePublicKey(publicKey))
+}
+
+// safeKeyPrefix returns a short prefix of key for logs: at most 20 bytes
+// and never more than half the key, so a short key is never logged whole
+func safeKeyPrefix(key string) string {
+	n := min(20, len(key)/2)
+	return key[:n] + "..."
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKeyEncodingsShareHueAndActorID(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	raw := make([]byte, ed25519.PublicKeySize)
+	for i := range raw {
+		raw[i] = byte(i*7 + 250) // includes bytes that differ in base64 and base64url
+	}
+	spki, err := x509.MarshalPKIXPublicKey(ed25519.PublicKey(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodings := map[string]string{
+		"base64":    base64.StdEncoding.EncodeToString(raw),
+		"base64url": base64.RawURLEncoding.EncodeToString(raw),
+		"hex":       hex.EncodeToString(raw),
+		"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: spki})),
+	}
+
+	first := joinKey(t, encodings["base64"])
+	if hue := DeriveHue(raw); first.hue() != hue {
+		t.Errorf("base64: hue %v, want %v", first.hue(), hue)
+	}
+	for name, key := range encodings {
+		if got, ok := decodeKey(key); !ok || string(got) != string(raw) {
+			t.Errorf("%s: decoded %x (ok %v), want %x", name, got, ok, raw)
+			continue
+		}
+		c := dial(t)
+		c.send(map[string]string{"type": "hello", "publicKey": key})
+		c.welcome = c.expect("welcome")
+		if c.welcome.ID != first.id || c.hue() != first.hue() {
+			t.Errorf("%s: actor %d hue %v, want actor %d hue %v", name, c.welcome.ID, c.hue(), first.id, first.hue())
+		}
+	}
+}
+
+func TestNonCanonicalBase64IsNotDecoded(t *testing.T) {
+	// Lenient decoding drops the trailing bits, so both would decode alike
+	for _, key := range []string{"key-10", "key-11"} {
+		if raw, ok := decodeKey(key); ok {
+			t.Errorf("%q decoded as %x", key, raw)
+		}
+	}
+	if canonicalKey("key-10") == canonicalKey("key-11") {
+		t.Error("distinct keys share a canonical form")
+	}
+}
+
+func TestSafeKeyPrefix(t *testing.T) {
+	long := strings.Repeat("k", 64)
+	for key, want := range map[string]string{
+		"":     "...",
+		"a":    "...",
+		"abcd": "ab...",
+		long:   long[:20] + "...",
+	} {
+		got := safeKeyPrefix(key)
+		if got != want {
+			t.Errorf("safeKeyPrefix(%q) = %q, want %q", key, got, want)
+		}
+		if key != "" && strings.Contains(got, key) {
+			t.Errorf("safeKeyPrefix(%q) reveals the whole key", key)
+		}
+	}
+
+	// a one-character key joins and is logged without panicking
+	resetPlayers(t)
+	logs := captureLog(t)
+	joinKey(t, "k")
+	if strings.Contains(logs.String(), "public key k") {
+		t.Errorf("short key logged whole:\n%s", logs)
+	}
+}
+
+// Known hues, shared with the web client's deriveColorHue
+func TestDeriveHueVectors(t *testing.T) {
+	ramp := make([]byte, 32) // long enough for the hash to wrap
+	for i := range ramp {
+		ramp[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		key  []byte
+		want float64
+	}{
+		{nil, 0},
+		{[]byte("a"), 97},
+		{[]byte("hello"), 322},
+		{[]byte{0, 1, 2, 3}, 306},
+		{ramp, 96},
+	} {
+		if got := DeriveHue(tc.key); got != tc.want {
+			t.Errorf("DeriveHue(%q) = %v, want %v", tc.key, got, tc.want)
+		}
+	}
+	if got := deriveColorHue(base64.StdEncoding.EncodeToString(ramp)); got != 96 {
+		t.Errorf("deriveColorHue of the base64 key = %v, want 96", got)
+	}
+}
+
+func TestHueDriftWarning(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &hueParityCheck, true)
+	key := base64.StdEncoding.EncodeToString([]byte("hello"))
+	logs := captureLog(t)
+
+	join(t, `{"type":"hello","publicKey":"`+key+`","colorHue":322}`)
+	if strings.Contains(logs.String(), "algorithms differ") {
+		t.Errorf("warned about a matching hue:\n%s", logs)
+	}
+	join(t, `{"type":"hello","publicKey":"`+key+`","colorHue":10}`)
+	if !strings.Contains(logs.String(), "client derived hue 10, server derived 322") {
+		t.Errorf("no warning for a drifted hue:\n%s", logs)
+	}
+}
+
+func TestValidatePublicKey(t *testing.T) {
+	p256, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	offCurve := p256.PublicKey().Bytes()
+	offCurve[len(offCurve)-1] ^= 1
+
+	for _, tc := range []struct {
+		format, key string
+		valid       bool
+	}{
+		{"", "any garbage", true},
+		{"p256", b64(p256.PublicKey().Bytes()), true},
+		{"p256", b64(offCurve), false},
+		{"p256", b64(x25519.PublicKey().Bytes()), false},
+		{"x25519", hex.EncodeToString(x25519.PublicKey().Bytes()), true},
+		{"x25519", b64(make([]byte, 31)), false},
+		{"ed25519", b64(edKey), true},
+		{"ed25519", b64(p256.PublicKey().Bytes()), false},
+		{"ed25519", "not a key", false},
+	} {
+		setVar(t, &keyFormat, tc.format)
+		if err := validatePublicKey(tc.key); (err == nil) != tc.valid {
+			t.Errorf("%s key %.20q: error %v, want valid=%v", tc.format, tc.key, err, tc.valid)
+		}
+	}
+}
+
+func TestInvalidKeyFallsBackOrIsRejected(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	setVar(t, &keyFormat, "ed25519")
+	edKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	validKey := base64.StdEncoding.EncodeToString(edKey)
+	joinKey(t, validKey)
+	joinKey(t, "garbage-key") // joins with a session ID
+	pubKeyMu.Lock()
+	_, mapped := pubKeyToID[canonicalKey(validKey)]
+	n := len(pubKeyToID)
+	pubKeyMu.Unlock()
+	if !mapped || n != 1 {
+		t.Errorf("%d actor mappings, valid key mapped: %v; want only the valid key", n, mapped)
+	}
+
+	setVar(t, &rejectInvalidKeys, true)
+	c := dial(t)
+	c.send(`{"type":"hello","publicKey":"garbage-key"}`)
+	if ce := c.closed(); ce == nil || ce.Code != websocket.ClosePolicyViolation {
+		t.Errorf("rejected client closed with %v, want a policy violation", ce)
+	}
+}
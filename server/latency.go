@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With LATENCY_COMPENSATION, the server measures each player's round trip
+// with WebSocket pings (answered by the browser itself) and broadcasts
+// their position advanced along their velocity by half of it, roughly
+// where they are now rather than where they were when they sent it. The
+// advance is capped at MAX_COMPENSATION.
+var (
+	latencyCompensation = getEnvBool("LATENCY_COMPENSATION", false)
+	maxCompensation     = getEnvDuration("MAX_COMPENSATION", 250*time.Millisecond)
+	rttPingInterval     = positiveDuration(getEnvDuration("RTT_PING_INTERVAL", 5*time.Second), 5*time.Second)
+)
+
+// trackRTT measures the round trip of pings sent by pingPlayers; the pong
+// handler runs in the player's read loop
+func trackRTT(p *Player) {
+	p.conn.SetPongHandler(func(appData string) error {
+		if len(appData) != 8 {
+			return nil
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(appData))))
+		rtt := time.Since(sent)
+		if rtt < 0 {
+			return nil
+		}
+		if old := time.Duration(p.rtt.Load()); old > 0 {
+			rtt = (4*old + rtt) / 5 // smooth out jitter
+		}
+		p.rtt.Store(int64(rtt))
+		return nil
+	})
+}
+
+// pingPlayers sends every player a timestamped WebSocket ping every
+// RTT_PING_INTERVAL
+func pingPlayers() {
+	for {
+		time.Sleep(rttPingInterval)
+		for _, player := range connectedPlayers() {
+			var stamp [8]byte
+			binary.BigEndian.PutUint64(stamp[:], uint64(time.Now().UnixNano()))
+			// short deadline: a busy writer shouldn't stall the others' pings
+			player.conn.WriteControl(websocket.PingMessage, stamp[:], time.Now().Add(100*time.Millisecond))
+		}
+	}
+}
+
+// compensateLatency advances each state by half its player's round trip
+func compensateLatency(states map[uint64]PlayerState, list []*Player) {
+	if !latencyCompensation {
+		return
+	}
+	for _, player := range list {
+		advance := min(time.Duration(player.rtt.Load())/2, maxCompensation).Seconds()
+		state, ok := states[player.ID]
+		if !ok || advance <= 0 {
+			continue
+		}
+		state.X += state.VX * advance
+		state.Y += state.VY * advance
+		state.Z += state.VZ * advance
+		states[player.ID] = state
+	}
+}
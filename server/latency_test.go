@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBroadcastPositionAdvancedByHalfRTT(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		enabled bool
+		rtt     time.Duration
+		want    float64
+	}{
+		{"disabled", false, 100 * time.Millisecond, 1},
+		{"half of 100ms", true, 100 * time.Millisecond, 1.5},
+		{"capped", true, 2 * time.Second, 3.5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resetPlayers(t)
+			setVar(t, &latencyCompensation, tc.enabled)
+			setVar(t, &maxCompensation, 250*time.Millisecond)
+			observer := joinKey(t, "latency-observer")
+			mover := joinKey(t, "latency-mover")
+			mover.send(`{"type":"state","state":{"x":1,"y":0,"z":0,"vx":10,"vy":0,"vz":0}}`)
+			mover.send(`{"type":"ping"}`)
+			mover.expect("pong")
+			findPlayers(mover.id)[0].rtt.Store(int64(tc.rtt))
+
+			broadcastTick()
+			state, ok := observer.expect("players").Players[mover.id]
+			if !ok {
+				t.Fatal("mover missing from the players frame")
+			}
+			if math.Abs(state.X-tc.want) > 1e-9 {
+				t.Errorf("broadcast x = %v, want %v", state.X, tc.want)
+			}
+		})
+	}
+}
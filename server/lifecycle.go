@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reasons the server closes connections on its own, each with a suggested
+// reconnect delay. Clients wait delay plus a random share of jitter, so a
+// restart doesn't bring everyone back in the same instant.
+const (
+	closeShutdown    = "shutdown"    // server restarting
+	closeDraining    = "draining"    // server being taken out of service
+	closeOverload    = "overload"    // MAX_PLAYERS or the room's maxPlayers reached
+	closeMaintenance = "maintenance" // planned maintenance
+)
+
+var reconnectHints = map[string]struct {
+	code          int
+	delay, jitter time.Duration
+}{
+	closeShutdown:    {websocket.CloseGoingAway, 2 * time.Second, 8 * time.Second},
+	closeDraining:    {websocket.CloseGoingAway, 5 * time.Second, 10 * time.Second},
+	closeOverload:    {websocket.CloseTryAgainLater, 10 * time.Second, 20 * time.Second},
+	closeMaintenance: {websocket.CloseTryAgainLater, 30 * time.Second, 30 * time.Second},
+}
+
+// CloseReason is the JSON close frame reason for server-initiated closes
+type CloseReason struct {
+	Reason       string `json:"reason"`
+	RetryAfterMs int64  `json:"retryAfterMs"`
+}
+
+// closeWithBackoff closes conn with a JSON reason carrying a reconnect
+// hint, waiting at most timeout for the close frame to be written
+func closeWithBackoff(conn Conn, cause string, timeout time.Duration) {
+	hint := reconnectHints[cause]
+	retry := hint.delay
+	if hint.jitter > 0 {
+		retry += rand.N(hint.jitter)
+	}
+	reason, _ := json.Marshal(CloseReason{Reason: cause, RetryAfterMs: retry.Milliseconds()})
+	closeWithin(conn, hint.code, string(reason), timeout)
+}
+
+// MAX_PLAYERS turns away new connections beyond this many players (0 = no limit)
+var maxPlayers = getEnvInt("MAX_PLAYERS", 0)
+
+// draining is set while the server is being taken out of service
+var draining atomic.Bool
+
+// admissionRefusal returns why a new connection can't be admitted, or ""
+func admissionRefusal() string {
+	if maintenance.Load() {
+		return closeMaintenance
+	}
+	if draining.Load() {
+		return closeDraining
+	}
+	if maxPlayers > 0 && players.Len() >= maxPlayers {
+		return closeOverload
+	}
+	return ""
+}
+
+// Closing everyone at once writes the close frames from CLOSE_WORKERS
+// goroutines, each write bounded by CLOSE_WRITE_TIMEOUT, so a crowd of
+// slow clients can't stretch a shutdown out one timeout at a time
+var (
+	closeWorkers      = max(getEnvInt("CLOSE_WORKERS", 64), 1)
+	closeWriteTimeout = positiveDuration(getEnvDuration("CLOSE_WRITE_TIMEOUT", 250*time.Millisecond), 250*time.Millisecond)
+)
+
+// closeAllPlayers removes every player without leave broadcasts (everyone
+// is going) and closes their connections with a reconnect hint. Once ctx
+// is done, the remaining connections are closed without the hint.
+func closeAllPlayers(ctx context.Context, cause, reason string) int {
+	var list []*Player
+	for _, player := range connectedPlayers() {
+		if players.Remove(player) {
+			list = append(list, player)
+		}
+	}
+	disconnects.add(reason, len(list))
+
+	queue := make(chan *Player)
+	var wg sync.WaitGroup
+	for range min(closeWorkers, len(list)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for player := range queue {
+				if ctx.Err() == nil {
+					closeWithBackoff(player.conn, cause, closeWriteTimeout)
+				}
+				player.close()
+				recordReplay("leave", player.ID, nil)
+			}
+		}()
+	}
+	for _, player := range list {
+		queue <- player
+	}
+	close(queue)
+	wg.Wait()
+
+	log.Printf("Closed %d players (%s)", len(list), reason)
+	return len(list)
+}
+
+// shutdownPlayers tells everyone the server is going down, gives the
+// notice a moment to go out, then closes all connections
+func shutdownPlayers(ctx context.Context) {
+	broadcast(WSMessage{Type: "serverShutdown"})
+	flushQueues(ctx, time.Second)
+	closeAllPlayers(ctx, closeShutdown, leaveShutdown)
+}
+
+// flushQueues waits up to timeout for queued messages to be written,
+// including the one a write pump has taken off the queue but not yet sent
+func flushQueues(ctx context.Context, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, player := range connectedPlayers() {
+		for player.unsent.Load() > 0 && time.Now().Before(deadline) && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// drainHandler stops admitting players and closes the current ones with a
+// reconnect hint; DELETE undoes it
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, scopeOps) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		audit(r, "drain on", "")
+		draining.Store(true)
+		closeAllPlayers(context.Background(), closeDraining, "draining")
+	case http.MethodDelete:
+		audit(r, "drain off", "")
+		draining.Store(false)
+		log.Println("No longer draining")
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// In maintenance mode pages get a 503 maintenance page and players are
+// turned away, while assets, admin routes and the webhook keep working so
+// a fix can still be deployed. Toggled by MAINTENANCE or /admin/maintenance.
+var maintenance atomic.Bool
+
+// MAINTENANCE_PAGE is an HTML file served instead of the built-in page
+var maintenancePage = os.Getenv("MAINTENANCE_PAGE")
+
+const defaultMaintenancePage = `<!doctype html>
+<html><head><meta charset="utf-8"><title>Maintenance</title></head>
+<body><h1>Down for maintenance</h1><p>We'll be back shortly.</p></body></html>
+`
+
+func init() {
+	maintenance.Store(getEnvBool("MAINTENANCE", false))
+}
+
+// isAsset reports whether a path is a static file rather than a page
+func isAsset(path string) bool {
+	return strings.Contains(path, ".") && !strings.HasSuffix(path, ".html")
+}
+
+func serveMaintenancePage(w http.ResponseWriter) {
+	page := []byte(defaultMaintenancePage)
+	if maintenancePage != "" {
+		if data, err := os.ReadFile(maintenancePage); err == nil {
+			page = data
+		} else {
+			log.Printf("Failed to read maintenance page: %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "60")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+}
+
+// startMaintenance tells players about the maintenance and closes them
+// with a reconnect hint
+func startMaintenance() {
+	maintenance.Store(true)
+	broadcast(WSMessage{Type: "maintenance"})
+	flushQueues(context.Background(), time.Second)
+	closeAllPlayers(context.Background(), closeMaintenance, "maintenance")
+}
+
+// maintenanceHandler turns maintenance mode on (POST) or off (DELETE)
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, scopeOps) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		log.Println("Entering maintenance mode")
+		audit(r, "maintenance on", "")
+		startMaintenance()
+	case http.MethodDelete:
+		maintenance.Store(false)
+		log.Println("Leaving maintenance mode")
+		audit(r, "maintenance off", "")
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
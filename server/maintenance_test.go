@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMaintenanceServesPageAndRefusesPlayers(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	withDist(t, map[string]string{"index.html": "<title>garden</title>", "app.js": "js"})
+	t.Cleanup(func() { maintenance.Store(false) })
+	playing := joinKey(t, "playing")
+
+	if rec := adminDo(http.MethodPost, "/admin/maintenance", ""); rec.Code != http.StatusOK {
+		t.Fatalf("maintenance on: %d %s", rec.Code, rec.Body)
+	}
+	playing.expect("maintenance")
+	if ce := playing.closed(); ce == nil || !strings.Contains(ce.Text, `"reason":"maintenance"`) {
+		t.Errorf("playing client closed with %v, want reason maintenance", ce)
+	}
+
+	rec := serve(httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "maintenance") {
+		t.Errorf("GET /: %d %q, want the 503 maintenance page", rec.Code, rec.Body)
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/app.js", nil)); rec.Code != http.StatusOK {
+		t.Errorf("GET /app.js: %d, want assets served during maintenance", rec.Code)
+	}
+
+	ce := dial(t).closed()
+	if ce == nil || ce.Code != websocket.CloseTryAgainLater || !strings.Contains(ce.Text, `"reason":"maintenance"`) {
+		t.Errorf("new connection closed with %v, want try again later for maintenance", ce)
+	}
+
+	if rec := adminDo(http.MethodDelete, "/admin/maintenance", ""); rec.Code != http.StatusOK {
+		t.Fatalf("maintenance off: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/", nil)); rec.Code != http.StatusOK {
+		t.Errorf("GET / after maintenance: %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// typeCounters counts WebSocket messages keyed by message type
+type typeCounters struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newTypeCounters() *typeCounters {
+	return &typeCounters{counts: make(map[string]uint64)}
+}
+
+func (c *typeCounters) add(msgType string, n int) {
+	if n <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.counts[msgType] += uint64(n)
+	c.mu.Unlock()
+}
+
+// snapshot returns a copy of the counters, safe to serialize
+func (c *typeCounters) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		out[k] = v
+	}
+	return out
+}
+
+// Message traffic by type: inbound from clients, outbound per recipient
+var (
+	inboundMessages  = newTypeCounters()
+	outboundMessages = newTypeCounters()
+)
+
+// countInbound counts a received message, lumping types outside the protocol together
+func countInbound(msgType string) {
+	if _, ok := validators[msgType]; !ok {
+		msgType = "unknown"
+	}
+	inboundMessages.add(msgType, 1)
+}
+
+// Disconnects by leave reason (left, timeout, kicked, error, idle, ...)
+var disconnects = newTypeCounters()
+
+// State frames skipped because the recipient's send queue was backlogged
+var skippedFrames atomic.Uint64
+
+// Frames dropped because the recipient's send queue was full
+var droppedFrames atomic.Uint64
+
+// Peak is the most players ever connected at once, and when it happened
+type Peak struct {
+	Players int       `json:"players"`
+	At      time.Time `json:"at"`
+}
+
+// Peaks is the overall peak and the peak of each room that had players
+type Peaks struct {
+	Peak
+	Rooms map[string]Peak `json:"rooms,omitempty"`
+}
+
+// Peak concurrency, persisted to PEAK_FILE (if set) so it survives
+// restarts. Joins only mark it for saving; the file is written at most
+// once per peakSaveDelay, off the join path.
+var (
+	peaks           Peaks
+	peakMu          sync.Mutex
+	peakFile        = os.Getenv("PEAK_FILE")
+	peakSavePending bool
+	peakSaveMu      sync.Mutex // serializes writes to PEAK_FILE
+)
+
+var peakSaveDelay = time.Second
+
+// notePlayerCount raises the overall peak and the peak of room if their
+// current counts exceed them
+func notePlayerCount(room *Room) {
+	total, inRoom := players.Len(), len(room.players())
+	peakMu.Lock()
+	defer peakMu.Unlock()
+	raised := false
+	if total > peaks.Players {
+		peaks.Peak = Peak{Players: total, At: time.Now().UTC()}
+		raised = true
+	}
+	if inRoom > peaks.Rooms[room.ID].Players {
+		if peaks.Rooms == nil {
+			peaks.Rooms = make(map[string]Peak)
+		}
+		peaks.Rooms[room.ID] = Peak{Players: inRoom, At: time.Now().UTC()}
+		raised = true
+	}
+	if raised {
+		schedulePeakSave()
+	}
+}
+
+// resetPeak restarts the peaks from the current counts
+func resetPeak() {
+	now := time.Now().UTC()
+	reset := Peaks{Peak: Peak{Players: players.Len(), At: now}}
+	for _, r := range roomList() {
+		if n := len(r.players()); n > 0 {
+			if reset.Rooms == nil {
+				reset.Rooms = make(map[string]Peak)
+			}
+			reset.Rooms[r.ID] = Peak{Players: n, At: now}
+		}
+	}
+	peakMu.Lock()
+	defer peakMu.Unlock()
+	peaks = reset
+	schedulePeakSave()
+}
+
+func currentPeaks() Peaks {
+	peakMu.Lock()
+	defer peakMu.Unlock()
+	return Peaks{Peak: peaks.Peak, Rooms: maps.Clone(peaks.Rooms)}
+}
+
+// schedulePeakSave writes the peaks to PEAK_FILE after peakSaveDelay,
+// unless a write is already due; callers hold peakMu
+func schedulePeakSave() {
+	if peakFile == "" || peakSavePending {
+		return
+	}
+	peakSavePending = true
+	afterFunc(peakSaveDelay, func() {
+		peakMu.Lock()
+		peakSavePending = false
+		peakMu.Unlock()
+		savePeak()
+	})
+}
+
+// savePeak writes the current peaks to PEAK_FILE
+func savePeak() {
+	if peakFile == "" {
+		return
+	}
+	peakSaveMu.Lock()
+	defer peakSaveMu.Unlock()
+	data, _ := json.Marshal(currentPeaks())
+	if err := os.WriteFile(peakFile, data, 0644); err != nil {
+		log.Printf("Failed to save peak: %v", err)
+	}
+}
+
+// loadPeak restores the peaks persisted by a previous run
+func loadPeak() {
+	if peakFile == "" {
+		return
+	}
+	data, err := os.ReadFile(peakFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to load peak: %v", err)
+		}
+		return
+	}
+	peakMu.Lock()
+	defer peakMu.Unlock()
+	if err := json.Unmarshal(data, &peaks); err != nil {
+		log.Printf("Failed to parse %s: %v", peakFile, err)
+	}
+}
+
+type Metrics struct {
+	Players  int                       `json:"players"`
+	Peak     Peaks                     `json:"peak"`
+	Teams    map[string]map[string]int `json:"teams"` // by room, then team
+	Inbound  map[string]uint64         `json:"inbound"`
+	Outbound map[string]uint64         `json:"outbound"`
+	Skipped  uint64                    `json:"skippedFrames"`
+	Dropped  uint64                    `json:"droppedFrames"`
+	Leaves   map[string]uint64         `json:"disconnects"`
+	Diag     DiagStats                 `json:"diagnostics"`
+}
+
+func collectMetrics() Metrics {
+	return Metrics{
+		Players:  players.Len(),
+		Peak:     currentPeaks(),
+		Teams:    teamCounts(),
+		Inbound:  inboundMessages.snapshot(),
+		Outbound: outboundMessages.snapshot(),
+		Skipped:  skippedFrames.Load(),
+		Dropped:  droppedFrames.Load(),
+		Leaves:   disconnects.snapshot(),
+		Diag:     currentDiagStats(),
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, scopeRead) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collectMetrics())
+}
+
+func resetPeakHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r, scopeOps) {
+		return
+	}
+	audit(r, "reset peak", "")
+	resetPeak()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentPeaks())
+}
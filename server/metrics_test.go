@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMessageCountersBySentAndReceivedType(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &inboundMessages, newTypeCounters())
+	setVar(t, &outboundMessages, newTypeCounters())
+
+	c := joinKey(t, "counted")
+	c.send(`{"type":"ping"}`)
+	c.expect("pong")
+	c.send(`{"type":"bogus"}`)
+	c.expect("protocolError")
+
+	rec := adminDo(http.MethodGet, "/admin/metrics", "")
+	var m Metrics
+	if err := json.NewDecoder(rec.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	for typ, want := range map[string]uint64{"ping": 1, "unknown": 1} {
+		if m.Inbound[typ] != want {
+			t.Errorf("inbound %s = %d, want %d", typ, m.Inbound[typ], want)
+		}
+	}
+	for typ, want := range map[string]uint64{"welcome": 1, "pong": 1, "protocolError": 1} {
+		if m.Outbound[typ] != want {
+			t.Errorf("outbound %s = %d, want %d", typ, m.Outbound[typ], want)
+		}
+	}
+}
+
+func TestPeakHoldsAfterDisconnects(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &rooms, newRooms("arena,lobby", ""))
+	setVar(t, &peaks, Peaks{})
+	setVar(t, &peakFile, filepath.Join(t.TempDir(), "peak.json"))
+	setVar(t, &peakSaveDelay, 10*time.Millisecond)
+
+	arena := []*testClient{joinRoom(t, "a1", "arena"), joinRoom(t, "a2", "arena"), joinRoom(t, "a3", "arena")}
+	joinRoom(t, "l1", "lobby")
+	for _, c := range arena[:2] {
+		c.conn.Close()
+	}
+	waitFor(t, "two players to leave", func() bool { return players.Len() == 2 })
+	joinRoom(t, "l2", "lobby")
+
+	rec := adminDo(http.MethodGet, "/admin/metrics", "")
+	var m Metrics
+	if err := json.NewDecoder(rec.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Peak.Players != 4 {
+		t.Errorf("peak = %d, want 4", m.Peak.Players)
+	}
+	for room, want := range map[string]int{"arena": 3, "lobby": 2} {
+		if got := m.Peak.Rooms[room].Players; got != want {
+			t.Errorf("peak in %s = %d, want %d", room, got, want)
+		}
+	}
+
+	var saved Peaks
+	waitFor(t, "the peak to be saved", func() bool {
+		data, err := os.ReadFile(peakFile)
+		return err == nil && json.Unmarshal(data, &saved) == nil && saved.Rooms["lobby"].Players == 2
+	})
+	if saved.Players != 4 || saved.Rooms["arena"].Players != 3 {
+		t.Errorf("saved peaks = %+v", saved)
+	}
+}
+
+func TestBandwidthCountersTrackMessageSizes(t *testing.T) {
+	resetPlayers(t)
+	c := dial(t)
+	hello := `{"type":"hello","publicKey":"metered"}`
+	c.send(hello)
+	received := 0
+	for {
+		_, data, err := c.read(50 * time.Millisecond)
+		if err != nil {
+			break
+		}
+		received += len(data)
+	}
+	ping := `{"type":"ping"}`
+	c.send(ping)
+	received += len(c.expectRaw("pong"))
+
+	list := players.Snapshot()
+	if len(list) != 1 {
+		t.Fatalf("%d players, want 1", len(list))
+	}
+	p := list[0]
+	if got, want := p.bytesReceived.Load(), uint64(len(hello)+len(ping)); got != want {
+		t.Errorf("bytes received = %d, want %d", got, want)
+	}
+	if got := p.bytesSent.Load(); got != uint64(received) {
+		t.Errorf("bytes sent = %d, want the %d the client read", got, received)
+	}
+}
+
+func TestStateFrameLargerThanQuotaStillGoesOut(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &outboundQuota, 10)
+	observer := joinKey(t, "metered-observer")
+	joinKey(t, "metered-mover")
+
+	broadcastTick()
+	if frame := observer.expectRaw("players"); len(frame) <= outboundQuota {
+		t.Fatalf("frame of %d bytes fits the %d byte quota", len(frame), outboundQuota)
+	}
+}
+
+func TestQuotaDebtSpacesOversizedFrames(t *testing.T) {
+	start := time.Now()
+	l := newRateLimiter(100, 100)
+	l.last = start
+	if !l.allowDebt(start, 300) {
+		t.Fatal("full bucket refused an oversized frame")
+	}
+	if l.allowDebt(start.Add(time.Second), 300) {
+		t.Error("oversized frame allowed while repaying the debt")
+	}
+	if !l.allowDebt(start.Add(3*time.Second), 300) {
+		t.Error("oversized frame refused once the budget is full again")
+	}
+}
+
+func TestTimeoutCountedByReason(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &disconnects, newTypeCounters())
+	stale := joinKey(t, "stale")
+	joinKey(t, "lively")
+
+	p := findPlayers(stale.id)[0]
+	p.stateMu.Lock()
+	p.lastPing = time.Now().Add(-time.Minute)
+	p.stateMu.Unlock()
+	disconnectStale(time.Now())
+
+	rec := adminDo(http.MethodGet, "/admin/metrics", "")
+	var m Metrics
+	if err := json.NewDecoder(rec.Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Leaves[leaveTimeout] != 1 || len(m.Leaves) != 1 {
+		t.Errorf("disconnects = %v, want one timeout", m.Leaves)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+// Clients send the game commit they were built from in hello. One on a
+// commit other than the deployed one gets an advisory clientOutdated, so
+// it can prompt for a reload; it isn't disconnected. The notice waits
+// CLIENT_OUTDATED_GRACE after a deploy or join, giving players a moment
+// to finish what they're doing and CDNs to catch up. Negative disables it.
+var clientOutdatedGrace = getEnvDuration("CLIENT_OUTDATED_GRACE", 30*time.Second)
+
+// checkOutdated notifies the players still on an old commit once the
+// grace period passes
+func checkOutdated(list []*Player) {
+	if clientOutdatedGrace < 0 {
+		return
+	}
+	afterFunc(clientOutdatedGrace, func() {
+		deployed := currentBuild().Commit
+		for _, player := range list {
+			if !slices.Contains(players.Lookup(player.ID), player) || !staleCommit(player.commit) {
+				continue
+			}
+			player.stateMu.Lock()
+			notified := player.outdatedFor == deployed
+			player.outdatedFor = deployed
+			player.stateMu.Unlock()
+			if notified {
+				continue
+			}
+			log.Printf("Player %d is on commit %s, deployed is %s", player.ID, player.commit, deployed)
+			player.Send(WSMessage{Type: "clientOutdated", Commit: deployed, BuildTime: currentBuild().TimeString()})
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// capColumnar asks for players frames packed as parallel arrays, which is
+// much smaller than the ID-keyed map and faster to parse in JS. Packed
+// frames carry position, velocity, yaw, hue and (with teams) lightness;
+// cubes are only in the map format.
+const capColumnar = "columnar"
+
+// PackedPlayers is the columnar players frame: entry i of each array
+// belongs to ids[i]
+type PackedPlayers struct {
+	IDs       []uint64  `json:"ids"`
+	Xs        []float64 `json:"xs"`
+	Ys        []float64 `json:"ys"`
+	Zs        []float64 `json:"zs"`
+	VXs       []float64 `json:"vxs"`
+	VYs       []float64 `json:"vys"`
+	VZs       []float64 `json:"vzs"`
+	Yaws      []float64 `json:"yaws"`
+	Hues      []float64 `json:"hues"`
+	Lightness []float64 `json:"lightness,omitempty"`
+}
+
+// stringPacked is PackedPlayers with its IDs as strings, for stringIds
+// clients; the outer IDs shadow the embedded ones
+type stringPacked struct {
+	*PackedPlayers
+	IDs []string `json:"ids"`
+}
+
+func (p *PackedPlayers) withStringIDs() stringPacked {
+	ids := make([]string, len(p.IDs))
+	for i, id := range p.IDs {
+		ids[i] = strconv.FormatUint(id, 10)
+	}
+	return stringPacked{p, ids}
+}
+
+// packStates converts states to columns, ordered by ID
+func packStates(states map[uint64]PlayerState) *PackedPlayers {
+	n := len(states)
+	p := &PackedPlayers{
+		IDs: make([]uint64, 0, n),
+		Xs:  make([]float64, 0, n), Ys: make([]float64, 0, n), Zs: make([]float64, 0, n),
+		VXs: make([]float64, 0, n), VYs: make([]float64, 0, n), VZs: make([]float64, 0, n),
+		Yaws: make([]float64, 0, n), Hues: make([]float64, 0, n),
+	}
+	for id := range states {
+		p.IDs = append(p.IDs, id)
+	}
+	slices.Sort(p.IDs)
+
+	teams := false
+	for _, id := range p.IDs {
+		s := states[id]
+		p.Xs, p.Ys, p.Zs = append(p.Xs, s.X), append(p.Ys, s.Y), append(p.Zs, s.Z)
+		p.VXs, p.VYs, p.VZs = append(p.VXs, s.VX), append(p.VYs, s.VY), append(p.VZs, s.VZ)
+		p.Yaws, p.Hues = append(p.Yaws, s.Yaw), append(p.Hues, s.ColorHue)
+		teams = teams || s.Team != ""
+	}
+	if teams {
+		p.Lightness = make([]float64, 0, n)
+		for _, id := range p.IDs {
+			p.Lightness = append(p.Lightness, states[id].Lightness)
+		}
+	}
+	return p
+}
+
+// playersFrame encodes states in the format p negotiated, returning the
+// message type and frame; all is every connected player's state
+func playersFrame(p *Player, states, all map[uint64]PlayerState) (string, outFrame) {
+	if p.indexes != nil {
+		return "playersBinary", outFrame{websocket.BinaryMessage, p.indexes.encode(states, all)}
+	}
+	if p.columnar {
+		data := encodeMessage(WSMessage{Type: "playersPacked", Packed: packStates(states)}, p.stringIDs)
+		return "playersPacked", outFrame{websocket.TextMessage, data}
+	}
+	data := encodeMessage(WSMessage{Type: "players", Players: states}, p.stringIDs)
+	return "players", outFrame{websocket.TextMessage, data}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func testStates(n int) map[uint64]PlayerState {
+	states := make(map[uint64]PlayerState, n)
+	for i := range n {
+		states[uint64(1000+i*7)] = PlayerState{
+			X: float64(i) * 1.5, Y: 0.25, Z: -float64(i),
+			VX: 1, VY: float64(i % 3), VZ: -0.5, Yaw: float64(i%4) * 0.5,
+			ColorHue: float64(i * 11 % 360),
+		}
+	}
+	return states
+}
+
+func TestPackedStatesRoundTrip(t *testing.T) {
+	states := testStates(20)
+	data := encodeMessage(WSMessage{Type: "playersPacked", Packed: packStates(states)}, false)
+	var msg WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Packed == nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+	p := msg.Packed
+	if len(p.IDs) != len(states) || p.Lightness != nil {
+		t.Fatalf("decoded %d ids (lightness %v), want %d without lightness", len(p.IDs), p.Lightness, len(states))
+	}
+	for i, id := range p.IDs {
+		got := PlayerState{X: p.Xs[i], Y: p.Ys[i], Z: p.Zs[i], VX: p.VXs[i], VY: p.VYs[i], VZ: p.VZs[i], Yaw: p.Yaws[i], ColorHue: p.Hues[i]}
+		if got != states[id] {
+			t.Errorf("player %d = %+v, want %+v", id, got, states[id])
+		}
+	}
+}
+
+func TestPackedLightnessOnlyWithTeams(t *testing.T) {
+	packed := packStates(map[uint64]PlayerState{
+		1: {Team: "red", Lightness: 0.4},
+		2: {Team: "blue", Lightness: 0.6},
+	})
+	if len(packed.Lightness) != 2 || packed.Lightness[0] != 0.4 || packed.Lightness[1] != 0.6 {
+		t.Errorf("lightness = %v, want [0.4 0.6] in ID order", packed.Lightness)
+	}
+}
+
+func TestPackedFrameIsSmaller(t *testing.T) {
+	states := testStates(100)
+	mapped := encodeMessage(WSMessage{Type: "players", Players: states}, false)
+	packed := encodeMessage(WSMessage{Type: "playersPacked", Packed: packStates(states)}, false)
+	t.Logf("100 players: map %d bytes, packed %d bytes", len(mapped), len(packed))
+	if len(packed) >= len(mapped)*3/4 {
+		t.Errorf("packed frame is %d bytes, want well under the map's %d", len(packed), len(mapped))
+	}
+}
+
+func TestPackedIDsAsStrings(t *testing.T) {
+	states := testStates(3)
+	data := encodeMessage(WSMessage{Type: "playersPacked", Packed: packStates(states)}, true)
+	var msg struct {
+		Packed struct {
+			IDs []string  `json:"ids"`
+			Xs  []float64 `json:"xs"`
+		} `json:"packed"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("ids aren't strings: %v (%s)", err, data)
+	}
+	for i, s := range msg.Packed.IDs {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || states[id].X != msg.Packed.Xs[i] {
+			t.Errorf("ids[%d] = %q doesn't match its column", i, s)
+		}
+	}
+}
+
+func TestColumnarNegotiatedPerClient(t *testing.T) {
+	resetPlayers(t)
+	columnar := join(t, `{"type":"hello","publicKey":"columns","capabilities":["columnar"]}`)
+	plain := joinKey(t, "map")
+
+	broadcastTick()
+	msg := columnar.expect("playersPacked")
+	if msg.Packed == nil || len(msg.Packed.IDs) != 1 || msg.Packed.IDs[0] != plain.id {
+		t.Errorf("packed frame %+v, want just %d", msg.Packed, plain.id)
+	}
+	if _, ok := plain.expect("players").Players[columnar.id]; !ok {
+		t.Errorf("map client's frame is missing %d", columnar.id)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// playerSet holds the connected players, split into shards with their own
+// locks so joins, leaves and lookups on different shards never contend.
+// Per-player state has its own mutex on Player, so the read loops don't
+// touch the set at all. Each shard also indexes its players by ID, which
+// is also what picks the shard, for O(1) lookups.
+type playerSet struct {
+	shards []*playerShard
+}
+
+type playerShard struct {
+	mu      sync.RWMutex
+	players map[*Player]struct{}
+	byID    map[uint64][]*Player // sessions sharing an actor ID share an entry
+}
+
+// PLAYER_SHARDS sets the number of lock shards (1 = a single global mutex)
+var players = newPlayerSet(getEnvInt("PLAYER_SHARDS", 16))
+
+func newPlayerSet(n int) *playerSet {
+	if n < 1 {
+		n = 1
+	}
+	s := &playerSet{shards: make([]*playerShard, n)}
+	for i := range s.shards {
+		s.shards[i] = &playerShard{
+			players: make(map[*Player]struct{}),
+			byID:    make(map[uint64][]*Player),
+		}
+	}
+	return s
+}
+
+func (s *playerSet) shard(id uint64) *playerShard {
+	return s.shards[id%uint64(len(s.shards))]
+}
+
+func (s *playerSet) Add(p *Player) {
+	sh := s.shard(p.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.players[p]; ok {
+		return
+	}
+	sh.players[p] = struct{}{}
+	sh.byID[p.ID] = append(sh.byID[p.ID], p)
+}
+
+// Remove deletes p and reports whether it was still present
+func (s *playerSet) Remove(p *Player) bool {
+	sh := s.shard(p.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.players[p]; !ok {
+		return false
+	}
+	delete(sh.players, p)
+	sessions := slices.DeleteFunc(sh.byID[p.ID], func(q *Player) bool { return q == p })
+	if len(sessions) == 0 {
+		delete(sh.byID, p.ID)
+	} else {
+		sh.byID[p.ID] = sessions
+	}
+	return true
+}
+
+// Lookup returns the connected players with the given ID
+func (s *playerSet) Lookup(id uint64) []*Player {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return slices.Clone(sh.byID[id])
+}
+
+func (s *playerSet) Len() int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		n += len(sh.players)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// Snapshot returns all players, safe to iterate without locks. Shards are
+// read one at a time, so a concurrent join or leave may or may not show up.
+func (s *playerSet) Snapshot() []*Player {
+	var list []*Player
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for p := range sh.players {
+			list = append(list, p)
+		}
+		sh.mu.RUnlock()
+	}
+	return list
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+// BenchmarkStateUpdates runs the read loops' workload, mostly state updates
+// with some joins and leaves and the odd broadcast tick, against a single
+// global mutex (1 shard) and the default sharding
+func BenchmarkStateUpdates(b *testing.B) {
+	const n = 1024
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			set := newPlayerSet(shards)
+			for id := uint64(1); id <= n; id++ {
+				set.Add(&Player{ID: id})
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), 0))
+				churn := &Player{ID: n + 1 + r.Uint64N(n)}
+				for i := 0; pb.Next(); i++ {
+					switch {
+					case i%256 == 0:
+						_ = set.Snapshot()
+					case i%32 == 0:
+						if !set.Remove(churn) {
+							set.Add(churn)
+						}
+					default:
+						for _, p := range set.Lookup(1 + r.Uint64N(n)) {
+							p.stateMu.Lock()
+							p.state.X += 0.1
+							p.stateMu.Unlock()
+						}
+					}
+				}
+			})
+		})
+	}
+}
+
+// checkIndex fails the test if a shard's ID index and player set disagree
+func checkIndex(t *testing.T, s *playerSet) {
+	t.Helper()
+	for i, sh := range s.shards {
+		indexed := 0
+		for id, sessions := range sh.byID {
+			if len(sessions) == 0 {
+				t.Errorf("shard %d keeps an empty entry for %d", i, id)
+			}
+			for _, p := range sessions {
+				if _, ok := sh.players[p]; !ok || p.ID != id {
+					t.Errorf("shard %d indexes %d under %d but doesn't hold it", i, p.ID, id)
+				}
+			}
+			indexed += len(sessions)
+		}
+		if indexed != len(sh.players) {
+			t.Errorf("shard %d indexes %d players but holds %d", i, indexed, len(sh.players))
+		}
+	}
+}
+
+func TestIDIndexConsistentAcrossJoinsAndLeaves(t *testing.T) {
+	s := newPlayerSet(4)
+	rng := rand.New(rand.NewPCG(1, 2))
+	var live []*Player
+	for range 2000 {
+		if len(live) == 0 || rng.IntN(3) > 0 {
+			// few IDs, so sessions often share one
+			p := &Player{ID: uint64(rng.IntN(20))}
+			s.Add(p)
+			live = append(live, p)
+		} else {
+			i := rng.IntN(len(live))
+			if !s.Remove(live[i]) {
+				t.Fatalf("player %d missing at removal", live[i].ID)
+			}
+			live = append(live[:i], live[i+1:]...)
+		}
+	}
+	checkIndex(t, s)
+
+	counts := make(map[uint64]int)
+	for _, p := range live {
+		counts[p.ID]++
+	}
+	for id := range uint64(20) {
+		if got := len(s.Lookup(id)); got != counts[id] {
+			t.Errorf("Lookup(%d) = %d sessions, want %d", id, got, counts[id])
+		}
+	}
+	for _, p := range live {
+		s.Remove(p)
+	}
+	checkIndex(t, s)
+	if s.Len() != 0 || len(s.Lookup(0)) != 0 {
+		t.Errorf("%d players left after removing all", s.Len())
+	}
+}
+
+func TestIDIndexFollowsSessions(t *testing.T) {
+	resetPlayers(t)
+	first := joinKey(t, "two-tabs")
+	second := joinKey(t, "two-tabs")
+	if first.id != second.id || len(findPlayers(first.id)) != 2 {
+		t.Fatalf("sessions of one actor: ids %d and %d, %d indexed", first.id, second.id, len(findPlayers(first.id)))
+	}
+	first.conn.Close()
+	waitFor(t, "the first session to leave", func() bool { return len(findPlayers(second.id)) == 1 })
+	checkIndex(t, players)
+}
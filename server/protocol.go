@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Coordinates beyond this are treated as client bugs, not positions
+const maxCoord = 1e6
+
+// validators check the shape of each inbound message type before the read
+// loop acts on it. A type without a validator is unknown to the protocol.
+var validators = map[string]func(msg *WSMessage) error{
+	"ping":         validatePing,
+	"state":        validateState,
+	"reaction":     validateReaction,
+	"chat":         validateChat,
+	"input":        validateInput,
+	"viewDistance": validateViewDistance,
+	"focus":        validateFocus,
+	"visibility":   validateVisibility,
+	"ready":        func(*WSMessage) error { return nil },
+	"ack":          validateAck,
+}
+
+// STRICT_DECODE rejects inbound messages with keys the protocol doesn't
+// know, surfacing client bugs in development. Production stays lenient so
+// older servers tolerate newer clients.
+var strictDecode = getEnvBool("STRICT_DECODE", false)
+
+// decodeMessage parses an inbound message, strictly if STRICT_DECODE is set
+func decodeMessage(data []byte, msg *WSMessage) error {
+	if !strictDecode {
+		return json.Unmarshal(data, msg)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(msg); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("trailing data after message")
+	}
+	return nil
+}
+
+// validateMessage returns a protocol violation in msg, or nil if it is well-formed
+func validateMessage(msg *WSMessage) error {
+	validate, ok := validators[msg.Type]
+	if !ok {
+		return fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	return validate(msg)
+}
+
+// validatePing checks the optional position carried by low-rate clients
+func validatePing(msg *WSMessage) error {
+	if p := msg.Position; p != nil {
+		return checkCoords("position", p.X, p.Y, p.Z)
+	}
+	return nil
+}
+
+func validateState(msg *WSMessage) error {
+	if msg.State == nil {
+		return errors.New("state: missing state")
+	}
+	s := msg.State
+	if err := checkCoords("state", s.X, s.Y, s.Z, s.VX, s.VY, s.VZ, s.Yaw); err != nil {
+		return err
+	}
+	if c := s.Cube; c != nil {
+		if err := checkCoords("state.cube", c.X, c.Y, c.Z, c.VX, c.VY, c.VZ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateVisibility(msg *WSMessage) error {
+	if msg.Visible == nil {
+		return errors.New("visibility: missing visible")
+	}
+	return nil
+}
+
+func validateReaction(msg *WSMessage) error {
+	if !allowedReactions[msg.Emoji] {
+		return fmt.Errorf("reaction: emoji %q not allowed", msg.Emoji)
+	}
+	return nil
+}
+
+func checkCoords(field string, values ...float64) error {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%s: non-finite number", field)
+		}
+		if math.Abs(v) > maxCoord {
+			return fmt.Errorf("%s: value %g out of range", field, v)
+		}
+	}
+	return nil
+}
+
+// ClientConfig is sent in welcome so clients adapt to the server at runtime
+// instead of hardcoding assumptions. Bump clientConfigVersion on breaking changes.
+type ClientConfig struct {
+	Version         int             `json:"version"`
+	ServerName      string          `json:"serverName,omitempty"`
+	TickRateHz      float64         `json:"tickRateHz"`
+	WorldRadius     float64         `json:"worldRadius,omitempty"` // 0 = unbounded
+	WorldSeed       uint32          `json:"worldSeed"`
+	MaxViewDistance float64         `json:"maxViewDistance,omitempty"` // 0 = uncapped
+	Reactions       []string        `json:"reactions,omitempty"`
+	Actions         []string        `json:"actions,omitempty"`
+	Features        map[string]bool `json:"features"`
+}
+
+const clientConfigVersion = 1
+
+var (
+	serverName  = os.Getenv("SERVER_NAME")
+	worldRadius = getEnvFloat("WORLD_RADIUS", 0)
+)
+
+// clientConfig is the config for a player joining room
+func clientConfig(room *Room) *ClientConfig {
+	reactions := make([]string, 0, len(allowedReactions))
+	for code := range allowedReactions {
+		reactions = append(reactions, code)
+	}
+	sort.Strings(reactions)
+	actions := make([]string, 0, len(allowedActions))
+	for action := range allowedActions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	return &ClientConfig{
+		Version:         clientConfigVersion,
+		ServerName:      serverName,
+		TickRateHz:      float64(time.Second) / float64(room.interval),
+		WorldRadius:     worldRadius,
+		WorldSeed:       worldSeed,
+		MaxViewDistance: maxViewDistance,
+		Reactions:       reactions,
+		Actions:         actions,
+		Features: map[string]bool{
+			"announcements":       true,
+			"colorChanged":        true,
+			"reactions":           len(reactions) > 0,
+			"chat":                true,
+			"disconnectGrace":     disconnectGrace > 0,
+			"acks":                true,
+			"actions":             len(actions) > 0,
+			capStringIDs:          true,
+			capColumnar:           true,
+			capBatch:              coalesceWindow > 0,
+			capBinary:             true,
+			"serverHueTransition": serverHueTransition,
+			"deadReckoning":       reckoningEpsilon > 0,
+			"dedupeStates":        dedupeStates,
+			"omitZeroVelocity":    omitZeroVelocity,
+			"warmup":              warmup,
+			"clientOutdated":      clientOutdatedGrace >= 0,
+			"focus":               true,
+			"frameParts":          maxFrameSize > 0,
+		},
+	}
+}
+
+// capStringIDs asks for IDs as JSON strings, since IDs past 2^53 lose
+// precision as JavaScript numbers. Map keys (players) are strings anyway.
+const capStringIDs = "stringIds"
+
+// encodeMessage marshals msg, with its IDs as strings if stringIDs is set
+// and its states lean if omitZeroVelocity is on
+func encodeMessage(msg WSMessage, stringIDs bool) []byte {
+	lean := omitZeroVelocity && (msg.State != nil || msg.Players != nil)
+	if !stringIDs && !lean {
+		data, _ := json.Marshal(msg)
+		return data
+	}
+	// the shadowing fields win over WSMessage's; nil ones are omitted
+	out := struct {
+		WSMessage
+		ID      any `json:"id,omitempty"`
+		AckID   any `json:"ackId,omitempty"`
+		PartID  any `json:"partId,omitempty"`
+		State   any `json:"state,omitempty"`
+		Players any `json:"players,omitempty"`
+		Packed  any `json:"packed,omitempty"`
+	}{WSMessage: msg}
+	if stringIDs {
+		out.ID, out.AckID, out.PartID = idValue(msg.ID), idValue(uint64(msg.AckID)), idValue(msg.PartID)
+	} else {
+		out.ID, out.AckID, out.PartID = numValue(msg.ID), numValue(uint64(msg.AckID)), numValue(msg.PartID)
+	}
+	if msg.State != nil {
+		out.State = msg.State
+		if lean {
+			out.State = msg.State.lean()
+		}
+	}
+	if len(msg.Players) > 0 {
+		out.Players = msg.Players
+		if lean {
+			out.Players = leanStates(msg.Players)
+		}
+	}
+	if msg.Packed != nil {
+		out.Packed = msg.Packed
+		if stringIDs {
+			out.Packed = msg.Packed.withStringIDs()
+		}
+	}
+	data, _ := json.Marshal(out)
+	return data
+}
+
+// idValue is id as a string for stringIds clients, nil for no ID
+func idValue(id uint64) any {
+	if id == 0 {
+		return nil
+	}
+	return idString(id)
+}
+
+// numValue is id as a number, nil for no ID
+func numValue(id uint64) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// idString formats id for stringIds clients, "" for no ID
+func idString(id uint64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatUint(id, 10)
+}
+
+// flexID is an ID clients may send back as a JSON number or, with
+// stringIds, as the string they received
+type flexID uint64
+
+func (id *flexID) UnmarshalJSON(data []byte) error {
+	var n uint64
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		parsed, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid ID %q", s)
+		}
+		n = parsed
+	} else if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = flexID(n)
+	return nil
+}
+
+func protocolError(err error) WSMessage {
+	return WSMessage{Type: "protocolError", Error: err.Error()}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateMessage(t *testing.T) {
+	tests := []struct {
+		msg   string
+		valid bool
+	}{
+		{`{"type":"ping"}`, true},
+		{`{"type":"ping","position":{"x":1,"y":2,"z":3}}`, true},
+		{`{"type":"ping","position":{"x":2e6,"y":0,"z":0}}`, false},
+
+		{`{"type":"state","state":{"x":1,"y":2,"z":3,"vx":0,"vy":0,"vz":0}}`, true},
+		{`{"type":"state","state":{"x":1,"y":0,"z":0,"cube":{"x":1,"y":1,"z":1}}}`, true},
+		{`{"type":"state"}`, false},
+		{`{"type":"state","state":null}`, false},
+		{`{"type":"state","state":{"x":-1e7,"y":0,"z":0}}`, false},
+		{`{"type":"state","state":{"x":0,"y":0,"z":0,"cube":{"x":0,"y":1e9,"z":0}}}`, false},
+
+		{`{"type":"reaction","emoji":"wave"}`, true},
+		{`{"type":"reaction"}`, false},
+		{`{"type":"reaction","emoji":"bomb"}`, false},
+
+		{`{"type":"input","action":"jump"}`, true},
+		{`{"type":"input","action":"teleport"}`, false},
+
+		{`{"type":"viewDistance","viewDistance":50}`, true},
+		{`{"type":"viewDistance","viewDistance":-1}`, false},
+
+		{`{"type":"focus"}`, true},
+		{`{"type":"focus","position":{"x":0,"y":0,"z":-3e6}}`, false},
+
+		{`{"type":"visibility","visible":false}`, true},
+		{`{"type":"visibility"}`, false},
+
+		{`{"type":"ack","ackId":7}`, true},
+		{`{"type":"ack"}`, false},
+
+		{`{"type":"ready"}`, true},
+		{`{"type":"teleport"}`, false},
+		{`{}`, false},
+	}
+	for _, tt := range tests {
+		var msg WSMessage
+		if err := json.Unmarshal([]byte(tt.msg), &msg); err != nil {
+			t.Fatalf("%s: %v", tt.msg, err)
+		}
+		if err := validateMessage(&msg); (err == nil) != tt.valid {
+			t.Errorf("%s: error %v, want valid %v", tt.msg, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateStateRejectsNonFinite(t *testing.T) {
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		msg := WSMessage{Type: "state", State: &PlayerState{VY: v}}
+		if err := validateMessage(&msg); err == nil || !strings.Contains(err.Error(), "non-finite") {
+			t.Errorf("vy %v: error %v, want non-finite", v, err)
+		}
+	}
+}
+
+func TestInvalidMessageGetsProtocolError(t *testing.T) {
+	resetPlayers(t)
+	c := joinKey(t, "validation")
+
+	c.send(`{"type":"state"}`)
+	if msg := c.expect("protocolError"); msg.Error != "state: missing state" {
+		t.Errorf("error = %q", msg.Error)
+	}
+	c.send(`{"type":"state","state":`)
+	if msg := c.expect("protocolError"); !strings.HasPrefix(msg.Error, "invalid JSON") {
+		t.Errorf("error = %q", msg.Error)
+	}
+
+	// The session survives and keeps accepting valid messages
+	c.send(`{"type":"ping"}`)
+	c.expect("pong")
+}
+
+func TestStrictDecodeRejectsUnknownKeys(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &strictDecode, true)
+	c := joinKey(t, "strict")
+
+	c.send(`{"type":"ping","extra":1}`)
+	if msg := c.expect("protocolError"); !strings.Contains(msg.Error, `unknown field "extra"`) {
+		t.Errorf("error = %q, want the unknown field named", msg.Error)
+	}
+	c.send(`{"type":"ping"}`)
+	c.expect("pong")
+
+	strictDecode = false
+	c.send(`{"type":"ping","extra":1}`)
+	c.expect("pong")
+}
+
+func TestWelcomeCarriesConfig(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &tickInterval, 100*time.Millisecond)
+	setVar(t, &rooms, newRooms("arena", "arena=50ms"))
+	setVar(t, &serverName, "garden-test")
+	setVar(t, &disconnectGrace, time.Second)
+	c := joinKey(t, "config-reader")
+
+	cfg := c.welcome.Config
+	if cfg == nil {
+		t.Fatal("welcome without config")
+	}
+	if cfg.Version != clientConfigVersion || cfg.ServerName != "garden-test" || cfg.TickRateHz != 10 {
+		t.Errorf("config = version %d, name %q, %v Hz", cfg.Version, cfg.ServerName, cfg.TickRateHz)
+	}
+	for _, flag := range []string{"announcements", "colorChanged", "reactions", "disconnectGrace", "acks", capStringIDs, capColumnar, capBinary, "focus", "chat"} {
+		if !cfg.Features[flag] {
+			t.Errorf("feature %q = false, want true", flag)
+		}
+	}
+	if !slices.Contains(cfg.Reactions, "wave") {
+		t.Errorf("reactions = %v, want wave among them", cfg.Reactions)
+	}
+	if hz := joinRoom(t, "fast-config-reader", "arena").welcome.Config.TickRateHz; hz != 20 {
+		t.Errorf("arena tick rate %v Hz, want its own 20", hz)
+	}
+}
+
+func TestStringIDsEverywhere(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &announcements, nil)
+	setVar(t, &reactionInterval, 0)
+	setVar(t, &disconnectGrace, 0)
+	numericID := regexp.MustCompile(`"(id|ackId|partId)":\d`)
+	stringID := func(data []byte, field string, id uint64) {
+		t.Helper()
+		if numericID.Match(data) || !strings.Contains(string(data), fmt.Sprintf(`"%s":"%d"`, field, id)) {
+			t.Errorf("want %s %d as a string: %s", field, id, data)
+		}
+	}
+
+	c := dial(t)
+	c.send(`{"type":"hello","publicKey":"precise","capabilities":["stringIds"]}`)
+	welcome := c.expectRaw("welcome")
+	var w struct {
+		ID flexID `json:"id"`
+	}
+	if err := json.Unmarshal(welcome, &w); err != nil {
+		t.Fatal(err)
+	}
+	stringID(welcome, "id", uint64(w.ID))
+	other := joinKey(t, "numeric")
+
+	other.send(`{"type":"reaction","emoji":"wave"}`)
+	stringID(c.expectRaw("reaction"), "id", other.id)
+	other.send(`{"type":"input","action":"jump"}`)
+	stringID(c.expectRaw("playerAction"), "id", other.id)
+
+	adminDo(http.MethodPost, "/admin/announce", `{"text":"hi","ack":true}`)
+	announcement := c.expectRaw("announcement")
+	var a struct {
+		AckID flexID `json:"ackId"`
+	}
+	json.Unmarshal(announcement, &a)
+	stringID(announcement, "ackId", uint64(a.AckID))
+	c.send(fmt.Sprintf(`{"type":"ack","ackId":"%d"}`, a.AckID))
+	waitFor(t, "the string ack to count", func() bool {
+		acksMu.Lock()
+		defer acksMu.Unlock()
+		return deliveries[uint64(a.AckID)].Acked == 1
+	})
+
+	other.conn.Close()
+	stringID(c.expectRaw("playerLeft"), "id", other.id)
+}
+
+func TestNumericIDsWithoutCapability(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &reactionInterval, 0)
+	a, b := joinKey(t, "plain-a"), joinKey(t, "plain-b")
+	b.send(`{"type":"reaction","emoji":"wave"}`)
+	if data := a.expectRaw("reaction"); !strings.Contains(string(data), fmt.Sprintf(`"id":%d`, b.id)) {
+		t.Errorf("want a numeric id: %s", data)
+	}
+}
+
+func TestZeroVelocityOmittedOnlyWhenEnabled(t *testing.T) {
+	for _, omit := range []bool{false, true} {
+		t.Run(fmt.Sprintf("omit=%v", omit), func(t *testing.T) {
+			resetPlayers(t)
+			setVar(t, &omitZeroVelocity, omit)
+			observer := joinKey(t, "velocity-observer")
+			still := joinKey(t, "velocity-still")
+			mover := joinKey(t, "velocity-mover")
+			still.moveTo(1)
+			mover.send(`{"type":"state","state":{"x":2,"y":0,"z":0,"vx":3,"vy":0,"vz":0}}`)
+			mover.send(`{"type":"ping"}`)
+			mover.expect("pong")
+
+			broadcastTick()
+			var frame struct {
+				Players map[string]map[string]any `json:"players"`
+			}
+			if err := json.Unmarshal(observer.expectRaw("players"), &frame); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"vx", "vy", "vz"} {
+				if _, ok := frame.Players[fmt.Sprint(still.id)][key]; ok == omit {
+					t.Errorf("stationary player has %s: %v", key, ok)
+				}
+				if _, ok := frame.Players[fmt.Sprint(mover.id)][key]; !ok {
+					t.Errorf("moving player is missing %s", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+)
+
+// rateLimiter is a token bucket: up to burst events at once, refilled at
+// rate per second. Not safe for concurrent use.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow consumes a token if one is available
+func (l *rateLimiter) allow(now time.Time) bool {
+	return l.allowN(now, 1)
+}
+
+// allowN consumes n tokens if that many are available
+func (l *rateLimiter) allowN(now time.Time, n int) bool {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// allowDebt is allowN for events that may exceed the burst: a full bucket
+// lets one through on credit, and the debt is repaid before the next, so
+// oversized events pass at a proportionally lower rate instead of never
+func (l *rateLimiter) allowDebt(now time.Time, n int) bool {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < min(float64(n), l.burst) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// Global inbound budget per connection, across all message types: at most
+// MESSAGE_RATE frames per second with bursts of MESSAGE_BURST. Frames over
+// budget are dropped; MESSAGE_VIOLATIONS of them get the client disconnected,
+// unless MESSAGE_VIOLATION_WINDOW passes without one, which forgives the rest.
+var (
+	messageRate            = getEnvFloat("MESSAGE_RATE", 30)
+	messageBurst           = getEnvInt("MESSAGE_BURST", 60)
+	messageViolations      = getEnvInt("MESSAGE_VIOLATIONS", 20)
+	messageViolationWindow = getEnvDuration("MESSAGE_VIOLATION_WINDOW", 10*time.Second)
+)
+
+// violationCounter counts budget violations, starting over after a quiet
+// window so occasional bursts in a long session don't add up. Not safe
+// for concurrent use.
+type violationCounter struct {
+	count int
+	last  time.Time
+}
+
+// add records a violation at now and returns the count in the current run
+func (v *violationCounter) add(now time.Time) int {
+	if now.Sub(v.last) > messageViolationWindow {
+		v.count = 0
+	}
+	v.count++
+	v.last = now
+	return v.count
+}
+
+// semaphore is a non-blocking counting semaphore; nil means unlimited
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Reactions are floating emoji shown over an avatar. Only codes from
+// REACTION_EMOJIS are relayed, at most one per REACTION_INTERVAL per player.
+var (
+	allowedReactions = parseReactions(getEnv("REACTION_EMOJIS", "wave,heart,laugh,wow,sad,fire,clap,thumbsup"))
+	reactionInterval = getEnvDuration("REACTION_INTERVAL", 500*time.Millisecond)
+)
+
+func parseReactions(list string) map[string]bool {
+	allowed := make(map[string]bool)
+	for _, code := range strings.Split(list, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			allowed[code] = true
+		}
+	}
+	return allowed
+}
+
+// handleReaction relays a reaction to the nearby players in the room, tagged with the
+// sender's ID and current position. Reactions over the rate limit are dropped.
+func handleReaction(p *Player, emoji string) {
+	now := time.Now()
+	if now.Sub(p.lastReact) < reactionInterval {
+		return
+	}
+	p.lastReact = now
+
+	p.stateMu.Lock()
+	pos := Position{X: p.state.X, Y: p.state.Y, Z: p.state.Z}
+	p.stateMu.Unlock()
+
+	sendAll(playersNear(p, pos), WSMessage{Type: "reaction", ID: p.ID, Emoji: emoji, Position: &pos})
+}
+
+// playersNear returns the players in p's room other than p that have pos
+// in view, the same interest test the broadcast tick applies to states
+func playersNear(p *Player, pos Position) []*Player {
+	at := PlayerState{X: pos.X, Y: pos.Y, Z: pos.Z}
+	var near []*Player
+	for _, player := range p.room.players() {
+		if player == p {
+			continue
+		}
+		player.stateMu.Lock()
+		visible := inView(player.interestCenter(player.state), at, player.viewDistance)
+		player.stateMu.Unlock()
+		if visible {
+			near = append(near, player)
+		}
+	}
+	return near
+}
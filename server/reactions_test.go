@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// moveTo sends a state at x and waits until the server has applied it
+func (c *testClient) moveTo(x float64) {
+	c.t.Helper()
+	c.send(fmt.Sprintf(`{"type":"state","state":{"x":%g,"y":0,"z":0}}`, x))
+	c.send(`{"type":"ping"}`)
+	c.expect("pong")
+}
+
+func TestReactionReachesNearbyPlayersOnly(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &reactionInterval, 0)
+	reactor := joinKey(t, "reactor")
+	near := join(t, `{"type":"hello","publicKey":"near","viewDistance":10}`)
+	far := join(t, `{"type":"hello","publicKey":"far","viewDistance":10}`)
+	unlimited := joinKey(t, "unlimited")
+	reactor.moveTo(0)
+	near.moveTo(5)
+	far.moveTo(100)
+
+	reactor.send(`{"type":"reaction","emoji":"wave"}`)
+	for name, c := range map[string]*testClient{"near": near, "unlimited": unlimited} {
+		msg := c.expect("reaction")
+		if msg.ID != reactor.id || msg.Emoji != "wave" || msg.Position == nil || msg.Position.X != 0 {
+			t.Errorf("%s: reaction %+v, want wave from %d at the origin", name, msg, reactor.id)
+		}
+	}
+	far.expectNone("reaction", 50*time.Millisecond)
+	reactor.expectNone("reaction", 10*time.Millisecond)
+}
+
+func TestReactionRateLimited(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &reactionInterval, time.Hour)
+	reactor := joinKey(t, "eager")
+	other := joinKey(t, "watcher")
+
+	reactor.send(`{"type":"reaction","emoji":"heart"}`)
+	reactor.send(`{"type":"reaction","emoji":"fire"}`)
+	if msg := other.expect("reaction"); msg.Emoji != "heart" {
+		t.Errorf("first reaction = %q", msg.Emoji)
+	}
+	other.expectNone("reaction", 50*time.Millisecond)
+}
+
+func TestInputActionReachesNearbyPlayers(t *testing.T) {
+	resetPlayers(t)
+	actor := joinKey(t, "jumper")
+	near := join(t, `{"type":"hello","publicKey":"near","viewDistance":10}`)
+	far := join(t, `{"type":"hello","publicKey":"far","viewDistance":10}`)
+	actor.moveTo(0)
+	near.moveTo(5)
+	far.moveTo(100)
+
+	actor.send(`{"type":"input","action":"jump"}`)
+	if msg := near.expect("playerAction"); msg.ID != actor.id || msg.Action != "jump" {
+		t.Errorf("playerAction %+v, want jump from %d", msg, actor.id)
+	}
+	far.expectNone("playerAction", 50*time.Millisecond)
+	actor.expectNone("playerAction", 10*time.Millisecond)
+
+	actor.send(`{"type":"input","action":"teleport"}`)
+	if msg := actor.expect("protocolError"); msg.Error != `input: action "teleport" not allowed` {
+		t.Errorf("error = %q", msg.Error)
+	}
+	near.expectNone("playerAction", 20*time.Millisecond)
+}
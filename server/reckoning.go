@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// With DEAD_RECKONING_EPSILON set, a player is left out of the players
+// frame while their position stays within epsilon of where their last
+// broadcast state predicts (position + velocity*dt), since clients
+// extrapolate it anyway. Clients must then merge players frames instead of
+// replacing their view. Everyone is still sent at least every
+// DEAD_RECKONING_REFRESH, which heals skipped frames.
+var (
+	reckoningEpsilon = getEnvFloat("DEAD_RECKONING_EPSILON", 0)
+	reckoningRefresh = positiveDuration(getEnvDuration("DEAD_RECKONING_REFRESH", time.Second), time.Second)
+)
+
+type reckoned struct {
+	state PlayerState
+	at    time.Time
+}
+
+// reckoningState is the last state a room's ticks broadcast per player ID
+type reckoningState struct {
+	mu            sync.Mutex
+	lastBroadcast map[uint64]reckoned
+}
+
+// suppressPredictable drops states that clients can predict from the last
+// broadcast, remembering the ones that are sent
+func (r *reckoningState) suppressPredictable(states map[uint64]PlayerState, t time.Time) map[uint64]PlayerState {
+	if reckoningEpsilon <= 0 {
+		return states
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastBroadcast == nil {
+		r.lastBroadcast = make(map[uint64]reckoned)
+	}
+
+	sent := make(map[uint64]PlayerState, len(states))
+	for id, state := range states {
+		last, ok := r.lastBroadcast[id]
+		if ok && t.Sub(last.at) < reckoningRefresh && predictable(last.state, state, t.Sub(last.at)) {
+			continue
+		}
+		sent[id] = state
+		r.lastBroadcast[id] = reckoned{state, t}
+	}
+	for id := range r.lastBroadcast {
+		if _, ok := states[id]; !ok {
+			delete(r.lastBroadcast, id) // left
+		}
+	}
+	return sent
+}
+
+// predictable reports whether actual is within epsilon of last extrapolated
+// by dt
+func predictable(last, actual PlayerState, dt time.Duration) bool {
+	s := dt.Seconds()
+	dx := actual.X - (last.X + last.VX*s)
+	dy := actual.Y - (last.Y + last.VY*s)
+	dz := actual.Z - (last.Z + last.VZ*s)
+	return dx*dx+dy*dy+dz*dz <= reckoningEpsilon*reckoningEpsilon
+}
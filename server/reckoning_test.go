@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadReckoningOmitsPredictablePlayers(t *testing.T) {
+	setVar(t, &reckoningEpsilon, 0.1)
+	setVar(t, &reckoningRefresh, time.Minute)
+	var r reckoningState
+	start := time.Now()
+	first := map[uint64]PlayerState{
+		1: {X: 0, VX: 2},
+		2: {X: 0, VX: 2},
+	}
+	if sent := r.suppressPredictable(first, start); len(sent) != 2 {
+		t.Fatalf("first tick sent %d players, want both", len(sent))
+	}
+
+	// a second on, player 1 is where its velocity put it; player 2 turned back
+	later := map[uint64]PlayerState{
+		1: {X: 2.05, VX: 2},
+		2: {X: -1, VX: -1},
+	}
+	sent := r.suppressPredictable(later, start.Add(time.Second))
+	if _, ok := sent[1]; ok {
+		t.Error("player moving along its velocity was sent")
+	}
+	if _, ok := sent[2]; !ok {
+		t.Error("player that deviated was omitted")
+	}
+
+	// past the refresh interval everyone is sent again
+	reckoningRefresh = time.Second
+	later[1] = PlayerState{X: 6, VX: 2}
+	if sent := r.suppressPredictable(later, start.Add(3*time.Second)); len(sent) != 2 {
+		t.Errorf("refresh tick sent %v, want both players", sent)
+	}
+}
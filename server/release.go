@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// With ATOMIC_DIST, each build goes into its own directory under
+// RELEASES_DIR and DIST_DIR is a symlink swapped to it only once the build
+// succeeds, so the file server never sees a half-written dist. The newest
+// RELEASES_KEEP releases are kept, which also lets clients still holding an
+// older index.html load its hashed assets.
+var (
+	atomicDist   = getEnvBool("ATOMIC_DIST", false)
+	releasesDir  = getEnv("RELEASES_DIR", filepath.Join(filepath.Dir(distDir), "releases"))
+	releasesKeep = getEnvInt("RELEASES_KEEP", 3)
+)
+
+// PNPM_HOME is where the build finds pnpm when it isn't on PATH
+var pnpmHome = getEnv("PNPM_HOME", "/home/exedev/.local/share/pnpm")
+
+// lookPath finds build tools; a var so tests can fake missing ones
+var lookPath = exec.LookPath
+
+// checkBuildTools fails with an actionable message if a tool the deploy
+// needs is missing, before anything in the repo is touched
+func checkBuildTools() error {
+	if _, err := lookPath("git"); err != nil {
+		return errors.New("git not found on PATH; install git on the server")
+	}
+	if _, err := lookPath("pnpm"); err == nil {
+		return nil
+	}
+	if _, err := lookPath(filepath.Join(pnpmHome, "pnpm")); err == nil {
+		return nil
+	}
+	return fmt.Errorf("pnpm not found on PATH or in %s; install it (e.g. corepack enable pnpm) or set PNPM_HOME", pnpmHome)
+}
+
+// buildGame installs dependencies and builds the game into outDir, or into
+// the default game/dist if outDir is empty. A var so it can be faked.
+var buildGame = func(outDir string) ([]byte, error) {
+	build := "pnpm build"
+	if outDir != "" {
+		build = fmt.Sprintf("pnpm build --outDir %q --emptyOutDir", outDir)
+	}
+	cmd := exec.Command("bash", "-c", fmt.Sprintf("cd %s/game && export PNPM_HOME=%s && export PATH=$PNPM_HOME:$PATH && pnpm install && %s", repoDir, pnpmHome, build))
+	return cmd.CombinedOutput()
+}
+
+// DEPLOY_TEST_CMD, when set, runs in the game directory after the reset and
+// before the build, e.g. "pnpm test" or "pnpm lint". If it fails, or runs
+// past DEPLOY_TEST_TIMEOUT, the repo is reset back to the deployed commit
+// and nothing is deployed.
+var (
+	deployTestCmd     = os.Getenv("DEPLOY_TEST_CMD")
+	deployTestTimeout = positiveDuration(getEnvDuration("DEPLOY_TEST_TIMEOUT", 10*time.Minute), 10*time.Minute)
+)
+
+// runTests installs dependencies and runs DEPLOY_TEST_CMD. A var so it can
+// be faked.
+var runTests = func() ([]byte, error) {
+	return runScript(fmt.Sprintf("cd %s/game && export PNPM_HOME=%s && export PATH=$PNPM_HOME:$PATH && pnpm install && %s", repoDir, pnpmHome, deployTestCmd), deployTestTimeout)
+}
+
+// runScript runs script with bash and returns its output, killing it once
+// timeout has passed. The script runs in its own process group and the
+// whole group is killed: killing bash alone leaves its children (pnpm and
+// whatever it started) holding the output pipe open, and the wait with them.
+func runScript(script string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bash", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = scriptWaitDelay
+	return cmd.CombinedOutput()
+}
+
+// scriptWaitDelay bounds the wait for a killed script's output, in case a
+// process that left the group still holds the pipe
+var scriptWaitDelay = 5 * time.Second
+
+// rollbackRepo resets the repo to the deployed commit after a failed test
+// step, so it matches the dist that is still being served
+func rollbackRepo(commit string) {
+	if commit == "" {
+		buildLogf("Rollback skipped: previous commit unknown")
+		return
+	}
+	output, err := exec.Command("git", "-C", repoDir, "reset", "--hard", commit).CombinedOutput()
+	if err != nil {
+		buildLogf("Rollback to %s failed: %v\n%s", commit, err, output)
+		return
+	}
+	buildLogf("Rolled back to %s", commit)
+}
+
+// swapDist atomically points the DIST_DIR symlink at release. A DIST_DIR
+// that is still a plain directory, from before ATOMIC_DIST, is first moved
+// into RELEASES_DIR as a release of its own. If the swap fails, release is
+// removed: it was never served.
+func swapDist(release string) (err error) {
+	defer func() {
+		if err != nil {
+			os.RemoveAll(release)
+		}
+	}()
+	info, err := os.Lstat(distDir)
+	switch {
+	case err == nil && info.IsDir():
+		legacy := filepath.Join(releasesDir, info.ModTime().UTC().Format("20060102T150405")+"-legacy")
+		if err := os.Rename(distDir, legacy); err != nil {
+			return fmt.Errorf("moving the existing %s into %s: %w", distDir, releasesDir, err)
+		}
+		log.Printf("Moved the existing dist to %s", legacy)
+	case err == nil && info.Mode()&os.ModeSymlink == 0:
+		return fmt.Errorf("%s is neither a directory nor a symlink", distDir)
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+
+	tmp := distDir + ".next"
+	os.Remove(tmp)
+	if err := os.Symlink(release, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, distDir); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Printf("Now serving %s", release)
+	return nil
+}
+
+// pruneReleases removes all but the newest RELEASES_KEEP releases, never
+// the one being served
+func pruneReleases() {
+	entries, err := os.ReadDir(releasesDir)
+	if err != nil {
+		log.Printf("Failed to list releases: %v", err)
+		return
+	}
+	current, _ := filepath.EvalSymlinks(distDir)
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names))) // names are timestamps
+	for i, name := range names {
+		dir := filepath.Join(releasesDir, name)
+		if i < releasesKeep || dir == current {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove release %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Replay recording: every join, leave and state update is appended as one
+// NDJSON record to a file in REPLAY_DIR, optionally gzipped (REPLAY_GZIP)
+var (
+	replayDir  = os.Getenv("REPLAY_DIR")
+	replayGzip = getEnvBool("REPLAY_GZIP", false)
+	recorder   *replayRecorder // nil when recording is disabled
+)
+
+const replayFlushInterval = time.Second
+
+type ReplayRecord struct {
+	Time  int64        `json:"t"` // unix milliseconds
+	Type  string       `json:"type"`
+	ID    uint64       `json:"id"`
+	State *PlayerState `json:"state,omitempty"`
+}
+
+type replayRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer // nil when uncompressed
+	buf  *bufio.Writer
+	enc  *json.Encoder
+}
+
+func newReplayRecorder(path string, compress bool) (*replayRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &replayRecorder{file: f}
+	var w io.Writer = f
+	if compress {
+		r.gz = gzip.NewWriter(f)
+		w = r.gz
+	}
+	r.buf = bufio.NewWriter(w)
+	r.enc = json.NewEncoder(r.buf)
+	return r, nil
+}
+
+func (r *replayRecorder) Record(rec ReplayRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		log.Printf("Replay record failed: %v", err)
+	}
+}
+
+// Flush pushes buffered records to disk. Gzip output is sync-flushed, so a
+// recording cut off after this point is still readable up to here.
+func (r *replayRecorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.buf.Flush(); err != nil {
+		return err
+	}
+	if r.gz != nil {
+		return r.gz.Flush()
+	}
+	return nil
+}
+
+func (r *replayRecorder) Close() error {
+	if err := r.Flush(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gz != nil {
+		if err := r.gz.Close(); err != nil {
+			return err
+		}
+	}
+	return r.file.Close()
+}
+
+// startReplayRecorder opens a new recording when REPLAY_DIR is set
+func startReplayRecorder() {
+	if replayDir == "" {
+		return
+	}
+	name := fmt.Sprintf("replay-%s.ndjson", time.Now().UTC().Format("20060102-150405"))
+	if replayGzip {
+		name += ".gz"
+	}
+	path := filepath.Join(replayDir, name)
+	r, err := newReplayRecorder(path, replayGzip)
+	if err != nil {
+		log.Printf("Replay recording disabled: %v", err)
+		return
+	}
+	recorder = r
+	log.Printf("Recording replay to %s", path)
+
+	go func() {
+		for {
+			time.Sleep(replayFlushInterval)
+			if err := r.Flush(); err != nil {
+				log.Printf("Replay flush failed: %v", err)
+			}
+		}
+	}()
+}
+
+func recordReplay(msgType string, id uint64, state *PlayerState) {
+	if recorder == nil {
+		return
+	}
+	recorder.Record(ReplayRecord{Time: time.Now().UnixMilli(), Type: msgType, ID: id, State: state})
+}
+
+// loadReplay reads a recording, gzipped or not. An interrupted recording
+// yields every complete record before the point it was cut off.
+func loadReplay(path string) ([]ReplayRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var records []ReplayRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec ReplayRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A partial trailing line from an interrupted write
+			break
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return records, err
+	}
+	return records, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A Room is a world of its own: its players only see, hear and snapshot
+// each other, and its broadcast loop runs at its own rate. Clients pick a
+// room with roomId in hello; without one, or with one that isn't
+// configured, they join the main room. ROOMS lists the other rooms and
+// ROOM_TICK_INTERVALS their rates ("lobby=1s,arena=50ms", main included),
+// each defaulting to TICK_INTERVAL.
+type Room struct {
+	ID       string
+	interval time.Duration
+	info     RoomInfo // guarded by roomMu
+
+	dedupe    dedupeState    // used by the room's ticks only
+	reckoning reckoningState // used by the room's ticks only
+	chat      chatLog
+}
+
+const mainRoomID = "main"
+
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// rooms is fixed at startup, so it is read without locks
+var rooms = newRooms(getEnv("ROOMS", ""), getEnv("ROOM_TICK_INTERVALS", ""))
+
+// newRooms builds the main room plus the comma-separated ids, with tick
+// intervals from a comma-separated list of id=duration
+func newRooms(ids, intervals string) map[string]*Room {
+	main := &Room{ID: mainRoomID, interval: tickInterval, info: RoomInfo{Name: os.Getenv("ROOM_NAME"), MOTD: os.Getenv("ROOM_MOTD")}}
+	list := map[string]*Room{mainRoomID: main}
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if !roomIDPattern.MatchString(id) {
+			reportInvalidEnv("ROOMS", id, "the main room")
+			continue
+		}
+		list[id] = &Room{ID: id, interval: tickInterval}
+	}
+	for _, entry := range strings.Split(intervals, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, value, _ := strings.Cut(entry, "=")
+		r, ok := list[strings.TrimSpace(id)]
+		interval, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil || interval <= 0 {
+			reportInvalidEnv("ROOM_TICK_INTERVALS", entry, "TICK_INTERVAL")
+			continue
+		}
+		r.interval = interval
+	}
+	return list
+}
+
+// findRoom returns the room with id, or the main room if there is none
+func findRoom(id string) *Room {
+	if r, ok := rooms[id]; ok {
+		return r
+	}
+	return rooms[mainRoomID]
+}
+
+// roomList returns the rooms in ID order
+func roomList() []*Room {
+	list := make([]*Room, 0, len(rooms))
+	for _, r := range rooms {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// players returns the connected players in the room
+func (r *Room) players() []*Player {
+	var list []*Player
+	for _, player := range connectedPlayers() {
+		if player.room == r {
+			list = append(list, player)
+		}
+	}
+	return list
+}
+
+// broadcast sends msg to everyone in the room and returns the recipient count
+func (r *Room) broadcast(msg WSMessage) int {
+	return sendAll(r.players(), msg)
+}
+
+// RoomInfo is a room's metadata, sent in welcome and to the room's
+// players whenever it changes
+type RoomInfo struct {
+	Name       string `json:"name,omitempty"`
+	MaxPlayers int    `json:"maxPlayers,omitempty"` // 0 = MAX_PLAYERS alone
+	MOTD       string `json:"motd,omitempty"`
+}
+
+// ROOM_NAME and ROOM_MOTD set the main room's initial metadata. ROOM_FILE,
+// when set, overrides them with the metadata of each room, by room ID, and
+// keeps changes made through /admin/room across restarts. roomMu guards
+// every room's info.
+var (
+	roomFile = os.Getenv("ROOM_FILE")
+	roomMu   sync.RWMutex
+)
+
+const (
+	maxRoomName = 64
+	maxRoomMOTD = 500
+)
+
+func validateRoom(info RoomInfo) string {
+	switch {
+	case utf8.RuneCountInString(info.Name) > maxRoomName:
+		return "Name too long"
+	case utf8.RuneCountInString(info.MOTD) > maxRoomMOTD:
+		return "MOTD too long"
+	case info.MaxPlayers < 0:
+		return "Invalid maxPlayers"
+	}
+	return ""
+}
+
+// Info returns the room's metadata
+func (r *Room) Info() RoomInfo {
+	roomMu.RLock()
+	defer roomMu.RUnlock()
+	return r.info
+}
+
+// welcomeInfo is the room's metadata for welcome, nil when nothing is configured
+func (r *Room) welcomeInfo() *RoomInfo {
+	info := r.Info()
+	if info == (RoomInfo{}) {
+		return nil
+	}
+	return &info
+}
+
+// full reports whether the room has reached its maxPlayers
+func (r *Room) full() bool {
+	limit := r.Info().MaxPlayers
+	return limit > 0 && len(r.players()) >= limit
+}
+
+// loadRoom restores the metadata saved in ROOM_FILE. A file holding a
+// single room's metadata, as written before rooms existed, is the main
+// room's.
+func loadRoom() {
+	if roomFile == "" {
+		return
+	}
+	data, err := os.ReadFile(roomFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to load room: %v", err)
+		}
+		return
+	}
+	var infos map[string]RoomInfo
+	if err := json.Unmarshal(data, &infos); err != nil {
+		var info RoomInfo
+		if json.Unmarshal(data, &info) != nil {
+			log.Printf("Failed to parse %s: %v", roomFile, err)
+			return
+		}
+		infos = map[string]RoomInfo{mainRoomID: info}
+	}
+	roomMu.Lock()
+	defer roomMu.Unlock()
+	for id, info := range infos {
+		r, ok := rooms[id]
+		if !ok {
+			log.Printf("Ignoring %s entry for unknown room %q", roomFile, id)
+			continue
+		}
+		if msg := validateRoom(info); msg != "" {
+			log.Printf("Ignoring %s entry for room %s: %s", roomFile, id, msg)
+			continue
+		}
+		r.info = info
+	}
+}
+
+// saveRoom writes every room's metadata to ROOM_FILE; callers hold roomMu
+func saveRoom() {
+	if roomFile == "" {
+		return
+	}
+	infos := make(map[string]RoomInfo)
+	for id, r := range rooms {
+		if r.info != (RoomInfo{}) {
+			infos[id] = r.info
+		}
+	}
+	data, _ := json.Marshal(infos)
+	if err := os.WriteFile(roomFile, data, 0644); err != nil {
+		log.Printf("Failed to save room: %v", err)
+	}
+}
+
+// roomHandler returns the metadata of the room given by id (the main room
+// by default) on GET and replaces it on POST, telling the room's players
+func roomHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = mainRoomID
+	}
+	target, ok := rooms[id]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !requireAdmin(w, r, scopeRead) {
+			return
+		}
+		if !ok {
+			apiError(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(target.Info())
+
+	case http.MethodPost:
+		if !requireAdmin(w, r, scopeAnnounce) {
+			return
+		}
+		if !ok {
+			apiError(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		var info RoomInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			apiError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if msg := validateRoom(info); msg != "" {
+			apiError(w, msg, http.StatusBadRequest)
+			return
+		}
+		roomMu.Lock()
+		target.info = info
+		saveRoom()
+		roomMu.Unlock()
+
+		audit(r, "room", id)
+		target.broadcast(WSMessage{Type: "room", Room: &info})
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "OK")
+
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// joinRoom joins room with a hello carrying publicKey
+func joinRoom(t *testing.T, publicKey, room string) *testClient {
+	t.Helper()
+	c := join(t, fmt.Sprintf(`{"type":"hello","publicKey":%q,"roomId":%q}`, publicKey, room))
+	if c.welcome.RoomID != room {
+		t.Fatalf("joined room %q, want %q", c.welcome.RoomID, room)
+	}
+	return c
+}
+
+// countFrames counts the messages of type typ that arrive within d
+func (c *testClient) countFrames(typ string, d time.Duration) int {
+	n := 0
+	deadline := time.Now().Add(d)
+	for {
+		_, data, err := c.read(time.Until(deadline))
+		if err != nil {
+			return n
+		}
+		if messageTypeOf(data) == typ {
+			n++
+		}
+	}
+}
+
+func TestRoomsTickAtTheirOwnRates(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &rooms, newRooms("fast,slow", "fast=20ms,slow=100ms"))
+	fast := joinRoom(t, "fast-1", "fast")
+	joinRoom(t, "fast-2", "fast")
+	slow := joinRoom(t, "slow-1", "slow")
+	joinRoom(t, "slow-2", "slow")
+
+	stop := make(chan struct{})
+	go broadcastPlayerStates(rooms["fast"], stop)
+	go broadcastPlayerStates(rooms["slow"], stop)
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+
+	fastFrames := fast.countFrames("players", 50*time.Millisecond)
+	slowFrames := slow.countFrames("players", 50*time.Millisecond)
+	if slowFrames < 2 || slowFrames > 6 {
+		t.Errorf("slow room sent %d frames in 500ms at 100ms, want about 5", slowFrames)
+	}
+	if fastFrames < 3*slowFrames {
+		t.Errorf("fast room sent %d frames, slow room %d; want fast at several times the rate", fastFrames, slowFrames)
+	}
+}
+
+func TestRoomsAreIsolated(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	setVar(t, &rooms, newRooms("arena,lobby", ""))
+	setVar(t, &reactionInterval, 0)
+	setVar(t, &disconnectGrace, 0)
+	a1 := joinRoom(t, "a1", "arena")
+	a2 := joinRoom(t, "a2", "arena")
+	l1 := joinRoom(t, "l1", "lobby")
+
+	broadcastTick()
+	frame := a1.expect("players").Players
+	if _, ok := frame[a2.id]; !ok || len(frame) != 1 {
+		t.Errorf("arena frame = %v, want only player %d", frame, a2.id)
+	}
+	l1.expectNone("players", 20*time.Millisecond)
+
+	l2 := dial(t)
+	l2.send(`{"type":"hello","publicKey":"l2","roomId":"lobby"}`)
+	if snapshot := l2.readSnapshot(); len(snapshot) != 1 || snapshot[l1.id] == (PlayerState{}) {
+		t.Errorf("lobby snapshot = %v, want only player %d", snapshot, l1.id)
+	}
+
+	a1.send(`{"type":"reaction","emoji":"wave"}`)
+	a2.expect("reaction")
+	l1.expectNone("reaction", 20*time.Millisecond)
+
+	a2.conn.Close()
+	if msg := a1.expect("playerLeft"); msg.ID != a2.id {
+		t.Errorf("playerLeft for %d, want %d", msg.ID, a2.id)
+	}
+	l1.expectNone("playerLeft", 20*time.Millisecond)
+}
+
+func TestUnknownRoomJoinsMain(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &rooms, newRooms("arena", ""))
+	c := join(t, `{"type":"hello","publicKey":"lost","roomId":"nowhere"}`)
+	if c.welcome.RoomID != mainRoomID {
+		t.Errorf("joined %q, want %q", c.welcome.RoomID, mainRoomID)
+	}
+}
+
+func TestNewRoomsSkipsInvalidEntries(t *testing.T) {
+	setVar(t, &invalidEnv, nil)
+	list := newRooms("ok, bad id ,also_ok", "ok=50ms,missing=1s,also_ok=soon")
+	if len(list) != 3 || list["ok"] == nil || list["also_ok"] == nil {
+		t.Fatalf("rooms = %v", list)
+	}
+	if list["ok"].interval != 50*time.Millisecond || list["also_ok"].interval != tickInterval {
+		t.Errorf("intervals ok=%v also_ok=%v", list["ok"].interval, list["also_ok"].interval)
+	}
+	if len(invalidEnv) != 3 {
+		t.Errorf("invalid entries reported: %v", invalidEnv)
+	}
+}
+
+func TestJoiningRoomReturnsItsMetadata(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &auditLog, nil)
+	setVar(t, &auditFile, "")
+	setVar(t, &roomFile, filepath.Join(t.TempDir(), "rooms.json"))
+	setVar(t, &rooms, newRooms("arena", ""))
+
+	rec := adminDo(http.MethodPost, "/admin/room?id=arena", `{"name":"The Arena","motd":"Last one standing","maxPlayers":1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set arena: %d %s", rec.Code, rec.Body)
+	}
+	if rec := adminDo(http.MethodPost, "/admin/room?id=nowhere", `{"name":"x"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown room: %d, want 404", rec.Code)
+	}
+
+	arena := joinRoom(t, "arena-player", "arena")
+	if info := arena.welcome.Room; info == nil || info.Name != "The Arena" || info.MOTD != "Last one standing" {
+		t.Errorf("arena welcome room = %+v", info)
+	}
+	if main := joinKey(t, "main-player"); main.welcome.Room != nil {
+		t.Errorf("main welcome room = %+v, want none", main.welcome.Room)
+	}
+
+	// the arena is full at one player
+	c := dial(t)
+	c.send(`{"type":"hello","publicKey":"arena-late","roomId":"arena"}`)
+	if ce := c.closed(); ce == nil || !strings.Contains(ce.Text, closeOverload) {
+		t.Errorf("joiner of a full room closed with %v, want %s", ce, closeOverload)
+	}
+
+	// the metadata survives a restart
+	setVar(t, &rooms, newRooms("arena", ""))
+	loadRoom()
+	if info := rooms["arena"].Info(); info.Name != "The Arena" || info.MaxPlayers != 1 {
+		t.Errorf("reloaded arena = %+v", info)
+	}
+}
+
+func TestLegacyRoomFileIsMainRoom(t *testing.T) {
+	setVar(t, &roomFile, filepath.Join(t.TempDir(), "room.json"))
+	setVar(t, &rooms, newRooms("arena", ""))
+	if err := os.WriteFile(roomFile, []byte(`{"name":"Garden","motd":"Welcome"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadRoom()
+	if info := rooms[mainRoomID].Info(); info.Name != "Garden" || info.MOTD != "Welcome" {
+		t.Errorf("main room = %+v, want the legacy file's metadata", info)
+	}
+}
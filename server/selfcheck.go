@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// STRICT_STARTUP exits when the self-check finds a problem, so
+// misconfiguration fails the deploy instead of the first request
+var strictStartup = getEnvBool("STRICT_STARTUP", false)
+
+// startupCheck runs selfCheck and logs its findings, returning them as an
+// error only under STRICT_STARTUP, when the server shouldn't start
+func startupCheck() error {
+	err := selfCheck()
+	switch {
+	case err == nil:
+		log.Println("Startup self-check passed")
+	case strictStartup:
+		return fmt.Errorf("startup self-check failed:\n%w", err)
+	default:
+		log.Printf("Startup self-check found problems:\n%v", err)
+	}
+	return nil
+}
+
+// selfCheck validates the configuration the server depends on and returns
+// every problem found, or nil
+func selfCheck() error {
+	var problems []error
+
+	if len(invalidEnv) > 0 {
+		problems = append(problems, fmt.Errorf("invalid values for %s", strings.Join(invalidEnv, ", ")))
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			problems = append(problems, fmt.Errorf("invalid PORT=%q", port))
+		}
+	}
+
+	// BUILD_ON_START creates a missing dist right after the check
+	if info, err := os.Stat(distDir); err != nil {
+		if !buildOnStart || !os.IsNotExist(err) {
+			problems = append(problems, fmt.Errorf("DIST_DIR: %w", err))
+		}
+	} else if !info.IsDir() {
+		problems = append(problems, fmt.Errorf("DIST_DIR %s is not a directory", distDir))
+	}
+
+	for _, dir := range []struct{ env, path string }{
+		{"PEAK_FILE", filepath.Dir(peakFile)},
+		{"AUDIT_FILE", filepath.Dir(auditFile)},
+		{"WORLD_SEED_FILE", filepath.Dir(worldSeedFile)},
+		{"ROOM_FILE", filepath.Dir(roomFile)},
+		{"REPLAY_DIR", replayDir},
+	} {
+		if os.Getenv(dir.env) == "" {
+			continue
+		}
+		if err := checkWritable(dir.path); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", dir.env, err))
+		}
+	}
+
+	// builds run for the webhook, which needs a secret, or BUILD_ON_START
+	if secret != "" || buildOnStart {
+		if _, err := os.Stat(repoDir); err != nil {
+			problems = append(problems, fmt.Errorf("REPO_DIR: %w", err))
+		}
+		if err := checkBuildTools(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// checkWritable creates and removes a file in dir
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".selfcheck-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// validStartup configures a dist dir and nothing that needs checking
+func validStartup(t *testing.T) {
+	t.Helper()
+	withDist(t, map[string]string{"index.html": "<html></html>"})
+	setVar(t, &invalidEnv, nil)
+	setVar(t, &secret, "")
+	setVar(t, &buildOnStart, false)
+	t.Setenv("PORT", "8000")
+}
+
+func TestStrictStartupFailsOnInvalidConfig(t *testing.T) {
+	validStartup(t)
+	setVar(t, &strictStartup, true)
+	if err := startupCheck(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+
+	t.Setenv("PORT", "http")
+	setVar(t, &invalidEnv, []string{"TICK_INTERVAL"})
+	err := startupCheck()
+	if err == nil {
+		t.Fatal("invalid config passed in strict mode")
+	}
+	for _, want := range []string{"PORT", "TICK_INTERVAL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %s", err, want)
+		}
+	}
+
+	strictStartup = false
+	logs := captureLog(t)
+	if err := startupCheck(); err != nil {
+		t.Errorf("lenient mode returned %v", err)
+	}
+	if !strings.Contains(logs.String(), "PORT") {
+		t.Errorf("problems not logged: %s", logs)
+	}
+}
+
+func TestSelfCheckReportsMissingDist(t *testing.T) {
+	validStartup(t)
+	setVar(t, &distDir, t.TempDir()+"/missing")
+	if err := selfCheck(); err == nil || !strings.Contains(err.Error(), "DIST_DIR") {
+		t.Errorf("selfCheck() = %v, want a DIST_DIR problem", err)
+	}
+}
+
+func TestSelfCheckLeavesMissingDistToBuildOnStart(t *testing.T) {
+	validStartup(t)
+	withRepo(t)
+	fakeBuild(t, func() error { return nil })
+	setVar(t, &distDir, t.TempDir()+"/missing")
+	setVar(t, &buildOnStart, true)
+	if err := selfCheck(); err != nil {
+		t.Errorf("missing dist with BUILD_ON_START: %v", err)
+	}
+}
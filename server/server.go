@@ -1,33 +1,103 @@
 package main
 
 import (
+	"compress/flate"
+	"container/list"
+	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
-	"os/exec"
+	"os/signal"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 var (
-	secret    = os.Getenv("WEBHOOK_SECRET")
-	distDir   = getEnv("DIST_DIR", "/home/exedev/the_masked_garden/game/dist")
-	repoDir   = getEnv("REPO_DIR", "/home/exedev/the_masked_garden")
-	lastBuild = time.Now()
-	buildMu   sync.RWMutex
+	secret     = os.Getenv("WEBHOOK_SECRET")
+	prevSecret = os.Getenv("WEBHOOK_SECRET_PREVIOUS") // still accepted while rotating
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	distDir    = getEnv("DIST_DIR", "/home/exedev/the_masked_garden/game/dist")
+	repoDir    = getEnv("REPO_DIR", "/home/exedev/the_masked_garden")
+	basePath   = cleanBasePath(os.Getenv("BASE_PATH"))
+	deployed   = BuildInfo{Time: time.Now(), Commit: currentCommit()}
+	buildMu    sync.RWMutex
 )
 
+// Env values that failed to parse, for the startup self-check
+var invalidEnv []string
+
+func reportInvalidEnv(key, value string, fallback any) {
+	log.Printf("Invalid %s=%q, using %v", key, value, fallback)
+	invalidEnv = append(invalidEnv, key)
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+		reportInvalidEnv(key, v, fallback)
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+		reportInvalidEnv(key, v, fallback)
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		reportInvalidEnv(key, v, fallback)
+	}
+	return fallback
+}
+
+// positiveDuration guards against zero or negative durations where those make no sense
+func positiveDuration(d, fallback time.Duration) time.Duration {
+	if d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+// cleanBasePath normalizes BASE_PATH ("game/", "/game") to "/game", or "" for root
+func cleanBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
 func getEnv(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -35,53 +105,241 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		reportInvalidEnv(key, v, fallback)
+	}
+	return fallback
+}
+
+// WS_COMPRESSION negotiates permessage-deflate with clients that offer it.
+// gorilla/websocket only implements it without context takeover: each frame
+// is compressed on its own, which keeps no per-connection window (~32KB
+// each side) around but compresses our small, repetitive frames less well
+// than a shared context would. Context takeover and window bits are
+// therefore not configurable. WS_COMPRESSION_LEVEL (1-9) trades CPU for
+// size; state frames are small enough that the default is usually right.
+var (
+	wsCompression      = getEnvBool("WS_COMPRESSION", false)
+	wsCompressionLevel = getEnvInt("WS_COMPRESSION_LEVEL", flate.DefaultCompression)
+)
+
+func init() {
+	if wsCompressionLevel != flate.DefaultCompression && (wsCompressionLevel < flate.BestSpeed || wsCompressionLevel > flate.BestCompression) {
+		reportInvalidEnv("WS_COMPRESSION_LEVEL", strconv.Itoa(wsCompressionLevel), "the default")
+		wsCompressionLevel = flate.DefaultCompression
+	}
+}
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:       func(r *http.Request) bool { return true },
+	EnableCompression: wsCompression,
 }
 
 var playerIDCounter uint64
 
-// Actor identity: map public key to persistent actor ID
+// ID_STRATEGY selects how new IDs are assigned: "sequential" (default) or
+// "random", which avoids leaking user counts and makes IDs unguessable
+var idStrategy = getEnv("ID_STRATEGY", "sequential")
+
+// Random IDs in use, to guarantee no collisions: actor IDs until their
+// mapping is evicted, session IDs until their session ends
 var (
-	pubKeyToID   = make(map[string]uint64)
-	pubKeyMu     sync.RWMutex
+	usedIDs = make(map[uint64]bool)
+	usedMu  sync.Mutex
+)
+
+// newID assigns a fresh ID, either from counter or at random per ID_STRATEGY
+func newID(counter *uint64) uint64 {
+	if idStrategy != "random" {
+		return atomic.AddUint64(counter, 1)
+	}
+	usedMu.Lock()
+	defer usedMu.Unlock()
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			log.Printf("Random ID generation failed, using sequential: %v", err)
+			return atomic.AddUint64(counter, 1)
+		}
+		id := binary.BigEndian.Uint64(buf[:])
+		if id != 0 && !usedIDs[id] {
+			usedIDs[id] = true
+			return id
+		}
+	}
+}
+
+// releaseID forgets a random ID that is no longer in use, so usedIDs stays
+// bounded by the actor mappings and live sessions
+func releaseID(id uint64) {
+	if idStrategy != "random" {
+		return
+	}
+	usedMu.Lock()
+	delete(usedIDs, id)
+	usedMu.Unlock()
+}
+
+// Actor identity: map public key to persistent actor ID. MAX_ACTORS caps
+// the mappings kept, evicting the least recently seen key past it; keys of
+// connected players and of leaves still in their grace period are pinned.
+// An evicted key that comes back gets a new ID. 0 keeps every mapping.
+var (
+	maxActors    = getEnvInt("MAX_ACTORS", 100000)
+	pubKeyToID   = make(map[string]*list.Element) // values are *actorEntry
+	actorsByUse  = list.New()                     // most recently seen first
+	pubKeyMu     sync.Mutex
 	actorCounter uint64
 )
 
-// getOrCreateActorID returns a persistent ID for a public key
+type actorEntry struct {
+	key string
+	id  uint64
+}
+
+// getOrCreateActorID returns a persistent ID for a public key, in any supported encoding
 func getOrCreateActorID(publicKey string) uint64 {
-	pubKeyMu.RLock()
-	if id, exists := pubKeyToID[publicKey]; exists {
-		pubKeyMu.RUnlock()
-		return id
-	}
-	pubKeyMu.RUnlock()
+	publicKey = canonicalKey(publicKey)
 
 	pubKeyMu.Lock()
 	defer pubKeyMu.Unlock()
-	// Double-check after acquiring write lock
-	if id, exists := pubKeyToID[publicKey]; exists {
-		return id
+	if el, exists := pubKeyToID[publicKey]; exists {
+		actorsByUse.MoveToFront(el)
+		return el.Value.(*actorEntry).id
+	}
+	id := newID(&actorCounter)
+	pubKeyToID[publicKey] = actorsByUse.PushFront(&actorEntry{key: publicKey, id: id})
+	if maxActors > 0 && actorsByUse.Len() > maxActors {
+		evictActors()
 	}
-	id := atomic.AddUint64(&actorCounter, 1)
-	pubKeyToID[publicKey] = id
 	return id
 }
 
+// evictActors drops the least recently seen unpinned mappings until back
+// under MAX_ACTORS; callers hold pubKeyMu
+func evictActors() {
+	for el := actorsByUse.Back(); el != nil && actorsByUse.Len() > maxActors; {
+		prev := el.Prev()
+		entry := el.Value.(*actorEntry)
+		if !actorPinned(entry.id) {
+			actorsByUse.Remove(el)
+			delete(pubKeyToID, entry.key)
+			releaseID(entry.id)
+		}
+		el = prev
+	}
+}
+
+// actorPinned reports whether id is in use by a connected player or a
+// pending leave that a reconnect could still cancel
+func actorPinned(id uint64) bool {
+	if len(players.Lookup(id)) > 0 {
+		return true
+	}
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	for key := range pendingLeaves {
+		if key.id == id {
+			return true
+		}
+	}
+	return false
+}
+
 // deriveColorHue derives a color hue from a public key (matches client algorithm)
 func deriveColorHue(publicKey string) float64 {
-	decoded, err := base64.StdEncoding.DecodeString(publicKey)
-	if err != nil {
-		// Fallback to simple hash of the string
-		decoded = []byte(publicKey)
-	}
-	var hash uint32 = 0
-	for _, b := range decoded {
+	return DeriveHue(decodePublicKey(publicKey))
+}
+
+// DeriveHue is the hue of a decoded public key: a 31-multiplier rolling
+// hash over the key bytes, wrapping at 32 bits, modulo 360. The web client
+// (deriveColorHue in actorIdentity.ts) must compute the same; known values:
+//
+//	""                 -> 0
+//	"a"                -> 97
+//	"hello"            -> 322
+//	"\x00\x01\x02\x03" -> 306
+//	bytes 0 to 31      -> 96 (the hash wraps)
+func DeriveHue(key []byte) float64 {
+	var hash uint32
+	for _, b := range key {
 		hash = hash*31 + uint32(b)
 	}
 	return float64(hash % 360)
 }
 
+// HUE_PARITY_CHECK warns when the hue a client derived itself and sent in
+// hello differs from the server's, a sign the two algorithms drifted apart
+var hueParityCheck = getEnvBool("HUE_PARITY_CHECK", true)
+
+func checkHueParity(hello []byte, serverHue float64) {
+	if !hueParityCheck {
+		return
+	}
+	var reported struct {
+		ColorHue *float64 `json:"colorHue"`
+	}
+	if json.Unmarshal(hello, &reported) != nil || reported.ColorHue == nil {
+		return
+	}
+	if *reported.ColorHue != serverHue {
+		log.Printf("Warning: client derived hue %g, server derived %g; client and server color algorithms differ", *reported.ColorHue, serverHue)
+	}
+}
+
+// Curated hues for unauthenticated players, handed out round-robin
+var (
+	fallbackPalette = parseHues(getEnv("FALLBACK_PALETTE", "0,30,55,120,160,190,215,260,290,325"))
+	paletteIndex    int
+	paletteMu       sync.Mutex
+)
+
+// parseHues parses a comma-separated list of hues in degrees
+func parseHues(list string) []float64 {
+	var hues []float64
+	for _, field := range strings.Split(list, ",") {
+		hue, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || hue < 0 || hue >= 360 {
+			log.Printf("Ignoring invalid palette hue %q", field)
+			continue
+		}
+		hues = append(hues, hue)
+	}
+	return hues
+}
+
+// nextFallbackHue picks the next palette hue not already worn by a connected
+// player, or simply the next one when every hue is taken
+func nextFallbackHue(id uint64) float64 {
+	if len(fallbackPalette) == 0 {
+		return float64((id * 137) % 360)
+	}
+
+	inUse := make(map[float64]bool)
+	for _, player := range connectedPlayers() {
+		player.stateMu.Lock()
+		inUse[player.ColorHue] = true
+		player.stateMu.Unlock()
+	}
+
+	paletteMu.Lock()
+	defer paletteMu.Unlock()
+	for i := range fallbackPalette {
+		hue := fallbackPalette[(paletteIndex+i)%len(fallbackPalette)]
+		if !inUse[hue] {
+			paletteIndex += i + 1
+			return hue
+		}
+	}
+	hue := fallbackPalette[paletteIndex%len(fallbackPalette)]
+	paletteIndex++
+	return hue
+}
+
 type CubeState struct {
 	X  float64 `json:"x"`
 	Y  float64 `json:"y"`
@@ -92,143 +350,771 @@ type CubeState struct {
 }
 
 type PlayerState struct {
-	X        float64    `json:"x"`
-	Y        float64    `json:"y"`
-	Z        float64    `json:"z"`
-	VX       float64    `json:"vx"`
-	VY       float64    `json:"vy"`
-	VZ       float64    `json:"vz"`
-	ColorHue float64    `json:"colorHue"`
-	Cube     *CubeState `json:"cube,omitempty"`
+	X         float64    `json:"x"`
+	Y         float64    `json:"y"`
+	Z         float64    `json:"z"`
+	VX        float64    `json:"vx"`
+	VY        float64    `json:"vy"`
+	VZ        float64    `json:"vz"`
+	ColorHue  float64    `json:"colorHue"`
+	Team      string     `json:"team,omitempty"`
+	Lightness float64    `json:"lightness,omitempty"` // per-member variation within a team
+	Yaw       float64    `json:"yaw,omitempty"`       // facing in radians, see Spawn
+	Cube      *CubeState `json:"cube,omitempty"`
+	Stale     bool       `json:"stale,omitempty"` // silent past STATE_TTL, with STALE_MARK
+}
+
+// Velocity is always serialized, zeros included, since clients
+// extrapolate with it and treat a missing field as an error.
+// OMIT_ZERO_VELOCITY drops vx/vy/vz for stationary players to save bytes,
+// for clients that default missing velocity to zero.
+var omitZeroVelocity = getEnvBool("OMIT_ZERO_VELOCITY", false)
+
+// leanState is PlayerState with zero velocities omitted. It's only used
+// for stationary players and only when omitZeroVelocity is on, so the
+// default path stays a plain struct encoding. Its fields must match
+// PlayerState's.
+type leanState struct {
+	X         float64    `json:"x"`
+	Y         float64    `json:"y"`
+	Z         float64    `json:"z"`
+	VX        float64    `json:"vx,omitempty"`
+	VY        float64    `json:"vy,omitempty"`
+	VZ        float64    `json:"vz,omitempty"`
+	ColorHue  float64    `json:"colorHue"`
+	Team      string     `json:"team,omitempty"`
+	Lightness float64    `json:"lightness,omitempty"`
+	Yaw       float64    `json:"yaw,omitempty"`
+	Cube      *CubeState `json:"cube,omitempty"`
+	Stale     bool       `json:"stale,omitempty"`
+}
+
+// lean returns s for encoding, without its velocity if it's stationary;
+// a moving player always carries all three components
+func (s PlayerState) lean() any {
+	if s.VX != 0 || s.VY != 0 || s.VZ != 0 {
+		return s
+	}
+	return leanState(s)
+}
+
+// leanStates converts states for encoding with lean
+func leanStates(states map[uint64]PlayerState) map[uint64]any {
+	lean := make(map[uint64]any, len(states))
+	for id, s := range states {
+		lean[id] = s.lean()
+	}
+	return lean
 }
 
 type Player struct {
-	ID       uint64
-	ColorHue float64
-	conn     *websocket.Conn
-	lastPing time.Time
-	state    PlayerState
-	stateMu  sync.Mutex
-	writeMu  sync.Mutex
+	ID           uint64
+	ColorHue     float64       // guarded by stateMu, may change via setPlayerColor
+	hueFrom      float64       // hue before the last color change, guarded by stateMu
+	hueSince     time.Time     // start of the hue transition, guarded by stateMu
+	hueFor       time.Duration // length of the hue transition, guarded by stateMu
+	Team         string        // set at join, "" when not on a team
+	room         *Room         // set at join
+	Lightness    float64
+	session      bool        // set at join: ID from the session counter, not a public key
+	stringIDs    bool        // set at join: IDs go out as JSON strings
+	columnar     bool        // set at join: players frames go out packed
+	batching     bool        // set at join: queued frames may be coalesced
+	indexes      *indexTable // set at join for binary frames; used by frame sends only
+	viewDistance float64     // interest radius, 0 = unlimited; guarded by stateMu
+	focus        *Position   // interest center instead of the avatar, nil = avatar; guarded by stateMu
+	conn         Conn
+	lastPing     time.Time // guarded by stateMu
+	lastActive   time.Time // last movement or interaction, guarded by stateMu
+	idleWarned   bool      // guarded by stateMu
+	state        PlayerState
+	stateCount   int       // state updates received, guarded by stateMu
+	lastState    time.Time // last state or ping position (join time before any), guarded by stateMu
+	stateMu      sync.Mutex
+	send         chan outFrame // outbound queue, drained by writePump
+	unsent       atomic.Int64  // frames queued and not yet written, see flushQueues
+	lastReact    time.Time     // for reaction rate limiting, read loop only
+	lastChat     time.Time     // for chat rate limiting, read loop only
+	done         chan struct{}
+	closeOnce    sync.Once
+
+	rtt           atomic.Int64 // smoothed round trip in ns, 0 until measured
+	debugUntil    atomic.Int64 // frames are logged until this unix ns time
+	hidden        atomic.Bool  // tab hidden: players frames paused
+	ready         atomic.Bool  // done warming up, see WARMUP
+	closing       atomic.Bool  // a write failed or the player closed; see writeFailed
+	commit        string       // game commit the client reported in hello
+	outdatedFor   string       // deployed commit clientOutdated was sent for; guarded by stateMu
+	joined        time.Time
+	phase         time.Duration // offset of players frames into the tick, see TICK_JITTER
+	staggerMu     sync.Mutex    // serializes staggered frame sends
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+	quota         *rateLimiter // outbound bytes budget, nil when OUTBOUND_QUOTA is off; guarded by stateMu
 }
 
+type outFrame struct {
+	messageType int
+	data        []byte
+}
+
+// Outbound queue tuning: a client whose queue holds sendBacklogThreshold
+// frames is congested and skips state broadcasts until it drains. Once
+// the queue is full, further frames are dropped; a client that is gone
+// rather than slow fails its next write and is disconnected then.
+var (
+	sendQueueSize        = getEnvInt("SEND_QUEUE_SIZE", 256)
+	sendBacklogThreshold = getEnvInt("SEND_BACKLOG_THRESHOLD", 32)
+)
+
+const writeWait = 10 * time.Second
+
+var (
+	errSendQueueFull = errors.New("send queue full")
+	errPlayerClosing = errors.New("player closing")
+)
+
+// writeFailed records a failed write to p and reports whether p should be
+// disconnected for it. A full queue only costs the frame. Otherwise the
+// player is on its way out, so concurrent broadcasts hitting it again are
+// dropped quietly: one disconnect logs once.
+func (p *Player) writeFailed(err error) bool {
+	if errors.Is(err, errSendQueueFull) {
+		droppedFrames.Add(1)
+		return false
+	}
+	if !p.closing.CompareAndSwap(false, true) {
+		return false
+	}
+	log.Printf("Write to player %d failed: %v", p.ID, err)
+	return true
+}
+
+// OUTBOUND_QUOTA is a soft per-player limit on state frame bytes per second (0 = off)
+var outboundQuota = getEnvInt("OUTBOUND_QUOTA", 0)
+
+func newPlayer(id uint64, colorHue float64, conn Conn) *Player {
+	p := &Player{
+		ID:         id,
+		ColorHue:   colorHue,
+		conn:       conn,
+		room:       findRoom(mainRoomID),
+		lastPing:   time.Now(),
+		lastActive: clock(),
+		lastState:  time.Now(),
+		joined:     time.Now(),
+		send:       make(chan outFrame, sendQueueSize),
+		done:       make(chan struct{}),
+	}
+	if outboundQuota > 0 {
+		p.quota = newRateLimiter(float64(outboundQuota), outboundQuota)
+	}
+	writePumps.Add(1)
+	go p.writePump()
+	return p
+}
+
+// WriteMessage queues a frame for the player without blocking the caller
 func (p *Player) WriteMessage(messageType int, data []byte) error {
-	p.writeMu.Lock()
-	defer p.writeMu.Unlock()
-	return p.conn.WriteMessage(messageType, data)
+	if p.closing.Load() {
+		return errPlayerClosing
+	}
+	select {
+	case <-p.done:
+		return websocket.ErrCloseSent
+	default:
+	}
+	p.unsent.Add(1)
+	select {
+	case p.send <- outFrame{messageType, data}:
+		p.bytesSent.Add(uint64(len(data)))
+		return nil
+	default:
+		p.unsent.Add(-1)
+		return errSendQueueFull
+	}
+}
+
+// withinQuota reports whether n more bytes of state frames fit the player's
+// OUTBOUND_QUOTA. Over quota, state frames are skipped (lowering the
+// player's update rate) rather than the player being cut off; a frame
+// larger than the quota goes out once the budget is full again.
+func (p *Player) withinQuota(n int) bool {
+	if p.quota == nil {
+		return true
+	}
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	return p.quota.allowDebt(time.Now(), n)
 }
 
+// backlogged reports whether the player's outbound queue is congested
+func (p *Player) backlogged() bool {
+	return len(p.send) >= sendBacklogThreshold
+}
+
+// Running player sessions and write pumps, so they can be waited out
 var (
-	players   = make(map[*websocket.Conn]*Player)
-	playersMu sync.RWMutex
+	sessions   sync.WaitGroup
+	writePumps sync.WaitGroup
 )
 
+// writePump is the only writer to the connection; a failed write disconnects
+// the player, as does a panic, which ends only this player's pump
+func (p *Player) writePump() {
+	defer writePumps.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Panic writing to player %d: %v\n%s", p.ID, err, debug.Stack())
+			disconnectPlayers([]*Player{p}, leaveError)
+			p.close()
+		}
+	}()
+	for {
+		select {
+		case <-p.done:
+			return
+		case frame := <-p.send:
+			frames, taken := []outFrame{frame}, 1
+			if p.batching && coalesceWindow > 0 && frame.messageType == websocket.TextMessage {
+				var ok bool
+				if frames, taken, ok = p.coalesce(frame); !ok {
+					return
+				}
+			}
+			for _, frame := range frames {
+				if p.debugging() {
+					p.debugFrame("out", frame.data)
+				}
+				p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := p.conn.WriteMessage(frame.messageType, frame.data); err != nil {
+					if p.writeFailed(err) {
+						disconnectPlayers([]*Player{p}, leaveError)
+					}
+					return
+				}
+			}
+			p.unsent.Add(-int64(taken))
+		}
+	}
+}
+
+// close stops the write pump and closes the connection; safe to call repeatedly
+func (p *Player) close() {
+	p.closeOnce.Do(func() {
+		p.closing.Store(true) // writes from here on fail without logging
+		close(p.done)
+		p.conn.Close()
+		if p.session {
+			releaseID(p.ID) // nobody can come back to a session ID
+		}
+	})
+}
+
 type WSMessage struct {
 	Type        string                 `json:"type"`
 	PlayerCount int                    `json:"playerCount,omitempty"`
 	ID          uint64                 `json:"id,omitempty"`
-	ColorHue    float64                `json:"colorHue,omitempty"`
+	ColorHue    *float64               `json:"colorHue,omitempty"` // a pointer so hue 0 is still sent
 	PublicKey   string                 `json:"publicKey,omitempty"`
 	State       *PlayerState           `json:"state,omitempty"`
 	Players     map[uint64]PlayerState `json:"players,omitempty"`
 	BuildTime   string                 `json:"buildTime,omitempty"`
+	Text        string                 `json:"text,omitempty"`
+	Level       string                 `json:"level,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	Emoji       string                 `json:"emoji,omitempty"`
+	Position    *Position              `json:"position,omitempty"`
+	Config      *ClientConfig          `json:"config,omitempty"`
+	Reason      string                 `json:"reason,omitempty"`
+	Seq         *int                   `json:"seq,omitempty"` // pointers so 0 is still sent
+	Total       *int                   `json:"total,omitempty"`
+	Data        string                 `json:"data,omitempty"`
+	Team        string                 `json:"team,omitempty"`
+	Lightness   float64                `json:"lightness,omitempty"`
+	SecondsLeft int                    `json:"secondsLeft,omitempty"`
+	AckID       flexID                 `json:"ackId,omitempty"`
+	Action      string                 `json:"action,omitempty"`
+	// Capabilities are optional protocol features a client asks for in hello
+	Capabilities []string          `json:"capabilities,omitempty"`
+	ViewDistance float64           `json:"viewDistance,omitempty"`
+	Packed       *PackedPlayers    `json:"packed,omitempty"`
+	TransitionMs int64             `json:"transitionMs,omitempty"`
+	Messages     []json.RawMessage `json:"messages,omitempty"`
+	Stats        *WorldStats       `json:"stats,omitempty"`
+	Visible      *bool             `json:"visible,omitempty"`
+	Commit       string            `json:"commit,omitempty"` // game commit, see CLIENT_OUTDATED_GRACE
+	PartID       uint64            `json:"partId,omitempty"`
+	Room         *RoomInfo         `json:"room,omitempty"`
+	Spawn        *Spawn            `json:"spawn,omitempty"`
+	SentAt       string            `json:"sentAt,omitempty"` // when a replayed announcement or chat message was sent
+	RoomID       string            `json:"roomId,omitempty"`
 }
 
-func broadcastPlayerCount() {
-	playersMu.RLock()
-	count := len(players)
-	playerList := make([]*Player, 0, len(players))
-	for _, player := range players {
-		playerList = append(playerList, player)
+type Position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// STABLE_ORDER makes every player iteration (and so every broadcast) go in
+// ID order, for reproducible tests and debugging diffs. The players map in
+// a frame is always serialized in key order by encoding/json regardless.
+var stableOrder = getEnvBool("STABLE_ORDER", false)
+
+// connectedPlayers returns a snapshot of all players, safe to iterate without locks
+func connectedPlayers() []*Player {
+	list := players.Snapshot()
+	if stableOrder {
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	}
+	return list
+}
+
+// Send marshals msg and writes it to the player, counting it by type
+func (p *Player) Send(msg WSMessage) error {
+	data := encodeMessage(msg, p.stringIDs)
+	outboundMessages.add(msg.Type, 1)
+	return p.WriteMessage(websocket.TextMessage, data)
+}
+
+// broadcast sends msg to every connected player and returns the recipient count
+func broadcast(msg WSMessage) int {
+	return sendAll(connectedPlayers(), msg)
+}
+
+// broadcastOthers sends msg to every player in sender's room but sender
+func broadcastOthers(sender *Player, msg WSMessage) int {
+	var others []*Player
+	for _, player := range sender.room.players() {
+		if player != sender {
+			others = append(others, player)
+		}
 	}
-	playersMu.RUnlock()
+	return sendAll(others, msg)
+}
 
-	msg := WSMessage{Type: "playerCount", PlayerCount: count}
-	data, _ := json.Marshal(msg)
+// sendAll writes msg to each player in playerList. Players whose write fails
+// are disconnected once the broadcast is done.
+func sendAll(playerList []*Player, msg WSMessage) int {
+	data := encodeMessage(msg, false)
+	var stringData []byte // encoded on demand for stringIds clients
+	outboundMessages.add(msg.Type, len(playerList))
 
+	var failed []*Player
 	for _, player := range playerList {
-		player.WriteMessage(websocket.TextMessage, data)
+		frame := data
+		if player.stringIDs {
+			if stringData == nil {
+				stringData = encodeMessage(msg, true)
+			}
+			frame = stringData
+		}
+		if err := player.WriteMessage(websocket.TextMessage, frame); err != nil && player.writeFailed(err) {
+			failed = append(failed, player)
+		}
 	}
+	disconnectPlayers(failed, leaveError)
+	return len(playerList)
 }
 
-func broadcastPlayerLeft(id uint64) {
-	playersMu.RLock()
-	playerList := make([]*Player, 0, len(players))
-	for _, player := range players {
-		playerList = append(playerList, player)
+// afterFunc starts the timers that act on players later, swappable so
+// tests can stop the ones still pending when they end
+var afterFunc = time.AfterFunc
+
+// PLAYER_COUNT_DEBOUNCE coalesces joins and leaves into at most one
+// playerCount per interval, sent with the count at the end of it.
+// 0 broadcasts on every change.
+var (
+	playerCountDebounce = getEnvDuration("PLAYER_COUNT_DEBOUNCE", 250*time.Millisecond)
+	playerCountMu       sync.Mutex
+	playerCountPending  bool
+)
+
+func broadcastPlayerCount() {
+	if playerCountDebounce <= 0 {
+		sendPlayerCount()
+		return
 	}
-	playersMu.RUnlock()
+	playerCountMu.Lock()
+	defer playerCountMu.Unlock()
+	if playerCountPending {
+		return
+	}
+	playerCountPending = true
+	afterFunc(playerCountDebounce, func() {
+		playerCountMu.Lock()
+		playerCountPending = false
+		playerCountMu.Unlock()
+		sendPlayerCount()
+	})
+}
 
-	msg := WSMessage{Type: "playerLeft", ID: id}
-	data, _ := json.Marshal(msg)
+func sendPlayerCount() {
+	broadcast(WSMessage{Type: "playerCount", PlayerCount: players.Len()})
+}
 
-	for _, player := range playerList {
-		player.WriteMessage(websocket.TextMessage, data)
+// Why a player left, sent as the reason of playerLeft
+const (
+	leaveLeft       = "left"       // client closed the connection
+	leaveTimeout    = "timeout"    // no ping within the liveness window
+	leaveKicked     = "kicked"     // removed by an admin
+	leaveShutdown   = "shutdown"   // server going down
+	leaveError      = "error"      // writing to the client failed
+	leaveIdle       = "idle"       // no activity after an idle warning
+	leaveOverBudget = "overBudget" // kept exceeding the message budget
+)
+
+// LEAVE_LAST_STATE includes the player's last state in playerLeft, so
+// clients can fade them out where they were instead of popping them
+var leaveLastState = getEnvBool("LEAVE_LAST_STATE", false)
+
+// broadcastPlayerLeft tells everyone in room a player left; last is their
+// final state, or nil
+func broadcastPlayerLeft(room *Room, id uint64, reason string, last *PlayerState) {
+	room.broadcast(WSMessage{Type: "playerLeft", ID: id, Reason: reason, State: last})
+}
+
+// findPlayers returns the connected players with the given ID
+func findPlayers(id uint64) []*Player {
+	return players.Lookup(id)
+}
+
+// setPlayerColor recolors a player over the transition duration and tells
+// everyone in its room, the player included
+func setPlayerColor(p *Player, hue float64, transition time.Duration) {
+	p.stateMu.Lock()
+	t := time.Now()
+	p.hueFrom, p.hueSince, p.hueFor = p.hueAt(t), t, transition
+	p.ColorHue = hue
+	p.stateMu.Unlock()
+	p.room.broadcast(WSMessage{Type: "colorChanged", ID: p.ID, ColorHue: &hue, TransitionMs: transition.Milliseconds()})
+}
+
+// Leaves waiting out the grace period, keyed by room and player ID. A
+// reconnect with the same actor ID to the same room within DISCONNECT_GRACE
+// cancels the playerLeft broadcast; joining another room doesn't.
+var (
+	disconnectGrace = getEnvDuration("DISCONNECT_GRACE", 0)
+	pendingLeaves   = make(map[leaveKey]*time.Timer)
+	pendingMu       sync.Mutex
+)
+
+type leaveKey struct {
+	room string
+	id   uint64
+}
+
+// scheduleLeave broadcasts playerLeft, after the grace period when one is configured
+func scheduleLeave(room *Room, id uint64, reason string, last *PlayerState) {
+	if disconnectGrace <= 0 {
+		broadcastPlayerLeft(room, id, reason, last)
+		return
+	}
+
+	key := leaveKey{room.ID, id}
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	if t, ok := pendingLeaves[key]; ok {
+		t.Stop()
+	}
+	var timer *time.Timer
+	timer = afterFunc(disconnectGrace, func() {
+		pendingMu.Lock()
+		current := pendingLeaves[key] == timer
+		if current {
+			delete(pendingLeaves, key)
+		}
+		pendingMu.Unlock()
+		if current {
+			broadcastPlayerLeft(room, id, reason, last)
+		}
+	})
+	pendingLeaves[key] = timer
+}
+
+// cancelPendingLeave suppresses the leave broadcast of a player who came
+// back to room in time
+func cancelPendingLeave(room *Room, id uint64) bool {
+	key := leaveKey{room.ID, id}
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	t, ok := pendingLeaves[key]
+	if ok {
+		t.Stop()
+		delete(pendingLeaves, key)
 	}
+	return ok
 }
 
 func broadcastBuildTime() {
-	playersMu.RLock()
-	playerList := make([]*Player, 0, len(players))
-	for _, player := range players {
-		playerList = append(playerList, player)
+	broadcast(WSMessage{Type: "buildTime", BuildTime: currentBuild().TimeString()})
+}
+
+// TICK_INTERVAL is how often player states are broadcast (default 5Hz)
+var tickInterval = positiveDuration(getEnvDuration("TICK_INTERVAL", 200*time.Millisecond), 200*time.Millisecond)
+
+// SLOW_TICK_THRESHOLD is how long a broadcast tick may take before it is
+// logged as slow (default: one tick interval)
+var slowTickThreshold = getEnvDuration("SLOW_TICK_THRESHOLD", tickInterval)
+
+// broadcastPlayerStates runs a room's broadcast loop at its tick interval
+// until stop is closed (never, if nil)
+func broadcastPlayerStates(r *Room, stop <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			timedTick(r)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// timedTick runs one tick of r, logging it if it took longer than SLOW_TICK_THRESHOLD
+func timedTick(r *Room) {
+	start := time.Now()
+	count := safeTick(r)
+	if elapsed := time.Since(start); slowTickThreshold > 0 && elapsed > slowTickThreshold {
+		log.Printf("Slow broadcast tick in room %s: %s for %d players (threshold %s)", r.ID, elapsed, count, slowTickThreshold)
 	}
-	playersMu.RUnlock()
+}
+
+// safeTick runs one broadcast tick of r, recovering from a panic so a bad
+// tick doesn't stop the loop; the next tick runs as usual
+func safeTick(r *Room) (count int) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Panic in broadcast tick of room %s: %v\n%s", r.ID, err, debug.Stack())
+		}
+	}()
+	return tickRoom(r)
+}
 
-	buildMu.RLock()
-	buildTimeStr := lastBuild.UTC().Format(time.RFC3339)
-	buildMu.RUnlock()
+// SOLO_BROADCAST keeps ticking with a single player connected, so
+// server-driven frames (tick hooks) still reach a solo player. Without it
+// ticks are skipped until two players can see each other.
+var soloBroadcast = getEnvBool("SOLO_BROADCAST", false)
+
+// tickHooks run every broadcast tick with the players of the room ticking,
+// for server-driven frames such as entities that aren't player-to-player states
+var tickHooks []func(playerList []*Player)
+
+// broadcastTick ticks every room once, outside their loops, and returns
+// the number of players considered
+func broadcastTick() int {
+	count := 0
+	for _, r := range roomList() {
+		count += tickRoom(r)
+	}
+	return count
+}
 
-	msg := WSMessage{Type: "buildTime", BuildTime: buildTimeStr}
-	data, _ := json.Marshal(msg)
+// tickRoom sends every player in r the states of all the others there and
+// returns the number of players considered
+func tickRoom(r *Room) int {
+	playerList := r.players()
+	minPlayers := 2
+	if soloBroadcast {
+		minPlayers = 1
+	}
+	if len(playerList) < minPlayers {
+		return len(playerList)
+	}
 
+	for _, hook := range tickHooks {
+		hook(playerList)
+	}
+	if len(playerList) < 2 {
+		return len(playerList) // nobody to exchange states with
+	}
+
+	states := playerStates(playerList) // includes each player's unique color
+	compensateLatency(states, playerList)
+	visible := withoutWarming(dropStale(states, playerList, time.Now()), playerList)
+	sent := r.reckoning.suppressPredictable(r.dedupe.dropUnchanged(visible, time.Now()), time.Now())
+
+	var failed []*Player
 	for _, player := range playerList {
-		player.WriteMessage(websocket.TextMessage, data)
+		if player.hidden.Load() {
+			continue // background tab, kept alive by pings alone
+		}
+		player.stateMu.Lock()
+		radius := player.viewDistance
+		center := player.interestCenter(states[player.ID])
+		player.stateMu.Unlock()
+
+		otherStates := make(map[uint64]PlayerState)
+		for id, state := range sent {
+			if id != player.ID && inView(center, state, radius) {
+				otherStates[id] = state
+			}
+		}
+		if len(otherStates) == 0 {
+			continue
+		}
+		if player.phase > 0 {
+			sendStaggered(player, otherStates, states)
+		} else if sendPlayersFrame(player, otherStates, states) {
+			failed = append(failed, player)
+		}
 	}
+	disconnectPlayers(failed, leaveError)
+	return len(playerList)
 }
 
-func broadcastPlayerStates() {
-	for {
-		time.Sleep(200 * time.Millisecond) // 5Hz
+// sendPlayersFrame queues a players frame of states for p, unless p is
+// backlogged or over its quota; all is every player's state. It reports
+// whether the write failed.
+func sendPlayersFrame(p *Player, states, all map[uint64]PlayerState) bool {
+	if p.backlogged() {
+		skippedFrames.Add(1)
+		return false
+	}
+	frameType, frame := playersFrame(p, states, all)
+	if !p.withinQuota(len(frame.data)) {
+		skippedFrames.Add(1)
+		return false
+	}
+	if p.indexes != nil {
+		p.indexes.announce()
+	}
+	outboundMessages.add(frameType, 1)
+	err := p.WriteMessage(frame.messageType, frame.data)
+	return err != nil && p.writeFailed(err)
+}
+
+// ZERO_SPAWN_VELOCITY ignores the velocity of a player's first state after
+// joining, until a second update confirms it
+var zeroSpawnVelocity = getEnvBool("ZERO_SPAWN_VELOCITY", false)
+
+// Handshake limits: HELLO_TIMEOUT bounds how long a client may take to send
+// its hello, MAX_MESSAGE_SIZE caps every inbound frame
+var (
+	helloTimeout   = getEnvDuration("HELLO_TIMEOUT", 10*time.Second)
+	maxMessageSize = int64(getEnvInt("MAX_MESSAGE_SIZE", 64*1024))
+)
+
+// Pings a client may send before its hello
+const maxHelloPings = 10
+
+var errHelloPings = errors.New("too many pings before hello")
+
+// remoteHost extracts the host from a RemoteAddr such as "1.2.3.4:5678",
+// "[::1]:5678" or a bare address without a port
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	// No port: strip IPv6 brackets if present
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
 
-		playersMu.RLock()
-		if len(players) < 2 {
-			playersMu.RUnlock()
+// TRUSTED_PROXIES lists the reverse proxies (IPs and CIDRs, comma-separated)
+// whose X-Forwarded-For is believed
+var trustedProxies = parseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
+
+func parseTrustedProxies(list string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			reportInvalidEnv("TRUSTED_PROXIES", entry, "no proxy for that entry")
 			continue
 		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
 
-		states := make(map[uint64]PlayerState)
-		playerConns := make(map[*Player]uint64)
-		for _, player := range players {
-			player.stateMu.Lock()
-			state := player.state
-			state.ColorHue = player.ColorHue // Include player's unique color
-			states[player.ID] = state
-			player.stateMu.Unlock()
-			playerConns[player] = player.ID
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
 		}
-		playersMu.RUnlock()
+	}
+	return false
+}
 
-		for player, myID := range playerConns {
-			otherStates := make(map[uint64]PlayerState)
-			for id, state := range states {
-				if id != myID {
-					otherStates[id] = state
-				}
-			}
-			if len(otherStates) > 0 {
-				msg := WSMessage{Type: "players", Players: otherStates}
-				data, _ := json.Marshal(msg)
-				player.WriteMessage(websocket.TextMessage, data)
-			}
+// clientIP returns the IP of the client making the request. Behind trusted
+// proxies that is the last X-Forwarded-For hop not added by one of them,
+// since anything further left can be forged by the client.
+func clientIP(r *http.Request) string {
+	ip := remoteHost(r.RemoteAddr)
+	if !trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
 		}
+		ip = hop
 	}
+	return ip
 }
 
+// closeWithReason sends a close frame so the client can tell why it was dropped
+func closeWithReason(conn Conn, code int, reason string) {
+	closeWithin(conn, code, reason, time.Second)
+}
+
+// closeWithin sends a close frame, giving up after timeout on a client
+// that isn't reading
+func closeWithin(conn Conn, code int, reason string, timeout time.Duration) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(timeout))
+}
+
+// MAX_HANDSHAKES caps connections between upgrade and hello, refusing more
+// with 503 before upgrading, so a flood of connections that never say
+// hello can't pile up goroutines (0 = no limit)
+var handshakes = newSemaphore(getEnvInt("MAX_HANDSHAKES", 256))
+
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !handshakes.tryAcquire() {
+		http.Error(w, "Too many pending connections", http.StatusServiceUnavailable)
+		return
+	}
+	handshakeDone := sync.OnceFunc(handshakes.release)
+	defer handshakeDone()
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		log.Printf("WebSocket upgrade from %s failed: %v", clientIP(r), err)
+		return
+	}
+	if wsCompression {
+		conn.SetCompressionLevel(wsCompressionLevel)
+	}
+	servePlayer(conn, clientIP(r), handshakeDone)
+}
+
+// servePlayer runs a player's session over conn: hello, welcome, then the
+// read loop until the connection ends. handshakeDone is called once the
+// hello has been read (or failed).
+func servePlayer(conn Conn, ip string, handshakeDone func()) {
+	sessions.Add(1)
+	defer sessions.Done()
+	if cause := admissionRefusal(); cause != "" {
+		log.Printf("Refusing connection from %s (%s)", ip, cause)
+		closeWithBackoff(conn, cause, time.Second)
+		conn.Close()
 		return
 	}
 
@@ -237,88 +1123,267 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	var colorHue float64
 	var id uint64
 
-	// Set a timeout for the hello message
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// The size limit and deadline both apply to the whole frame, so a client
+	// trickling a partial hello is cut off when the deadline passes. Pings
+	// before the hello are answered but don't extend the deadline, since
+	// only a data frame is the hello; past maxHelloPings the client is cut
+	// off rather than kept answering.
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	helloPings := 0
+	conn.SetPingHandler(func(appData string) error {
+		if helloPings++; helloPings > maxHelloPings {
+			return errHelloPings
+		}
+		// like gorilla's default handler, a failed pong is left to the read
+		conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		return nil
+	})
 
 	_, message, err := conn.ReadMessage()
+	conn.SetPingHandler(nil)
+	handshakeDone()
 	if err != nil {
-		log.Printf("Failed to read hello message: %v", err)
+		log.Printf("Failed to read hello message from %s: %v", ip, err)
+		var netErr net.Error
+		switch {
+		case errors.As(err, &netErr) && netErr.Timeout():
+			closeWithReason(conn, websocket.ClosePolicyViolation, "hello timeout")
+		case errors.Is(err, websocket.ErrReadLimit):
+			closeWithReason(conn, websocket.CloseMessageTooBig, "hello too large")
+		case errors.Is(err, errHelloPings):
+			closeWithReason(conn, websocket.ClosePolicyViolation, "too many pings")
+		}
 		conn.Close()
 		return
 	}
 
+	// A client that skipped the hello (or raced a message ahead of it)
+	// still joins, with a session ID, and its first message is handled by
+	// the read loop instead of being dropped
+	var early []byte
 	var helloMsg WSMessage
-	if json.Unmarshal(message, &helloMsg) != nil || helloMsg.Type != "hello" || helloMsg.PublicKey == "" {
+	validHello := json.Unmarshal(message, &helloMsg) == nil && helloMsg.Type == "hello" && helloMsg.PublicKey != ""
+	if validHello {
+		if err := validatePublicKey(helloMsg.PublicKey); err != nil {
+			log.Printf("Invalid public key %s from %s: %v", safeKeyPrefix(helloMsg.PublicKey), ip, err)
+			if rejectInvalidKeys {
+				closeWithReason(conn, websocket.ClosePolicyViolation, "invalid public key")
+				conn.Close()
+				return
+			}
+			validHello = false
+		}
+	}
+	if !validHello {
 		log.Printf("Invalid hello message, using session ID instead")
+		if _, known := validators[helloMsg.Type]; known {
+			early = message
+		}
 		// Fallback: use session-based ID
-		id = atomic.AddUint64(&playerIDCounter, 1)
-		colorHue = float64((id * 137) % 360) // Simple fallback color
+		id = newID(&playerIDCounter)
+		colorHue = nextFallbackHue(id)
 	} else {
 		publicKey = helloMsg.PublicKey
 		id = getOrCreateActorID(publicKey)
 		colorHue = deriveColorHue(publicKey)
-		log.Printf("Actor authenticated with public key (first 20 chars): %s...", publicKey[:min(20, len(publicKey))])
+		checkHueParity(message, colorHue)
+		log.Printf("Actor authenticated with public key %s", safeKeyPrefix(publicKey))
+	}
+
+	// Team members share their team's hue and differ in lightness instead
+	var team string
+	var lightness float64
+	if validTeam(helloMsg.Team) {
+		team = helloMsg.Team
+		colorHue = teamHue(team)
+		lightness = teamLightness(id)
+	}
+
+	joined := findRoom(helloMsg.RoomID)
+	if helloMsg.RoomID != "" && joined.ID != helloMsg.RoomID {
+		log.Printf("Unknown room %q requested from %s, joining %s", helloMsg.RoomID, ip, joined.ID)
+	}
+	if joined.full() {
+		log.Printf("Refusing connection from %s (room %s full)", ip, joined.ID)
+		closeWithBackoff(conn, closeOverload, time.Second)
+		conn.Close()
+		return
 	}
 
 	// Clear the deadline for normal operation
 	conn.SetReadDeadline(time.Time{})
 
-	player := &Player{ID: id, ColorHue: colorHue, conn: conn, lastPing: time.Now()}
+	player := newPlayer(id, colorHue, conn)
+	if early == nil {
+		// an early message is counted when the read loop handles it
+		player.bytesReceived.Add(uint64(len(message)))
+	}
+	player.session = !validHello
+	player.Team, player.Lightness = team, lightness
+	player.room = joined
+	player.phase = tickPhase(joined.interval)
+	// others see the newcomer at its spawn until its first state
+	spawn := spawnFor(id)
+	player.state.X, player.state.Y, player.state.Z = spawn.Position.X, spawn.Position.Y, spawn.Position.Z
+	player.state.Yaw = spawn.Yaw
+	player.stringIDs = slices.Contains(helloMsg.Capabilities, capStringIDs)
+	player.columnar = slices.Contains(helloMsg.Capabilities, capColumnar)
+	player.batching = slices.Contains(helloMsg.Capabilities, capBatch)
+	if slices.Contains(helloMsg.Capabilities, capBinary) {
+		player.indexes = newIndexTable()
+	}
+	if measureRTT() {
+		trackRTT(player)
+	}
+	player.viewDistance = clampViewDistance(helloMsg.ViewDistance)
+	if versionPattern.MatchString(helloMsg.Commit) {
+		player.commit = helloMsg.Commit
+	}
+
+	players.Add(player)
+	notePlayerCount(player.room)
+
+	recordReplay("join", id, nil)
+
+	if cancelPendingLeave(player.room, id) {
+		log.Printf("Player %d reconnected within grace period", id)
+	}
 
-	playersMu.Lock()
-	players[conn] = player
-	playersMu.Unlock()
+	leaveReason := leaveLeft
+	defer func() {
+		// a panic ends only this player's session, not the server
+		if err := recover(); err != nil {
+			log.Printf("Panic serving player %d: %v\n%s", id, err, debug.Stack())
+			leaveReason = leaveError
+		}
+		disconnectPlayers([]*Player{player}, leaveReason)
+		player.close()
+	}()
 
 	// Send player their ID and current build time
-	buildMu.RLock()
-	buildTimeStr := lastBuild.UTC().Format(time.RFC3339)
-	buildMu.RUnlock()
+	player.Send(WSMessage{Type: "welcome", ID: id, ColorHue: &colorHue, Team: team, Lightness: lightness, BuildTime: currentBuild().TimeString(), Config: clientConfig(player.room), Room: player.room.welcomeInfo(), Spawn: &spawn, RoomID: player.room.ID})
 
-	welcomeMsg := WSMessage{Type: "welcome", ID: id, ColorHue: colorHue, BuildTime: buildTimeStr}
-	welcomeData, _ := json.Marshal(welcomeMsg)
-	conn.WriteMessage(websocket.TextMessage, welcomeData)
+	// A client can't render a world missing a chunk, so a snapshot that
+	// didn't fully go out ends the session
+	if err := sendSnapshot(player); err != nil {
+		log.Printf("Sending snapshot to player %d failed: %v", id, err)
+		leaveReason = leaveError
+		return
+	}
+
+	for _, a := range currentAnnouncements() {
+		player.Send(WSMessage{Type: "announcement", Text: a.Text, Level: a.Level, SentAt: a.Sent.UTC().Format(time.RFC3339)})
+	}
+	sendChatHistory(player)
 
-	log.Printf("Player %d connected (colorHue: %.1f). Total: %d", id, colorHue, len(players))
+	log.Printf("Player %d connected from %s (colorHue: %.1f). Total: %d", id, ip, colorHue, players.Len())
 	broadcastPlayerCount()
+	checkOutdated([]*Player{player})
 
-	defer func() {
-		playersMu.Lock()
-		delete(players, conn)
-		playersMu.Unlock()
-		conn.Close()
-		log.Printf("Player %d disconnected. Total: %d", id, len(players))
-		broadcastPlayerLeft(id)
-		broadcastPlayerCount()
-	}()
+	limiter := newRateLimiter(messageRate, messageBurst)
+	var violations violationCounter
 
 	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			break
+		message := early
+		if message != nil {
+			early = nil
+		} else {
+			var err error
+			if _, message, err = conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		player.bytesReceived.Add(uint64(len(message)))
+		if player.debugging() {
+			player.debugFrame("in", message)
+		}
+
+		if now := time.Now(); !limiter.allow(now) {
+			if violations.add(now) >= messageViolations {
+				log.Printf("Player %d exceeded the message budget, disconnecting", id)
+				closeWithReason(conn, websocket.ClosePolicyViolation, "rate limit exceeded")
+				leaveReason = leaveOverBudget
+				break
+			}
+			player.Send(protocolError(errors.New("rate limit exceeded")))
+			continue
 		}
 
 		var msg WSMessage
-		if json.Unmarshal(message, &msg) == nil {
-			switch msg.Type {
-			case "ping":
-				playersMu.Lock()
-				if p, ok := players[conn]; ok {
-					p.lastPing = time.Now()
-				}
-				playersMu.Unlock()
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"pong"}`))
-
-			case "state":
-				if msg.State != nil {
-					playersMu.RLock()
-					if p, ok := players[conn]; ok {
-						p.stateMu.Lock()
-						p.state = *msg.State
-						p.stateMu.Unlock()
-					}
-					playersMu.RUnlock()
+		if err := decodeMessage(message, &msg); err != nil {
+			countInbound("")
+			player.Send(protocolError(fmt.Errorf("invalid JSON: %w", err)))
+			continue
+		}
+		countInbound(msg.Type)
+
+		if err := validateMessage(&msg); err != nil {
+			player.Send(protocolError(err))
+			continue
+		}
+
+		switch msg.Type {
+		case "ping":
+			player.stateMu.Lock()
+			player.lastPing = time.Now()
+			if pos := msg.Position; pos != nil {
+				// Clients throttling full state can keep their avatar current
+				// via pings. Without velocity, don't let others extrapolate.
+				if moved(player.state, PlayerState{X: pos.X, Y: pos.Y, Z: pos.Z}) {
+					player.markActive()
 				}
+				player.state.X, player.state.Y, player.state.Z = pos.X, pos.Y, pos.Z
+				player.state.VX, player.state.VY, player.state.VZ = 0, 0, 0
+				player.lastState = player.lastPing
 			}
+			player.stateMu.Unlock()
+			player.Send(WSMessage{Type: "pong"})
+
+		case "state":
+			player.stateMu.Lock()
+			if moved(player.state, *msg.State) {
+				player.markActive()
+			}
+			player.state = *msg.State
+			if zeroSpawnVelocity && player.stateCount == 0 {
+				// Don't let remote avatars fly off during the first interpolation
+				player.state.VX, player.state.VY, player.state.VZ = 0, 0, 0
+			}
+			player.stateCount++
+			player.lastState = time.Now()
+			player.stateMu.Unlock()
+			recordReplay("state", id, msg.State)
+
+		case "reaction":
+			player.stateMu.Lock()
+			player.markActive()
+			player.stateMu.Unlock()
+			handleReaction(player, msg.Emoji)
+
+		case "chat":
+			player.stateMu.Lock()
+			player.markActive()
+			player.stateMu.Unlock()
+			handleChat(player, msg.Text)
+
+		case "ready":
+			player.ready.Store(true)
+
+		case "visibility":
+			player.hidden.Store(!*msg.Visible)
+
+		case "viewDistance":
+			setViewDistance(player, msg.ViewDistance)
+
+		case "focus":
+			setFocus(player, msg.Position)
+
+		case "input":
+			handleInput(player, msg.Action)
+
+		case "ack":
+			handleAck(player, uint64(msg.AckID))
 		}
 	}
 }
@@ -326,32 +1391,58 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 func cleanupStaleConnections() {
 	for {
 		time.Sleep(2 * time.Second)
-		now := time.Now()
-		var stale []*websocket.Conn
-		var staleIDs []uint64
-
-		playersMu.RLock()
-		for conn, player := range players {
-			if now.Sub(player.lastPing) > 5*time.Second {
-				stale = append(stale, conn)
-				staleIDs = append(staleIDs, player.ID)
-			}
-		}
-		playersMu.RUnlock()
+		disconnectStale(time.Now())
+		checkIdle()
+	}
+}
 
-		for i, conn := range stale {
-			playersMu.Lock()
-			delete(players, conn)
-			playersMu.Unlock()
-			conn.Close()
-			log.Printf("Cleaned up stale player %d. Total: %d", staleIDs[i], len(players))
-			broadcastPlayerLeft(staleIDs[i])
+// disconnectStale times out the players that haven't pinged in the 5s
+// before now
+func disconnectStale(now time.Time) {
+	var stale []*Player
+	for _, player := range connectedPlayers() {
+		player.stateMu.Lock()
+		lastPing := player.lastPing
+		player.stateMu.Unlock()
+		if now.Sub(lastPing) > 5*time.Second {
+			stale = append(stale, player)
 		}
+	}
+	disconnectPlayers(stale, leaveTimeout)
+}
 
-		if len(stale) > 0 {
-			broadcastPlayerCount()
+// disconnectPlayers removes players, closes their connections and notifies
+// everyone else. Players already removed by another path are skipped, so
+// it is safe to call from the read loop, the sweeper and broadcasts alike.
+func disconnectPlayers(list []*Player, reason string) {
+	if len(list) == 0 {
+		return
+	}
+
+	var removed []*Player
+	for _, player := range list {
+		if players.Remove(player) {
+			removed = append(removed, player)
 		}
 	}
+	total := players.Len()
+	disconnects.add(reason, len(removed))
+
+	for _, player := range removed {
+		player.close()
+		log.Printf("Player %d disconnected (%s). Total: %d", player.ID, reason, total)
+		recordReplay("leave", player.ID, nil)
+		var last *PlayerState
+		if leaveLastState {
+			state := playerStates([]*Player{player})[player.ID]
+			last = &state
+		}
+		scheduleLeave(player.room, player.ID, reason, last)
+	}
+
+	if len(removed) > 0 {
+		broadcastPlayerCount()
+	}
 }
 
 func verifySignature(payload []byte, signature string) bool {
@@ -365,14 +1456,39 @@ func verifySignature(payload []byte, signature string) bool {
 	if err != nil {
 		return false
 	}
-	mac := hmac.New(sha256.New, []byte(secret))
+	// check both secrets every time so timing doesn't reveal which matched
+	valid := signedWith(secret, payload, sig)
+	if prevSecret != "" && signedWith(prevSecret, payload, sig) {
+		valid = true
+	}
+	return valid
+}
+
+func signedWith(key string, payload, sig []byte) bool {
+	mac := hmac.New(sha256.New, []byte(key))
 	mac.Write(payload)
 	return hmac.Equal(sig, mac.Sum(nil))
 }
 
+// WEBHOOK_MAX_BYTES caps webhook payloads, which are read in full before
+// the signature can be checked
+var webhookMaxBytes = int64(getEnvInt("WEBHOOK_MAX_BYTES", 1<<20))
+
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if ip := clientIP(r); !webhookSourceAllowed(ip) {
+		log.Printf("Webhook from disallowed source %s", ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, webhookMaxBytes)
 	payload, err := io.ReadAll(r.Body)
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Failed to read body", http.StatusBadRequest)
 		return
 	}
@@ -388,76 +1504,161 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Received webhook event: %s", event)
 
 	if event == "push" {
-		go func() {
-			log.Println("Fetching latest changes...")
-			cmd := exec.Command("git", "-C", repoDir, "fetch", "origin")
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				log.Printf("Git fetch failed: %v\n%s", err, output)
-				return
-			}
-			log.Printf("Git fetch succeeded:\n%s", output)
-
-			log.Println("Resetting to origin/main...")
-			cmd = exec.Command("git", "-C", repoDir, "reset", "--hard", "origin/main")
-			output, err = cmd.CombinedOutput()
-			if err != nil {
-				log.Printf("Git reset failed: %v\n%s", err, output)
-				return
-			}
-			log.Printf("Git reset succeeded:\n%s", output)
-
-			log.Println("Rebuilding...")
-			cmd = exec.Command("bash", "-c", fmt.Sprintf("cd %s/game && export PNPM_HOME=/home/exedev/.local/share/pnpm && export PATH=$PNPM_HOME:$PATH && pnpm install && pnpm build", repoDir))
-			output, err = cmd.CombinedOutput()
-			if err != nil {
-				log.Printf("Build failed: %v\n%s", err, output)
-				return
-			}
-			log.Println("Build succeeded")
-
-			// Update build time and notify all clients
-			buildMu.Lock()
-			lastBuild = time.Now()
-			buildMu.Unlock()
-			broadcastBuildTime()
-		}()
+		pushBuild()
 	}
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "OK")
 }
 
-func main() {
-	go cleanupStaleConnections()
-	go broadcastPlayerStates()
+// HTTP timeouts against slow clients (slowloris). The read timeouts end at
+// a WebSocket upgrade, where gorilla clears the deadlines; the write
+// timeout is only applied to static files and the webhook, since admin
+// rebuilds can legitimately take minutes. 0 disables a timeout.
+var (
+	httpReadHeaderTimeout = getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	httpReadTimeout       = getEnvDuration("HTTP_READ_TIMEOUT", 30*time.Second)
+	httpWriteTimeout      = getEnvDuration("HTTP_WRITE_TIMEOUT", 30*time.Second)
+	httpIdleTimeout       = getEnvDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+)
 
+// newHTTPServer serves routes on addr with the HTTP timeouts
+func newHTTPServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           routes(),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+}
+
+// SPA_FALLBACK serves index.html for unknown extensionless paths, for the
+// game's client-side routes. Disable it when there is no SPA to get 404s.
+var spaFallback = getEnvBool("SPA_FALLBACK", true)
+
+// routes builds the HTTP handler, mounted under BASE_PATH when one is set
+func routes() http.Handler {
+	mux := http.NewServeMux()
 	fs := http.FileServer(http.Dir(distDir))
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/admin/announce", announceHandler)
+	mux.HandleFunc("/admin/acks", acksHandler)
+	mux.HandleFunc("/admin/audit", auditHandler)
+	mux.HandleFunc("/admin/metrics", metricsHandler)
+	mux.HandleFunc("/admin/metrics/reset-peak", resetPeakHandler)
+	mux.HandleFunc("/admin/builds", buildsHandler)
+	mux.HandleFunc("/admin/rebuild", rebuildHandler)
+	mux.HandleFunc("/admin/color", colorHandler)
+	mux.HandleFunc("/admin/kick", kickHandler)
+	mux.HandleFunc("/admin/drain", drainHandler)
+	mux.HandleFunc("/admin/maintenance", maintenanceHandler)
+	mux.HandleFunc("/admin/players", playersHandler)
+	mux.HandleFunc("/admin/debug", debugHandler)
+	mux.HandleFunc("/admin/ws", adminWSHandler)
+	mux.HandleFunc("/admin/room", roomHandler)
+	mux.HandleFunc("GET /admin/{$}", dashboardHandler)
+	mux.HandleFunc("GET /admin", dashboardRedirect)
+	mux.HandleFunc("GET /api/players/{id}", playerHandler)
+	mux.HandleFunc("POST /api/diag", diagHandler)
+	mux.HandleFunc("/version", versionHandler)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			handleWebSocket(w, r)
+			return
+		}
+
+		// static files and the webhook are short; WebSockets aren't
+		if httpWriteTimeout > 0 {
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(httpWriteTimeout))
+		}
+
 		if r.URL.Path == "/__webhook" && r.Method == "POST" {
 			webhookHandler(w, r)
 			return
 		}
 
-		if r.URL.Path == "/ws" {
-			handleWebSocket(w, r)
+		if maintenance.Load() && !isAsset(r.URL.Path) {
+			serveMaintenancePage(w)
 			return
 		}
 
 		path := distDir + r.URL.Path
 		if _, err := os.Stat(path); os.IsNotExist(err) && !strings.Contains(r.URL.Path, ".") {
+			if !spaFallback {
+				http.NotFound(w, r)
+				return
+			}
 			http.ServeFile(w, r, distDir+"/index.html")
 			return
 		}
 
+		if serveGzipped(w, r) {
+			return
+		}
+		withContentType(w, r)
 		fs.ServeHTTP(w, r)
 	})
 
+	if basePath == "" {
+		return mux
+	}
+
+	// Everything lives under the prefix, e.g. /game/ws and /game/__webhook
+	root := http.NewServeMux()
+	root.Handle(basePath+"/", http.StripPrefix(basePath, mux))
+	root.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	return root
+}
+
+func main() {
+	if err := startupCheck(); err != nil {
+		log.Fatal(err)
+	}
+	loadPeak()
+	loadAudit()
+	loadRoom()
+	startupBuild()
+	startReplayRecorder()
+	startWebhookAllowList()
+	go cleanupStaleConnections()
+	for _, r := range roomList() {
+		go broadcastPlayerStates(r, nil)
+	}
+	if measureRTT() {
+		go pingPlayers()
+	}
+	if worldStatsInterval > 0 {
+		go broadcastWorldStats()
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8000"
 	}
-	log.Printf("Server listening on :%s, serving %s", port, distDir)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	srv := newHTTPServer(":" + port)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Println("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownPlayers(shutdownCtx)
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Server listening on :%s%s/, serving %s", port, basePath, distDir)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	savePeak() // in case a save is still due
+	if recorder != nil {
+		recorder.Close()
+	}
 }
@@ -0,0 +1,1054 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// resetActors gives the test an empty public key to actor ID mapping
+func resetActors(t *testing.T) {
+	t.Helper()
+	setVar(t, &pubKeyToID, make(map[string]*list.Element))
+	setVar(t, &actorsByUse, list.New())
+	setVar(t, &usedIDs, make(map[uint64]bool))
+	setVar(t, &actorCounter, 0)
+	setVar(t, &playerIDCounter, 0)
+}
+
+func idInUse(id uint64) bool {
+	usedMu.Lock()
+	defer usedMu.Unlock()
+	return usedIDs[id]
+}
+
+func TestRandomIDsAreUniqueAndStablePerKey(t *testing.T) {
+	resetActors(t)
+	setVar(t, &idStrategy, "random")
+
+	ids := make(map[uint64]string)
+	for i := range 1000 {
+		key := fmt.Sprintf("key %d", i)
+		id := getOrCreateActorID(key)
+		if other, dup := ids[id]; dup {
+			t.Fatalf("%s and %s both got ID %d", key, other, id)
+		}
+		ids[id] = key
+	}
+	for id, key := range ids {
+		if again := getOrCreateActorID(key); again != id {
+			t.Errorf("%s: ID changed from %d to %d", key, id, again)
+		}
+	}
+}
+
+func TestSequentialIDsByDefault(t *testing.T) {
+	resetActors(t)
+	for want := uint64(1); want <= 3; want++ {
+		if id := getOrCreateActorID(fmt.Sprintf("seq-%d", want)); id != want {
+			t.Errorf("ID %d, want %d", id, want)
+		}
+	}
+	if id := getOrCreateActorID("seq-1"); id != 1 {
+		t.Errorf("known key got ID %d, want 1", id)
+	}
+}
+
+func TestActorCapEvictsOldestUnusedMapping(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	setVar(t, &maxActors, 2)
+	active := joinKey(t, "active-key") // the oldest mapping, pinned while connected
+	idle := getOrCreateActorID("idle-key")
+	getOrCreateActorID("newest-key")
+
+	known := func(key string) bool {
+		pubKeyMu.Lock()
+		defer pubKeyMu.Unlock()
+		_, ok := pubKeyToID[canonicalKey(key)]
+		return ok
+	}
+	if known("idle-key") {
+		t.Error("the oldest unused mapping was kept")
+	}
+	if !known("active-key") || !known("newest-key") {
+		t.Error("the active or the newest mapping was evicted")
+	}
+	if id := getOrCreateActorID("active-key"); id != active.id {
+		t.Errorf("active key now maps to %d, want %d", id, active.id)
+	}
+	if id := getOrCreateActorID("idle-key"); id == idle {
+		t.Errorf("evicted key got its old ID %d back", id)
+	}
+}
+
+func TestSessionIDReleasedWhenSessionEnds(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	setVar(t, &idStrategy, "random")
+
+	c := join(t, `{"type":"hello"}`) // no key: session ID
+	if !idInUse(c.id) {
+		t.Fatalf("session ID %d not reserved while connected", c.id)
+	}
+	c.conn.Close()
+	waitFor(t, "session ID release", func() bool { return !idInUse(c.id) })
+}
+
+// failingConn is a connection whose writes all fail, like one closed by
+// the peer mid-broadcast
+type failingConn struct {
+	*memConn
+}
+
+func (failingConn) WriteMessage(int, []byte) error { return net.ErrClosed }
+
+func TestFailedBroadcastWritePrunesPlayer(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &disconnects, newTypeCounters())
+	server, _ := newMemConnPair()
+	p := newPlayer(42, 0, failingConn{server})
+	players.Add(p)
+
+	broadcast(WSMessage{Type: "announcement", Text: "hello"})
+	waitFor(t, "pruning", func() bool { return len(players.Lookup(42)) == 0 })
+	if n := disconnects.snapshot()[leaveError]; n != 1 {
+		t.Errorf("error disconnects = %d, want 1", n)
+	}
+}
+
+func TestFailingWritesLogOnceAndRemoveOnce(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &disconnects, newTypeCounters())
+	logs := captureLog(t)
+	server, _ := newMemConnPair()
+	p := newPlayer(43, 0, failingConn{server})
+	players.Add(p)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			broadcast(WSMessage{Type: "announcement", Text: "hello"})
+			if p.writeFailed(net.ErrClosed) {
+				disconnectPlayers([]*Player{p}, leaveError)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "pruning", func() bool { return len(players.Lookup(43)) == 0 })
+	if n := strings.Count(logs.String(), "Write to player 43 failed"); n != 1 {
+		t.Errorf("logged %d write errors, want 1:\n%s", n, logs)
+	}
+	if n := disconnects.snapshot()[leaveError]; n != 1 {
+		t.Errorf("error disconnects = %d, want 1", n)
+	}
+}
+
+func TestBasePathMountsSPAAndWebSocket(t *testing.T) {
+	resetPlayers(t)
+	withDist(t, map[string]string{"index.html": "<title>garden</title>", "app.js": "js"})
+	setVar(t, &basePath, "/game")
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+
+	for path, want := range map[string]string{
+		"/game/":          "<title>garden</title>",
+		"/game/some/page": "<title>garden</title>",
+		"/game/app.js":    "js",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("GET %s: %d %q, want %q", path, resp.StatusCode, body, want)
+		}
+	}
+	if resp, err := http.Get(srv.URL + "/app.js"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /app.js outside the base path: %v %v, want 404", resp.StatusCode, err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/game/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","publicKey":"base-path"}`))
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var welcome WSMessage
+	if err := conn.ReadJSON(&welcome); err != nil || welcome.Type != "welcome" {
+		t.Errorf("over /game/ws got %+v, %v; want welcome", welcome, err)
+	}
+	conn.Close()
+	waitFor(t, "the session to end", func() bool { return players.Len() == 0 })
+}
+
+func TestFallbackJoinsGetDistinctPaletteColors(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	setVar(t, &fallbackPalette, []float64{30, 150, 270})
+	setVar(t, &paletteIndex, 0)
+
+	seen := make(map[float64]bool)
+	for range 3 {
+		hue := join(t, `{"type":"hello"}`).hue()
+		if !slices.Contains(fallbackPalette, hue) {
+			t.Errorf("hue %g not from the palette", hue)
+		}
+		if seen[hue] {
+			t.Errorf("hue %g handed out twice", hue)
+		}
+		seen[hue] = true
+	}
+}
+
+// stalledConn is a connection whose writes block until released, like a
+// congested link
+type stalledConn struct {
+	*memConn
+	release chan struct{}
+}
+
+func (c stalledConn) WriteMessage(messageType int, data []byte) error {
+	<-c.release
+	return c.memConn.WriteMessage(messageType, data)
+}
+
+// addPlayer adds a player served over conn without a session, at x
+func addPlayer(t *testing.T, id uint64, conn Conn, x float64) *Player {
+	t.Helper()
+	p := newPlayer(id, 0, conn)
+	p.state.X = x
+	players.Add(p)
+	return p
+}
+
+func TestCongestedClientGetsFewerFramesAndStays(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &sendQueueSize, 8)
+	setVar(t, &sendBacklogThreshold, 3)
+	skipped, dropped := skippedFrames.Load(), droppedFrames.Load()
+
+	server, client := newMemConnPair()
+	stalled := stalledConn{server, make(chan struct{})}
+	slow := addPlayer(t, 1, stalled, 0)
+	other, _ := newMemConnPair()
+	addPlayer(t, 2, other, 1)
+
+	// the pump holds one frame; the queue then fills up to the threshold
+	for range 10 {
+		broadcastTick()
+	}
+	if got := len(slow.send); got != sendBacklogThreshold {
+		t.Errorf("queued %d players frames, want %d", got, sendBacklogThreshold)
+	}
+	if n := skippedFrames.Load() - skipped; n < 5 {
+		t.Errorf("skipped %d frames, want most of them", n)
+	}
+
+	// other messages still queue until the queue is full, then drop
+	for range 10 {
+		broadcast(WSMessage{Type: "announcement", Text: "spam"})
+	}
+	if droppedFrames.Load() == dropped {
+		t.Error("no frames dropped with a full queue")
+	}
+	if len(players.Lookup(1)) == 0 {
+		t.Fatal("congested player was disconnected")
+	}
+
+	// once the link recovers, the backlog drains and frames flow again
+	close(stalled.release)
+	waitFor(t, "the queue to drain", func() bool { return len(slow.send) == 0 })
+	for {
+		client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, _, err := client.ReadMessage(); err != nil {
+			break
+		}
+	}
+	broadcastTick()
+	client.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, data, err := client.ReadMessage(); err != nil || messageTypeOf(data) != "players" {
+		t.Errorf("after draining got %s, %v; want players", data, err)
+	}
+}
+
+func TestReconnectWithinGraceSuppressesLeave(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	setVar(t, &disconnectGrace, 150*time.Millisecond)
+	observer := joinKey(t, "observer")
+	flaky := joinKey(t, "flaky")
+
+	flaky.conn.Close()
+	waitFor(t, "the disconnect", func() bool { return players.Len() == 1 })
+	back := joinKey(t, "flaky")
+	if back.id != flaky.id {
+		t.Fatalf("reconnected as %d, want %d", back.id, flaky.id)
+	}
+	observer.expectNone("playerLeft", 3*disconnectGrace)
+}
+
+func TestLeaveBroadcastAfterGrace(t *testing.T) {
+	resetPlayers(t)
+	resetActors(t)
+	setVar(t, &disconnectGrace, 50*time.Millisecond)
+	observer := joinKey(t, "observer")
+	gone := joinKey(t, "gone")
+
+	start := time.Now()
+	gone.conn.Close()
+	if msg := observer.expect("playerLeft"); msg.ID != gone.id {
+		t.Errorf("playerLeft for %d, want %d", msg.ID, gone.id)
+	}
+	if waited := time.Since(start); waited < disconnectGrace {
+		t.Errorf("playerLeft after %v, before the %v grace period", waited, disconnectGrace)
+	}
+}
+
+func TestSilentClientClosedAtHelloTimeout(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &helloTimeout, 50*time.Millisecond)
+	c := dial(t)
+
+	ce := c.closed()
+	if ce == nil || ce.Code != websocket.ClosePolicyViolation || ce.Text != "hello timeout" {
+		t.Errorf("closed with %v, want policy violation \"hello timeout\"", ce)
+	}
+}
+
+func TestPingsDontExtendHelloDeadline(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &helloTimeout, 100*time.Millisecond)
+	c := dial(t)
+
+	// A slow client keeping the connection busy without ever saying hello
+	start := time.Now()
+	for range 4 {
+		if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			break
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+	ce := c.closed()
+	if ce == nil || ce.Text != "hello timeout" {
+		t.Fatalf("closed with %v, want \"hello timeout\"", ce)
+	}
+	if waited := time.Since(start); waited > 4*helloTimeout {
+		t.Errorf("closed after %v", waited)
+	}
+}
+
+func TestPingBeforeHelloStillJoins(t *testing.T) {
+	resetPlayers(t)
+	c := dial(t)
+	if err := c.conn.WriteMessage(websocket.PingMessage, []byte("early")); err != nil {
+		t.Fatal(err)
+	}
+	c.send(`{"type":"hello","publicKey":"pinged-first"}`)
+	c.expect("welcome")
+}
+
+func TestPingsAnsweredWhileHelloWindowRuns(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &helloTimeout, 300*time.Millisecond)
+	c := dial(t)
+	var pongs atomic.Int32
+	c.conn.SetPongHandler(func(appData string) error {
+		if appData == "keepalive" {
+			pongs.Add(1)
+		}
+		return nil
+	})
+
+	for range 3 {
+		if err := c.conn.WriteMessage(websocket.PingMessage, []byte("keepalive")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.send(`{"type":"hello","publicKey":"kept-alive"}`)
+	if msg := c.expect("welcome"); msg.ID == 0 {
+		t.Errorf("welcome = %+v", msg)
+	}
+	if n := pongs.Load(); n != 3 {
+		t.Errorf("got %d pongs for 3 pings before the hello", n)
+	}
+}
+
+func TestHelloLimits(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &maxMessageSize, 64)
+
+	c := dial(t)
+	c.send(`{"type":"hello","publicKey":"` + strings.Repeat("k", 100) + `"}`)
+	if ce := c.closed(); ce == nil || ce.Code != websocket.CloseMessageTooBig || ce.Text != "hello too large" {
+		t.Errorf("oversized hello: closed with %v", ce)
+	}
+
+	c = dial(t)
+	for range maxHelloPings + 1 {
+		c.conn.WriteMessage(websocket.PingMessage, nil)
+	}
+	if ce := c.closed(); ce == nil || ce.Text != "too many pings" {
+		t.Errorf("ping flood: closed with %v", ce)
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	tests := []struct{ addr, want string }{
+		{"192.0.2.7:5678", "192.0.2.7"},
+		{"192.0.2.7", "192.0.2.7"},
+		{"[::1]:12345", "::1"},
+		{"[2001:db8::2]:443", "2001:db8::2"},
+		{"[2001:db8::2]", "2001:db8::2"},
+		{"2001:db8::2", "2001:db8::2"},
+		{"[fe80::1%eth0]:80", "fe80::1%eth0"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := remoteHost(tt.addr); got != tt.want {
+			t.Errorf("remoteHost(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestLeaveReasons(t *testing.T) {
+	leave := map[string]func(t *testing.T, c *testClient){
+		leaveLeft: func(t *testing.T, c *testClient) { c.conn.Close() },
+		leaveTimeout: func(t *testing.T, c *testClient) {
+			p := findPlayers(c.id)[0]
+			p.stateMu.Lock()
+			p.lastPing = time.Now().Add(-time.Minute)
+			p.stateMu.Unlock()
+			disconnectStale(time.Now())
+		},
+		leaveKicked: func(t *testing.T, c *testClient) {
+			withAdmin(t)
+			if rec := adminDo(http.MethodPost, "/admin/kick", fmt.Sprintf(`{"id":%d}`, c.id)); rec.Code != http.StatusOK {
+				t.Fatalf("kick: %d %s", rec.Code, rec.Body)
+			}
+			if ce := c.closed(); ce == nil || ce.Text != leaveKicked {
+				t.Errorf("kicked client closed with %v", ce)
+			}
+		},
+	}
+	for reason, leave := range leave {
+		t.Run(reason, func(t *testing.T) {
+			resetPlayers(t)
+			setVar(t, &disconnectGrace, 0)
+			observer := joinKey(t, "observer")
+			leaver := joinKey(t, "leaver")
+
+			leave(t, leaver)
+			msg := observer.expect("playerLeft")
+			if msg.ID != leaver.id || msg.Reason != reason {
+				t.Errorf("playerLeft %d (%q), want %d (%q)", msg.ID, msg.Reason, leaver.id, reason)
+			}
+		})
+	}
+}
+
+func TestShutdownClosesEveryoneWithReason(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &disconnects, newTypeCounters())
+	a, b := joinKey(t, "a"), joinKey(t, "b")
+
+	shutdownPlayers(context.Background())
+	for _, c := range []*testClient{a, b} {
+		if ce := c.closed(); ce == nil || !strings.Contains(ce.Text, `"reason":"shutdown"`) {
+			t.Errorf("closed with %v, want reason shutdown", ce)
+		}
+	}
+	if n := disconnects.snapshot()[leaveShutdown]; n != 2 {
+		t.Errorf("shutdown disconnects = %d, want 2", n)
+	}
+}
+
+// slowCloseConn is a client that never takes its close frame, so every
+// close write runs into its deadline
+type slowCloseConn struct {
+	*memConn
+}
+
+func (c slowCloseConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	time.Sleep(time.Until(deadline))
+	return memTimeoutError{}
+}
+
+func TestShutdownWithSlowClientsFinishesInTime(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &closeWorkers, 8)
+	setVar(t, &closeWriteTimeout, 100*time.Millisecond)
+	var list []*Player
+	for id := range uint64(32) {
+		server, _ := newMemConnPair()
+		list = append(list, addPlayer(t, id+1, slowCloseConn{server}, 0))
+	}
+
+	// one at a time, the close writes alone would take 3.2s
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	shutdownPlayers(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v, want within the 1s deadline", elapsed)
+	}
+	for _, p := range list {
+		select {
+		case <-p.done:
+		default:
+			t.Fatalf("player %d still open after shutdown", p.ID)
+		}
+	}
+	if n := players.Len(); n != 0 {
+		t.Errorf("%d players left after shutdown", n)
+	}
+}
+
+func TestStableOrderBroadcasts(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &stableOrder, true)
+	for _, id := range []uint64{107, 103, 112, 101, 109} {
+		server, _ := newMemConnPair()
+		addPlayer(t, id, server, float64(id))
+	}
+	var ids []uint64
+	for _, p := range connectedPlayers() {
+		ids = append(ids, p.ID)
+	}
+	if !slices.IsSorted(ids) || len(ids) != 5 {
+		t.Errorf("players in order %v, want sorted by ID", ids)
+	}
+
+	observer := joinKey(t, "observer")
+	observer.moveTo(-1)
+	broadcastTick()
+	first := observer.expectRaw("players")
+	broadcastTick()
+	if second := observer.expectRaw("players"); string(second) != string(first) {
+		t.Errorf("frames differ:\n%s\n%s", first, second)
+	}
+	// Keys are serialized sorted as strings
+	if i := strings.Index(string(first), `"players":`); i < 0 || !strings.HasPrefix(string(first[i:]), `"players":{"101":`) {
+		t.Errorf("players frame %s doesn't start with player 101", first)
+	}
+}
+
+func TestSlowTickIsLogged(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &slowTickThreshold, 20*time.Millisecond)
+	logs := captureLog(t)
+	a, _ := newMemConnPair()
+	b, _ := newMemConnPair()
+	addPlayer(t, 1, a, 0)
+	addPlayer(t, 2, b, 1)
+
+	timedTick(findRoom(mainRoomID))
+	if strings.Contains(logs.String(), "Slow broadcast tick") {
+		t.Fatalf("fast tick logged as slow: %s", logs)
+	}
+
+	setVar(t, &tickHooks, []func([]*Player){func([]*Player) { time.Sleep(30 * time.Millisecond) }})
+	timedTick(findRoom(mainRoomID))
+	if !strings.Contains(logs.String(), "Slow broadcast tick") || !strings.Contains(logs.String(), "for 2 players") {
+		t.Errorf("slow tick not logged: %s", logs)
+	}
+}
+
+func TestSoloBroadcastRunsTickHooks(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &tickHooks, []func([]*Player){func(list []*Player) {
+		sendAll(list, WSMessage{Type: "entities", Text: "fountain"})
+	}})
+	solo := joinKey(t, "solo")
+
+	setVar(t, &soloBroadcast, false)
+	broadcastTick()
+	solo.expectNone("entities", 20*time.Millisecond)
+
+	soloBroadcast = true
+	broadcastTick()
+	if msg := solo.expect("entities"); msg.Text != "fountain" {
+		t.Errorf("entities = %q", msg.Text)
+	}
+	solo.expectNone("players", 20*time.Millisecond)
+}
+
+func TestPingPositionUpdatesBroadcastState(t *testing.T) {
+	resetPlayers(t)
+	mobile := joinKey(t, "mobile")
+	observer := joinKey(t, "observer")
+	mobile.send(`{"type":"state","state":{"x":1,"y":0,"z":0,"vx":3,"vy":0,"vz":0}}`)
+
+	mobile.send(`{"type":"ping","position":{"x":7,"y":2,"z":-4}}`)
+	mobile.expect("pong")
+	broadcastTick()
+	state, ok := observer.expect("players").Players[mobile.id]
+	if !ok {
+		t.Fatal("mobile player missing from the frame")
+	}
+	if state.X != 7 || state.Y != 2 || state.Z != -4 || state.VX != 0 {
+		t.Errorf("state = %+v, want the ping position at rest", state)
+	}
+}
+
+func TestMixedMessagesExceedGlobalBudget(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &messageRate, 1)
+	setVar(t, &messageBurst, 4)
+	setVar(t, &messageViolations, 3)
+	observer := joinKey(t, "budget-observer")
+	c := joinKey(t, "chatty")
+
+	for i := range 10 {
+		if i%2 == 0 {
+			c.send(`{"type":"ping"}`)
+		} else {
+			c.send(`{"type":"state","state":{"x":1,"y":0,"z":0}}`)
+		}
+	}
+	ce := c.closed()
+	if ce.Code != websocket.ClosePolicyViolation || ce.Text != "rate limit exceeded" {
+		t.Errorf("closed with %d %q, want policy violation for the rate limit", ce.Code, ce.Text)
+	}
+	if msg := observer.expect("playerLeft"); msg.ID != c.id || msg.Reason != leaveOverBudget {
+		t.Errorf("playerLeft %d (%q), want %d (%q)", msg.ID, msg.Reason, c.id, leaveOverBudget)
+	}
+}
+
+func TestViolationsResetAfterQuietWindow(t *testing.T) {
+	setVar(t, &messageViolationWindow, 10*time.Second)
+	var v violationCounter
+	start := time.Now()
+	v.add(start)
+	v.add(start.Add(5 * time.Second))
+	if n := v.add(start.Add(10 * time.Second)); n != 3 {
+		t.Errorf("violations 5s apart counted %d, want 3", n)
+	}
+	if n := v.add(start.Add(time.Minute)); n != 1 {
+		t.Errorf("violation after a quiet minute counted %d, want 1", n)
+	}
+}
+
+func TestFirstStateAfterJoinBroadcastsZeroVelocity(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &zeroSpawnVelocity, true)
+	spawner := joinKey(t, "spawner")
+	observer := joinKey(t, "spawn-observer")
+
+	spawner.send(`{"type":"state","state":{"x":1,"y":0,"z":0,"vx":3,"vy":-2,"vz":5}}`)
+	spawner.send(`{"type":"ping"}`)
+	spawner.expect("pong")
+	broadcastTick()
+	if state := observer.expect("players").Players[spawner.id]; state.X != 1 || state.VX != 0 || state.VY != 0 || state.VZ != 0 {
+		t.Errorf("first state = %+v, want x 1 at rest", state)
+	}
+
+	spawner.send(`{"type":"state","state":{"x":2,"y":0,"z":0,"vx":3,"vy":-2,"vz":5}}`)
+	spawner.send(`{"type":"ping"}`)
+	spawner.expect("pong")
+	broadcastTick()
+	if state := observer.expect("players").Players[spawner.id]; state.VX != 3 || state.VY != -2 || state.VZ != 5 {
+		t.Errorf("confirmed state = %+v, want its velocity", state)
+	}
+}
+
+func TestHelloStateLeaveFlow(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &disconnectGrace, 0)
+	observer := joinKey(t, "flow-observer")
+
+	walker := dial(t)
+	walker.send(`{"type":"hello","publicKey":"flow-walker"}`)
+	welcome := walker.expect("welcome")
+	if welcome.ID == 0 || welcome.ID == observer.id {
+		t.Fatalf("welcomed as %d beside observer %d", welcome.ID, observer.id)
+	}
+	for observer.expect("playerCount").PlayerCount != 2 {
+		// skip the count from the observer's own join
+	}
+
+	walker.send(`{"type":"state","state":{"x":4,"y":1,"z":-2}}`)
+	walker.send(`{"type":"ping"}`)
+	walker.expect("pong")
+	broadcastTick()
+	if state := observer.expect("players").Players[welcome.ID]; state.X != 4 || state.Y != 1 || state.Z != -2 {
+		t.Errorf("observer sees the walker at %+v, want (4, 1, -2)", state)
+	}
+	walker.expect("players") // a write still pending when it closes would fail as an error
+
+	walker.conn.Close()
+	if msg := observer.expect("playerLeft"); msg.ID != welcome.ID || msg.Reason != leaveLeft {
+		t.Errorf("playerLeft %d (%q), want %d (%q)", msg.ID, msg.Reason, welcome.ID, leaveLeft)
+	}
+	waitFor(t, "the walker to be removed", func() bool { return players.Len() == 1 })
+}
+
+func TestDrainingCloseCarriesBackoffHint(t *testing.T) {
+	resetPlayers(t)
+	draining.Store(true)
+	t.Cleanup(func() { draining.Store(false) })
+
+	ce := dial(t).closed()
+	if ce == nil || ce.Code != websocket.CloseGoingAway {
+		t.Fatalf("closed with %v, want going away", ce)
+	}
+	var reason CloseReason
+	if err := json.Unmarshal([]byte(ce.Text), &reason); err != nil {
+		t.Fatalf("close reason %q: %v", ce.Text, err)
+	}
+	hint := reconnectHints[closeDraining]
+	retry := time.Duration(reason.RetryAfterMs) * time.Millisecond
+	if reason.Reason != closeDraining || retry < hint.delay || retry >= hint.delay+hint.jitter {
+		t.Errorf("close reason %+v, want draining with a retry in [%v, %v)", reason, hint.delay, hint.delay+hint.jitter)
+	}
+}
+
+type panickingConn struct {
+	*memConn
+}
+
+func (panickingConn) WriteMessage(int, []byte) error { panic("encoder bug") }
+
+func TestPanicInPlayerWriteLeavesOthersTicking(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &disconnectGrace, 0)
+	logs := captureLog(t)
+	observer := joinKey(t, "steady")
+	server, _ := newMemConnPair()
+	broken := addPlayer(t, 7, panickingConn{server}, 1)
+
+	broadcastTick()
+	observer.expect("players")
+	if msg := observer.expect("playerLeft"); msg.ID != broken.ID || msg.Reason != leaveError {
+		t.Errorf("playerLeft %d (%q), want %d (%q)", msg.ID, msg.Reason, broken.ID, leaveError)
+	}
+	if !strings.Contains(logs.String(), "Panic writing to player 7") {
+		t.Errorf("panic not logged: %s", logs)
+	}
+
+	// the loop goes on, and so does a tick whose hook panics
+	setVar(t, &soloBroadcast, true)
+	calls := 0
+	setVar(t, &tickHooks, []func([]*Player){func(list []*Player) {
+		if calls++; calls == 1 {
+			panic("hook bug")
+		}
+		sendAll(list, WSMessage{Type: "entities"})
+	}})
+	stop := make(chan struct{})
+	defer close(stop)
+	go broadcastPlayerStates(findRoom(mainRoomID), stop)
+	observer.expect("entities")
+}
+
+func TestCompressedFramesDecode(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &upgrader.EnableCompression, true)
+	setVar(t, &wsCompressionLevel, 9)
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") || !strings.Contains(ext, "server_no_context_takeover") {
+		t.Fatalf("negotiated extensions %q, want permessage-deflate without context takeover", ext)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","publicKey":"deflated"}`))
+	joinKey(t, "deflate-peer")
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var welcome WSMessage
+	if err := conn.ReadJSON(&welcome); err != nil || welcome.Type != "welcome" {
+		t.Fatalf("got %+v, %v; want welcome", welcome, err)
+	}
+	for range 3 {
+		broadcastTick()
+	}
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("reading compressed frames: %v", err)
+		}
+		if msg.Type == "players" && len(msg.Players) == 1 {
+			break
+		}
+	}
+}
+
+func TestHandshakesBeyondCapGet503(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &handshakes, newSemaphore(2))
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	// two connections that haven't said hello hold both slots
+	var pending []*websocket.Conn
+	for range 2 {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("within the cap: %v", err)
+		}
+		defer conn.Close()
+		pending = append(pending, conn)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("beyond the cap: %v, want 503", err)
+	}
+
+	// a hello frees its slot for the next connection
+	pending[0].WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","publicKey":"handshaker"}`))
+	pending[0].SetReadDeadline(time.Now().Add(testTimeout))
+	var welcome WSMessage
+	if err := pending[0].ReadJSON(&welcome); err != nil || welcome.Type != "welcome" {
+		t.Fatalf("got %+v, %v; want welcome", welcome, err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("after a handshake completed: %v", err)
+	}
+	conn.Close()
+
+	// the joined session ends before the next test starts
+	pending[0].Close()
+	waitFor(t, "the session to end", func() bool { return players.Len() == 0 })
+}
+
+func TestSweptPlayerLeavesWithLastState(t *testing.T) {
+	for _, include := range []bool{false, true} {
+		t.Run(fmt.Sprintf("include=%v", include), func(t *testing.T) {
+			resetPlayers(t)
+			setVar(t, &leaveLastState, include)
+			observer := joinKey(t, "fade-observer")
+			leaver := joinKey(t, "fade-leaver")
+			leaver.moveTo(3)
+
+			p := findPlayers(leaver.id)[0]
+			p.stateMu.Lock()
+			p.lastPing = time.Now().Add(-time.Minute)
+			p.stateMu.Unlock()
+			disconnectStale(time.Now())
+
+			msg := observer.expect("playerLeft")
+			if msg.ID != leaver.id || msg.Reason != leaveTimeout {
+				t.Fatalf("playerLeft %d (%q), want %d (timeout)", msg.ID, msg.Reason, leaver.id)
+			}
+			switch {
+			case !include && msg.State != nil:
+				t.Errorf("last state %+v sent with the option off", *msg.State)
+			case include && (msg.State == nil || msg.State.X != 3):
+				t.Errorf("last state %+v, want x=3", msg.State)
+			}
+		})
+	}
+}
+
+// startHTTPServer runs newHTTPServer on a free local port until the test ends
+func startHTTPServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(ln.Addr().String())
+	// Close leaves hijacked WebSockets running, so their handlers are
+	// waited for before the test's globals are restored
+	var handlers sync.WaitGroup
+	routes := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		routes.ServeHTTP(w, r)
+	})
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+		handlers.Wait()
+	})
+	return ln.Addr().String()
+}
+
+func TestSlowHeadersCutOff(t *testing.T) {
+	setVar(t, &httpReadHeaderTimeout, 100*time.Millisecond)
+	addr := startHTTPServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Slow: ")
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	io.ReadAll(conn)
+	if elapsed := time.Since(start); elapsed >= testTimeout {
+		t.Errorf("connection still open after %v", elapsed)
+	}
+}
+
+func TestHTTPTimeoutsSpareWebSockets(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &httpReadHeaderTimeout, 50*time.Millisecond)
+	setVar(t, &httpReadTimeout, 50*time.Millisecond)
+	setVar(t, &httpWriteTimeout, 50*time.Millisecond)
+	setVar(t, &httpIdleTimeout, 50*time.Millisecond)
+	addr := startHTTPServer(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		conn.Close()
+		waitFor(t, "the session to end", func() bool { return players.Len() == 0 })
+	}()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","publicKey":"long-lived"}`))
+	time.Sleep(200 * time.Millisecond)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ping"}`)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("WebSocket cut off past the HTTP timeouts: %v", err)
+		}
+		if msg.Type == "pong" {
+			return
+		}
+	}
+}
+
+func TestStateRightAfterHelloIsApplied(t *testing.T) {
+	resetPlayers(t)
+	for name, msgs := range map[string][]string{
+		"after hello":   {`{"type":"hello","publicKey":"eager"}`, `{"type":"state","state":{"x":7,"y":0,"z":0}}`},
+		"without hello": {`{"type":"state","state":{"x":7,"y":0,"z":0}}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := dial(t)
+			for _, msg := range msgs {
+				c.send(msg)
+			}
+			c.id = c.expect("welcome").ID
+			c.send(`{"type":"ping"}`)
+			c.expect("pong")
+			p := findPlayers(c.id)[0]
+			p.stateMu.Lock()
+			defer p.stateMu.Unlock()
+			if p.state.X != 7 || p.stateCount != 1 {
+				t.Errorf("state x=%v after %d states, want the early state applied", p.state.X, p.stateCount)
+			}
+		})
+	}
+}
+
+func TestEventsWithinWindowArriveAsOneBatch(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &coalesceWindow, 50*time.Millisecond)
+	server, client := newMemConnPair()
+	p := addPlayer(t, 1, server, 0)
+	p.batching = true
+
+	p.Send(WSMessage{Type: "playerJoined", ID: 2})
+	p.Send(WSMessage{Type: "playerCount", PlayerCount: 2})
+	p.Send(WSMessage{Type: "buildTime", Text: "now"})
+
+	client.SetReadDeadline(time.Now().Add(testTimeout))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch WSMessage
+	if err := json.Unmarshal(data, &batch); err != nil || batch.Type != "batch" {
+		t.Fatalf("got %s, want a batch", data)
+	}
+	var types []string
+	for _, raw := range batch.Messages {
+		types = append(types, messageTypeOf(raw))
+	}
+	if !slices.Equal(types, []string{"playerJoined", "playerCount", "buildTime"}) {
+		t.Errorf("batch holds %v", types)
+	}
+
+	// without the capability every message is its own frame
+	p.batching = false
+	p.Send(WSMessage{Type: "playerJoined", ID: 3})
+	if _, data, err := client.ReadMessage(); err != nil || messageTypeOf(data) != "playerJoined" {
+		t.Errorf("got %s, %v; want a lone playerJoined", data, err)
+	}
+}
+
+func TestHiddenTabGetsNoPlayersFramesUntilVisible(t *testing.T) {
+	resetPlayers(t)
+	hidden, other := joinKey(t, "hidden-tab"), joinKey(t, "visible-tab")
+	hidden.send(`{"type":"visibility","visible":false}`)
+	hidden.send(`{"type":"ping"}`)
+	hidden.expect("pong")
+
+	broadcastTick()
+	other.expect("players")
+	hidden.expectNone("players", 100*time.Millisecond)
+	if len(findPlayers(hidden.id)) != 1 {
+		t.Fatal("hidden player was disconnected")
+	}
+
+	hidden.send(`{"type":"visibility","visible":true}`)
+	hidden.send(`{"type":"ping"}`)
+	hidden.expect("pong")
+	broadcastTick()
+	if _, ok := hidden.expect("players").Players[other.id]; !ok {
+		t.Error("resumed player's frame is missing the other player")
+	}
+}
+
+func TestJoinsWithinDebounceGiveOneCount(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &playerCountDebounce, 100*time.Millisecond)
+	observer := joinKey(t, "count-observer")
+	if n := observer.expect("playerCount").PlayerCount; n != 1 {
+		t.Fatalf("first count %d, want 1", n)
+	}
+
+	for _, key := range []string{"count-a", "count-b", "count-c"} {
+		joinKey(t, key)
+	}
+	var counts []int
+	deadline := time.Now().Add(400 * time.Millisecond)
+	for {
+		_, data, err := observer.read(time.Until(deadline))
+		if err != nil {
+			break
+		}
+		if messageTypeOf(data) == "playerCount" {
+			var msg WSMessage
+			json.Unmarshal(data, &msg)
+			counts = append(counts, msg.PlayerCount)
+		}
+	}
+	if !slices.Equal(counts, []int{4}) {
+		t.Errorf("counts after three joins: %v, want a single 4", counts)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The join snapshot is sent as SNAPSHOT_CHUNK_SIZE players per snapshotChunk,
+// followed by snapshotEnd. With SNAPSHOT_COMPRESS each chunk's players map
+// is gzipped and base64-encoded into data instead.
+var (
+	snapshotChunkSize = max(getEnvInt("SNAPSHOT_CHUNK_SIZE", 50), 1)
+	snapshotCompress  = getEnvBool("SNAPSHOT_COMPRESS", false)
+)
+
+// MAX_FRAME_SIZE caps the size of snapshot frames, the ones that grow with
+// the world (a chunk of players with cubes, or the compressed data). A
+// larger frame goes out as framePart messages: its bytes base64-encoded
+// and cut into parts that share a partId, numbered by seq out of total.
+// The client joins the data in order, decodes it and handles the result as
+// if the frame had arrived whole. 0 disables the cap.
+var maxFrameSize = getEnvInt("MAX_FRAME_SIZE", 0)
+
+func init() {
+	if maxFrameSize > 0 && maxFrameSize < minFrameSize {
+		log.Printf("MAX_FRAME_SIZE=%d is too small, using %d", maxFrameSize, minFrameSize)
+		maxFrameSize = minFrameSize
+	}
+}
+
+const (
+	minFrameSize      = 1024
+	framePartOverhead = 128 // room left in each part for the envelope
+)
+
+var framePartCounter atomic.Uint64
+
+// sendLarge sends msg, split into framePart messages if it exceeds
+// MAX_FRAME_SIZE. Outbound metrics count the messages that go out, so
+// the parts of a split frame and not the frame itself.
+func (p *Player) sendLarge(msg WSMessage) error {
+	data := encodeMessage(msg, p.stringIDs)
+	if maxFrameSize <= 0 || len(data) <= maxFrameSize {
+		outboundMessages.add(msg.Type, 1)
+		return p.WriteMessage(websocket.TextMessage, data)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	size := maxFrameSize - framePartOverhead
+	total := (len(encoded) + size - 1) / size
+	partID := framePartCounter.Add(1)
+	for seq := range total {
+		part := encoded[seq*size : min((seq+1)*size, len(encoded))]
+		if err := p.Send(WSMessage{Type: "framePart", PartID: partID, Seq: &seq, Total: &total, Data: part}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// playerStates returns the current state of each player, keyed by ID
+func playerStates(list []*Player) map[uint64]PlayerState {
+	states := make(map[uint64]PlayerState, len(list))
+	for _, player := range list {
+		player.stateMu.Lock()
+		state := player.state
+		state.ColorHue = player.hueAt(time.Now())
+		state.Team, state.Lightness = player.Team, player.Lightness
+		states[player.ID] = state
+		player.stateMu.Unlock()
+	}
+	return states
+}
+
+// snapshotChunks splits the states of everyone else in self's room into
+// chunk messages. Like the broadcast tick it excludes by ID, so another
+// session of the same actor isn't sent as someone else.
+func snapshotChunks(self *Player) []WSMessage {
+	var others []*Player
+	for _, player := range self.room.players() {
+		if player.ID != self.ID && player.isReady() {
+			others = append(others, player)
+		}
+	}
+
+	var chunks []WSMessage
+	for start := 0; start < len(others); start += snapshotChunkSize {
+		end := min(start+snapshotChunkSize, len(others))
+		states := playerStates(others[start:end])
+		seq := len(chunks)
+		msg := WSMessage{Type: "snapshotChunk", Seq: &seq}
+		if snapshotCompress && omitZeroVelocity {
+			msg.Data = compressJSON(leanStates(states))
+		} else if snapshotCompress {
+			msg.Data = compressJSON(states)
+		} else {
+			msg.Players = states
+		}
+		chunks = append(chunks, msg)
+	}
+	total := len(chunks)
+	for i := range chunks {
+		chunks[i].Total = &total
+	}
+	return chunks
+}
+
+// sendSnapshot sends a joining player the current state of the world,
+// stopping at the first frame that can't be queued
+func sendSnapshot(p *Player) error {
+	chunks := snapshotChunks(p)
+	for _, chunk := range chunks {
+		if err := p.sendLarge(chunk); err != nil {
+			return err
+		}
+	}
+	total := len(chunks)
+	return p.Send(WSMessage{Type: "snapshotEnd", Total: &total})
+}
+
+// compressJSON gzips the JSON encoding of v and returns it base64-encoded
+func compressJSON(v any) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	json.NewEncoder(gz).Encode(v)
+	gz.Close()
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// readSnapshot reads the join snapshot up to snapshotEnd and reassembles
+// its chunks, checking they arrive numbered in order. Chunks split into
+// framePart messages are joined first.
+func (c *testClient) readSnapshot() map[uint64]PlayerState {
+	c.t.Helper()
+	states := make(map[uint64]PlayerState)
+	chunks := 0
+	var parts []string
+	for {
+		_, data, err := c.read(testTimeout)
+		if err != nil {
+			c.t.Fatalf("waiting for snapshot: %v", err)
+		}
+		if maxFrameSize > 0 && len(data) > maxFrameSize {
+			c.t.Errorf("%d byte frame over MAX_FRAME_SIZE=%d", len(data), maxFrameSize)
+		}
+		var msg WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.t.Fatal(err)
+		}
+		if msg.Type == "framePart" {
+			if msg.Seq == nil || *msg.Seq != len(parts) || msg.Total == nil || msg.PartID == 0 {
+				c.t.Fatalf("part %d: %s", len(parts), data)
+			}
+			if parts = append(parts, msg.Data); len(parts) < *msg.Total {
+				continue
+			}
+			whole, err := base64.StdEncoding.DecodeString(strings.Join(parts, ""))
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			parts, data, msg = nil, whole, WSMessage{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		switch msg.Type {
+		case "snapshotEnd":
+			if msg.Total == nil || *msg.Total != chunks {
+				c.t.Errorf("snapshotEnd total %v after %d chunks: %s", msg.Total, chunks, data)
+			}
+			return states
+		case "snapshotChunk":
+		default:
+			continue
+		}
+		if msg.Seq == nil || *msg.Seq != chunks || msg.Total == nil {
+			c.t.Fatalf("chunk %d: %s", chunks, data)
+		}
+		chunks++
+		players := msg.Players
+		if msg.Data != "" {
+			players = decompressStates(c.t, msg.Data)
+		}
+		for id, state := range players {
+			if _, dup := states[id]; dup {
+				c.t.Errorf("player %d in two chunks", id)
+			}
+			states[id] = state
+		}
+	}
+}
+
+func decompressStates(t *testing.T, data string) map[uint64]PlayerState {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states map[uint64]PlayerState
+	if err := json.NewDecoder(gz).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+	return states
+}
+
+// addPlayers adds n players without sessions, with IDs from 1001 and x = ID
+func addPlayers(t *testing.T, n int) {
+	t.Helper()
+	for i := range n {
+		server, _ := newMemConnPair()
+		id := uint64(1001 + i)
+		addPlayer(t, id, server, float64(id))
+	}
+}
+
+func TestSnapshotChunksReassemble(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "compressed"
+		}
+		t.Run(name, func(t *testing.T) {
+			resetPlayers(t)
+			setVar(t, &snapshotChunkSize, 4)
+			setVar(t, &snapshotCompress, compress)
+			addPlayers(t, 10) // three chunks: 4, 4 and 2
+
+			c := dial(t)
+			c.send(`{"type":"hello","publicKey":"snapshot-reader"}`)
+			states := c.readSnapshot()
+			if len(states) != 10 {
+				t.Fatalf("reassembled %d players, want 10", len(states))
+			}
+			for id, state := range states {
+				if id < 1001 || id > 1010 || state.X != float64(id) {
+					t.Errorf("player %d at x %v", id, state.X)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptySnapshotEndsWithTotalZero(t *testing.T) {
+	resetPlayers(t)
+	c := dial(t)
+	c.send(`{"type":"hello","publicKey":"alone"}`)
+	if states := c.readSnapshot(); len(states) != 0 {
+		t.Errorf("snapshot of an empty world has %d players", len(states))
+	}
+}
+
+func TestUnsentSnapshotEndsSession(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &snapshotChunkSize, 1)
+	setVar(t, &sendQueueSize, 2)
+	addPlayers(t, 5)
+
+	// The pump blocks on the welcome, so the third chunk finds the queue full
+	server, client := newMemConnPair()
+	stalled := stalledConn{server, make(chan struct{})}
+	defer close(stalled.release)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		servePlayer(stalled, "192.0.2.1", func() {})
+	}()
+	client.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","publicKey":"congested"}`))
+
+	waitFor(t, "the session to end", func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	if n := players.Len(); n != 5 {
+		t.Errorf("%d players left, want 5", n)
+	}
+}
+
+func TestJoinSnapshotExcludesSelf(t *testing.T) {
+	resetPlayers(t)
+	first := joinKey(t, "snapshot-first")
+
+	second := dial(t)
+	second.send(`{"type":"hello","publicKey":"snapshot-second"}`)
+	second.welcome = second.expect("welcome")
+	states := second.readSnapshot()
+	if _, ok := states[second.welcome.ID]; ok {
+		t.Errorf("snapshot includes the joiner %d itself", second.welcome.ID)
+	}
+	if _, ok := states[first.id]; !ok || len(states) != 1 {
+		t.Errorf("snapshot = %v, want only player %d", states, first.id)
+	}
+}
+
+func TestOversizedSnapshotIsSplitAndReassembles(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &maxFrameSize, minFrameSize)
+	setVar(t, &snapshotChunkSize, 40)
+	setVar(t, &outboundMessages, newTypeCounters())
+	addPlayers(t, 40) // one chunk of a few KB
+
+	c := dial(t)
+	c.send(`{"type":"hello","publicKey":"split-reader"}`)
+	states := c.readSnapshot()
+	if len(states) != 40 {
+		t.Fatalf("reassembled %d players, want 40", len(states))
+	}
+	for id, state := range states {
+		if state.X != float64(id) {
+			t.Errorf("player %d at x %v", id, state.X)
+		}
+	}
+	counts := outboundMessages.snapshot()
+	if counts["framePart"] < 2 || counts["snapshotChunk"] != 0 {
+		t.Errorf("outbound = %v, want the parts counted instead of the chunk", counts)
+	}
+}
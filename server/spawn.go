@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Spawn is where a new player starts and which way it faces, sent in
+// welcome. Yaw is in radians about +Y, three.js style: 0 faces -Z.
+type Spawn struct {
+	Position Position `json:"position"`
+	Yaw      float64  `json:"yaw"`
+}
+
+// Players spawn on a circle of SPAWN_RADIUS around SPAWN_CENTER ("x,y,z"),
+// spread by ID along the golden angle, each facing the center. With no
+// radius they spawn at the center facing SPAWN_YAW.
+var (
+	spawnCenter = getEnvVec("SPAWN_CENTER", Position{})
+	spawnRadius = math.Max(getEnvFloat("SPAWN_RADIUS", 0), 0)
+	spawnYaw    = getEnvFloat("SPAWN_YAW", 0)
+)
+
+// goldenAngle spreads consecutive IDs evenly around the circle
+var goldenAngle = math.Pi * (3 - math.Sqrt(5))
+
+func getEnvVec(key string, fallback Position) Position {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	if parts := strings.Split(v, ","); len(parts) == 3 {
+		var xyz [3]float64
+		var err error
+		for i, part := range parts {
+			if xyz[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+				break
+			}
+		}
+		if err == nil && checkCoords(key, xyz[:]...) == nil {
+			return Position{X: xyz[0], Y: xyz[1], Z: xyz[2]}
+		}
+	}
+	reportInvalidEnv(key, v, fallback)
+	return fallback
+}
+
+// spawnFor returns the deterministic spawn of player id
+func spawnFor(id uint64) Spawn {
+	if spawnRadius == 0 {
+		return Spawn{Position: spawnCenter, Yaw: spawnYaw}
+	}
+	angle := math.Mod(float64(id)*goldenAngle, 2*math.Pi)
+	pos := Position{
+		X: spawnCenter.X + spawnRadius*math.Cos(angle),
+		Y: spawnCenter.Y,
+		Z: spawnCenter.Z + spawnRadius*math.Sin(angle),
+	}
+	return Spawn{Position: pos, Yaw: yawToward(pos, spawnCenter)}
+}
+
+// yawToward is the yaw that faces from from to to on the XZ plane
+func yawToward(from, to Position) float64 {
+	return math.Atan2(-(to.X - from.X), -(to.Z - from.Z))
+}
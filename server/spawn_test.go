@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSpawnFacesCenter(t *testing.T) {
+	setVar(t, &spawnCenter, Position{X: 10, Y: 2, Z: -5})
+	setVar(t, &spawnRadius, 8)
+	for id := uint64(1); id <= 12; id++ {
+		s := spawnFor(id)
+		// yaw 0 faces -Z, so the facing direction is (-sin, -cos) on XZ
+		fx, fz := -math.Sin(s.Yaw), -math.Cos(s.Yaw)
+		dx, dz := (spawnCenter.X-s.Position.X)/spawnRadius, (spawnCenter.Z-s.Position.Z)/spawnRadius
+		if math.Abs(fx-dx) > 1e-9 || math.Abs(fz-dz) > 1e-9 {
+			t.Errorf("player %d at %+v faces (%.3f, %.3f), want the center at (%.3f, %.3f)", id, s.Position, fx, fz, dx, dz)
+		}
+		if d := math.Hypot(s.Position.X-spawnCenter.X, s.Position.Z-spawnCenter.Z); math.Abs(d-spawnRadius) > 1e-9 {
+			t.Errorf("player %d spawned %v from the center, want %v", id, d, spawnRadius)
+		}
+	}
+
+	setVar(t, &spawnRadius, 0)
+	setVar(t, &spawnYaw, 1.25)
+	if s := spawnFor(3); s.Position != spawnCenter || s.Yaw != 1.25 {
+		t.Errorf("without a radius spawned %+v, want the center facing SPAWN_YAW", s)
+	}
+}
+
+func TestSpawnOrientationInWelcomeAndFrames(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &spawnCenter, Position{})
+	setVar(t, &spawnRadius, 5)
+	c := joinKey(t, "spawned")
+	want := spawnFor(c.id)
+	if c.welcome.Spawn == nil || *c.welcome.Spawn != want {
+		t.Fatalf("welcome spawn = %+v, want %+v", c.welcome.Spawn, want)
+	}
+
+	columnar := join(t, `{"type":"hello","publicKey":"spawn-watcher","capabilities":["columnar"]}`)
+	broadcastTick()
+	packed := columnar.expect("playersPacked").Packed
+	if len(packed.IDs) != 1 || packed.IDs[0] != c.id || packed.Yaws[0] != want.Yaw {
+		t.Errorf("packed frame %+v, want %d facing %v", packed, c.id, want.Yaw)
+	}
+}
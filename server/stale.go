@@ -0,0 +1,46 @@
+package main
+
+import (
+	"maps"
+	"time"
+)
+
+// STATE_TTL stops broadcasting players whose last state (or ping position)
+// is older than this, so someone who went silent but keeps pinging doesn't
+// hang in place forever. With STALE_MARK they're sent marked stale instead.
+// 0 disables this.
+var (
+	stateTTL  = getEnvDuration("STATE_TTL", 0)
+	staleMark = getEnvBool("STALE_MARK", false)
+)
+
+// dropStale returns states without, or with marked, the players silent
+// past STATE_TTL. states itself is left as is.
+func dropStale(states map[uint64]PlayerState, list []*Player, t time.Time) map[uint64]PlayerState {
+	if stateTTL <= 0 {
+		return states
+	}
+	var fresh map[uint64]PlayerState // copied on the first stale player
+	for _, player := range list {
+		player.stateMu.Lock()
+		stale := t.Sub(player.lastState) > stateTTL
+		player.stateMu.Unlock()
+		state, ok := states[player.ID]
+		if !stale || !ok {
+			continue
+		}
+		if fresh == nil {
+			fresh = maps.Clone(states)
+		}
+		if staleMark {
+			state.Stale = true
+			fresh[player.ID] = state
+		} else {
+			delete(fresh, player.ID)
+		}
+	}
+	if fresh == nil {
+		return states
+	}
+	return fresh
+}
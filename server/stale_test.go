@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSilentPlayerDropsOutOfBroadcasts(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &stateTTL, time.Minute)
+	setVar(t, &staleMark, false)
+	observer := joinKey(t, "ttl-observer")
+	active := joinKey(t, "ttl-active")
+	silent := joinKey(t, "ttl-silent")
+	silent.moveTo(1)
+	age := func(c *testClient, d time.Duration) {
+		p := findPlayers(c.id)[0]
+		p.stateMu.Lock()
+		p.lastState = time.Now().Add(-d)
+		p.stateMu.Unlock()
+	}
+	frame := func() map[uint64]PlayerState {
+		broadcastTick()
+		return observer.expect("players").Players
+	}
+
+	age(silent, 2*time.Minute)
+	states := frame()
+	if _, ok := states[silent.id]; ok {
+		t.Error("player silent past the TTL still broadcast")
+	}
+	if _, ok := states[active.id]; !ok {
+		t.Error("active player dropped")
+	}
+
+	staleMark = true
+	if state, ok := frame()[silent.id]; !ok || !state.Stale {
+		t.Errorf("with STALE_MARK: %+v (sent %v), want marked stale", state, ok)
+	}
+
+	staleMark = false
+	silent.moveTo(2)
+	if state, ok := frame()[silent.id]; !ok || state.Stale || state.X != 2 {
+		t.Errorf("after a fresh state: %+v (sent %v), want it back unmarked", state, ok)
+	}
+}
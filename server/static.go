@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Content types for dist assets that the system MIME tables often get
+// wrong or lack. CONTENT_TYPES adds or overrides entries as a
+// comma-separated list of ext=type, e.g. ".glb=model/gltf-binary".
+var contentTypes = parseContentTypes(getEnv("CONTENT_TYPES", ""))
+
+var defaultContentTypes = map[string]string{
+	".wasm": "application/wasm",
+	".glb":  "model/gltf-binary",
+	".gltf": "model/gltf+json",
+	".mjs":  "text/javascript; charset=utf-8",
+}
+
+func parseContentTypes(list string) map[string]string {
+	types := make(map[string]string, len(defaultContentTypes))
+	for ext, typ := range defaultContentTypes {
+		types[ext] = typ
+	}
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		ext, typ, ok := strings.Cut(field, "=")
+		ext, typ = strings.ToLower(strings.TrimSpace(ext)), strings.TrimSpace(typ)
+		if !ok || typ == "" || ext == "" {
+			log.Printf("Ignoring invalid content type %q", field)
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		types[ext] = typ
+	}
+	return types
+}
+
+// withContentType sets the overridden Content-Type for the request's
+// extension; http.FileServer keeps a type that is already set
+func withContentType(w http.ResponseWriter, r *http.Request) {
+	if typ, ok := contentTypes[strings.ToLower(path.Ext(r.URL.Path))]; ok {
+		w.Header().Set("Content-Type", typ)
+	}
+}
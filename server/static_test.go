@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStaticContentTypeOverrides(t *testing.T) {
+	withDist(t, map[string]string{"game.wasm": "\x00asm", "scene.glb": "glTF", "level.dat": "data"})
+	setVar(t, &contentTypes, parseContentTypes("dat=application/x-level, bogus"))
+
+	for path, want := range map[string]string{
+		"/game.wasm": "application/wasm",
+		"/scene.glb": "model/gltf-binary",
+		"/level.dat": "application/x-level",
+	} {
+		rec := serve(httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != want {
+			t.Errorf("GET %s: %d with Content-Type %q, want %q", path, rec.Code, rec.Header().Get("Content-Type"), want)
+		}
+	}
+}
+
+func TestUnknownPathFallsBackOnlyWhenEnabled(t *testing.T) {
+	withDist(t, map[string]string{"index.html": "<html>game</html>", "app.js": "js"})
+
+	for _, tc := range []struct {
+		fallback bool
+		path     string
+		want     int
+	}{
+		{true, "/lobby", http.StatusOK},
+		{false, "/lobby", http.StatusNotFound},
+		{false, "/app.js", http.StatusOK},
+		{false, "/missing.js", http.StatusNotFound},
+	} {
+		setVar(t, &spaFallback, tc.fallback)
+		rec := serve(httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("SPA_FALLBACK=%v GET %s: %d, want %d", tc.fallback, tc.path, rec.Code, tc.want)
+		}
+		if tc.path == "/lobby" && tc.fallback != strings.Contains(rec.Body.String(), "game") {
+			t.Errorf("SPA_FALLBACK=%v GET %s served %q", tc.fallback, tc.path, rec.Body)
+		}
+	}
+}
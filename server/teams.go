@@ -0,0 +1,43 @@
+package main
+
+import "regexp"
+
+var teamNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func validTeam(team string) bool {
+	return teamNamePattern.MatchString(team)
+}
+
+// teamHue derives a team's shared base hue from its name, with the same
+// hash used for public keys
+func teamHue(team string) float64 {
+	var hash uint32
+	for _, b := range []byte(team) {
+		hash = hash*31 + uint32(b)
+	}
+	return float64(hash % 360)
+}
+
+// teamLightness spreads team members over a lightness range so teammates
+// sharing a hue remain distinguishable
+func teamLightness(id uint64) float64 {
+	const steps, lo, hi = 5, 0.4, 0.7
+	return lo + float64(id%steps)*(hi-lo)/(steps-1)
+}
+
+// teamCounts returns the number of connected players per team in each room
+// that has teams
+func teamCounts() map[string]map[string]int {
+	counts := make(map[string]map[string]int)
+	for _, player := range connectedPlayers() {
+		if player.Team == "" {
+			continue
+		}
+		room := player.room.ID
+		if counts[room] == nil {
+			counts[room] = make(map[string]int)
+		}
+		counts[room][player.Team]++
+	}
+	return counts
+}
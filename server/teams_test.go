@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTeammatesShareBaseHue(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &rooms, newRooms("arena", ""))
+	red1 := join(t, `{"type":"hello","publicKey":"red-1","team":"red"}`)
+	red2 := join(t, `{"type":"hello","publicKey":"red-2","team":"red"}`)
+	blue := join(t, `{"type":"hello","publicKey":"blue-1","team":"blue"}`)
+	join(t, `{"type":"hello","publicKey":"red-3","team":"red","roomId":"arena"}`)
+
+	if red1.hue() != teamHue("red") || red2.hue() != red1.hue() {
+		t.Errorf("red hues %v and %v, want both %v", red1.hue(), red2.hue(), teamHue("red"))
+	}
+	if blue.hue() == red1.hue() {
+		t.Errorf("blue shares red's hue %v", blue.hue())
+	}
+	if red1.welcome.Team != "red" {
+		t.Errorf("welcomed to team %q, want red", red1.welcome.Team)
+	}
+
+	broadcastTick()
+	if state := red1.expect("players").Players[red2.id]; state.Team != "red" {
+		t.Errorf("teammate broadcast with team %q, want red", state.Team)
+	}
+
+	counts := teamCounts()
+	if counts[mainRoomID]["red"] != 2 || counts[mainRoomID]["blue"] != 1 || counts["arena"]["red"] != 1 {
+		t.Errorf("team counts = %v", counts)
+	}
+}
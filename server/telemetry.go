@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TelemetryEvent is one message on /admin/ws, the operator channel that
+// keeps build logs, metrics and audit events off the player socket
+type TelemetryEvent struct {
+	Type    string        `json:"type"` // buildLog, build, metrics or audit
+	Time    time.Time     `json:"time"`
+	Line    string        `json:"line,omitempty"`
+	Build   *BuildRecord  `json:"build,omitempty"`
+	Metrics *MetricsDelta `json:"metrics,omitempty"`
+	Audit   *AuditEntry   `json:"audit,omitempty"`
+}
+
+// MetricsDelta is the change in counters since the previous metrics event
+type MetricsDelta struct {
+	Players  int               `json:"players"`
+	Inbound  map[string]uint64 `json:"inbound,omitempty"`
+	Outbound map[string]uint64 `json:"outbound,omitempty"`
+	Skipped  uint64            `json:"skippedFrames,omitempty"`
+	Dropped  uint64            `json:"droppedFrames,omitempty"`
+	Leaves   map[string]uint64 `json:"disconnects,omitempty"`
+}
+
+// ADMIN_WS_LOCAL_ONLY only accepts /admin/ws from loopback addresses, e.g.
+// for an SSH tunnel. It checks the socket's address, not forwarded headers.
+var (
+	adminWSLocalOnly       = getEnvBool("ADMIN_WS_LOCAL_ONLY", false)
+	adminWSMetricsInterval = positiveDuration(getEnvDuration("ADMIN_WS_METRICS_INTERVAL", 5*time.Second), 5*time.Second)
+)
+
+// Events queued per watcher; a watcher that falls behind misses events
+// rather than slowing down builds or admin requests
+const telemetryQueueSize = 64
+
+var (
+	telemetryMu   sync.Mutex
+	telemetrySubs = make(map[chan TelemetryEvent]struct{})
+)
+
+func publishTelemetry(ev TelemetryEvent) {
+	ev.Time = time.Now().UTC()
+	telemetryMu.Lock()
+	defer telemetryMu.Unlock()
+	for ch := range telemetrySubs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func subscribeTelemetry() (<-chan TelemetryEvent, func()) {
+	ch := make(chan TelemetryEvent, telemetryQueueSize)
+	telemetryMu.Lock()
+	telemetrySubs[ch] = struct{}{}
+	telemetryMu.Unlock()
+	return ch, func() {
+		telemetryMu.Lock()
+		delete(telemetrySubs, ch)
+		telemetryMu.Unlock()
+	}
+}
+
+func metricsDelta(cur, prev Metrics) *MetricsDelta {
+	return &MetricsDelta{
+		Players:  cur.Players,
+		Inbound:  counterDelta(cur.Inbound, prev.Inbound),
+		Outbound: counterDelta(cur.Outbound, prev.Outbound),
+		Skipped:  cur.Skipped - prev.Skipped,
+		Dropped:  cur.Dropped - prev.Dropped,
+		Leaves:   counterDelta(cur.Leaves, prev.Leaves),
+	}
+}
+
+// counterDelta returns the counters that grew, by how much
+func counterDelta(cur, prev map[string]uint64) map[string]uint64 {
+	var delta map[string]uint64
+	for k, v := range cur {
+		if v > prev[k] {
+			if delta == nil {
+				delta = make(map[string]uint64)
+			}
+			delta[k] = v - prev[k]
+		}
+	}
+	return delta
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminWSHandler streams telemetry events, plus a metrics delta every
+// ADMIN_WS_METRICS_INTERVAL, until the watcher disconnects
+func adminWSHandler(w http.ResponseWriter, r *http.Request) {
+	if adminWSLocalOnly && !isLoopback(r.RemoteAddr) {
+		apiError(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !requireAdmin(w, r, scopeRead) {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Admin WebSocket upgrade from %s failed: %v", clientIP(r), err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("Admin %s watching telemetry from %s", adminIdentity(r), clientIP(r))
+
+	events, unsubscribe := subscribeTelemetry()
+	defer unsubscribe()
+
+	// nothing is expected from the watcher; reading notices it leaving
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(adminWSMetricsInterval)
+	defer ticker.Stop()
+	prev := collectMetrics()
+	for {
+		var ev TelemetryEvent
+		select {
+		case <-closed:
+			return
+		case ev = <-events:
+		case <-ticker.C:
+			cur := collectMetrics()
+			ev = TelemetryEvent{Type: "metrics", Time: time.Now().UTC(), Metrics: metricsDelta(cur, prev)}
+			prev = cur
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteJSON(ev); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminWebSocketStreamsTelemetry(t *testing.T) {
+	resetPlayers(t)
+	withAdmin(t)
+	setVar(t, &announcements, nil)
+	setVar(t, &auditFile, "")
+	setVar(t, &adminWSMetricsInterval, 20*time.Millisecond)
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/admin/ws"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without a token: %v, want 401", err)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer wrong"}}); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("with a wrong token: %v, want 401", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + testAdminToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	next := func(typ string) TelemetryEvent {
+		t.Helper()
+		for {
+			var ev TelemetryEvent
+			if err := conn.ReadJSON(&ev); err != nil {
+				t.Fatalf("waiting for %s: %v", typ, err)
+			}
+			if ev.Type == typ {
+				return ev
+			}
+		}
+	}
+
+	// a metrics event means the watcher is subscribed
+	if ev := next("metrics"); ev.Metrics == nil {
+		t.Error("metrics event without a delta")
+	}
+	adminDo(http.MethodPost, "/admin/announce", `{"text":"watch this"}`)
+	ev := next("audit")
+	if ev.Audit == nil || ev.Audit.Action != "announce" || ev.Audit.Admin != "tester" {
+		t.Errorf("audit event %+v, want an announce by tester", ev.Audit)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"maps"
+	"time"
+)
+
+// With WARMUP, new players start out warming: they get the snapshot and
+// broadcasts and may send state, but aren't shown to others until they
+// send "ready" (once their assets have loaded), or WARMUP_TIMEOUT passes.
+var (
+	warmup        = getEnvBool("WARMUP", false)
+	warmupTimeout = positiveDuration(getEnvDuration("WARMUP_TIMEOUT", 10*time.Second), 10*time.Second)
+)
+
+// isReady reports whether p is shown to other players
+func (p *Player) isReady() bool {
+	return !warmup || p.ready.Load() || time.Since(p.joined) > warmupTimeout
+}
+
+// withoutWarming returns states without the players still warming up.
+// states itself is left as is.
+func withoutWarming(states map[uint64]PlayerState, list []*Player) map[uint64]PlayerState {
+	var ready map[uint64]PlayerState // copied on the first warming player
+	for _, player := range list {
+		if player.isReady() {
+			continue
+		}
+		if ready == nil {
+			ready = maps.Clone(states)
+		}
+		delete(ready, player.ID)
+	}
+	if ready == nil {
+		return states
+	}
+	return ready
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWarmingPlayerHiddenUntilReady(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &warmup, true)
+	setVar(t, &warmupTimeout, time.Minute)
+	ready := func(c *testClient) {
+		c.send(`{"type":"ready"}`)
+		c.send(`{"type":"ping"}`)
+		c.expect("pong")
+	}
+	observer, peer := joinKey(t, "warm-observer"), joinKey(t, "warm-peer")
+	ready(observer)
+	ready(peer)
+	newcomer := joinKey(t, "warm-newcomer")
+	newcomer.moveTo(5)
+
+	broadcastTick()
+	states := observer.expect("players").Players
+	if _, ok := states[newcomer.id]; ok {
+		t.Error("warming player broadcast before ready")
+	}
+	if _, ok := states[peer.id]; !ok {
+		t.Error("ready player missing")
+	}
+	// the newcomer already sees everyone else
+	if states := newcomer.expect("players").Players; len(states) != 2 {
+		t.Errorf("warming player's frame has %d players, want 2", len(states))
+	}
+
+	ready(newcomer)
+	broadcastTick()
+	if state, ok := observer.expect("players").Players[newcomer.id]; !ok || state.X != 5 {
+		t.Errorf("after ready: %+v (sent %v), want x=5", state, ok)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The world seed lets clients that generate the world procedurally all
+// render the same one. WORLD_SEED pins it; otherwise a random seed is
+// generated and persisted to WORLD_SEED_FILE (if set), and reused across
+// restarts until it is older than WORLD_SEED_WINDOW (0 = forever).
+var (
+	worldSeedFile   = os.Getenv("WORLD_SEED_FILE")
+	worldSeedWindow = getEnvDuration("WORLD_SEED_WINDOW", 24*time.Hour)
+	worldSeed       = loadWorldSeed()
+)
+
+// WorldSeed is the persisted seed and when it was generated. Seeds stay
+// within 32 bits so JavaScript clients read them exactly.
+type WorldSeed struct {
+	Seed    uint32    `json:"seed"`
+	Created time.Time `json:"created"`
+}
+
+func loadWorldSeed() uint32 {
+	if value := os.Getenv("WORLD_SEED"); value != "" {
+		seed, err := strconv.ParseUint(value, 10, 32)
+		if err == nil {
+			return uint32(seed)
+		}
+		log.Printf("Invalid WORLD_SEED=%q, generating one", value)
+	}
+
+	if worldSeedFile != "" {
+		var saved WorldSeed
+		data, err := os.ReadFile(worldSeedFile)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, &saved); err != nil {
+				log.Printf("Failed to parse %s: %v", worldSeedFile, err)
+			} else if worldSeedWindow <= 0 || time.Since(saved.Created) < worldSeedWindow {
+				return saved.Seed
+			}
+		case !os.IsNotExist(err):
+			log.Printf("Failed to load world seed: %v", err)
+		}
+	}
+
+	seed := WorldSeed{Seed: rand.Uint32(), Created: time.Now().UTC()}
+	if worldSeedFile != "" {
+		data, _ := json.Marshal(seed)
+		if err := os.WriteFile(worldSeedFile, data, 0644); err != nil {
+			log.Printf("Failed to save world seed: %v", err)
+		}
+	}
+	log.Printf("World seed: %d", seed.Seed)
+	return seed.Seed
+}
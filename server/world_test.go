@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJoinersShareWorldSeed(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &worldSeed, 424242)
+	a, b := joinKey(t, "seed-a"), joinKey(t, "seed-b")
+	if a.welcome.Config.WorldSeed != 424242 || b.welcome.Config.WorldSeed != 424242 {
+		t.Errorf("seeds %d and %d, want both 424242", a.welcome.Config.WorldSeed, b.welcome.Config.WorldSeed)
+	}
+}
+
+func TestWorldSeedSurvivesRestartWithinWindow(t *testing.T) {
+	t.Setenv("WORLD_SEED", "")
+	setVar(t, &worldSeedFile, filepath.Join(t.TempDir(), "seed.json"))
+	setVar(t, &worldSeedWindow, time.Hour)
+
+	first := loadWorldSeed()
+	if again := loadWorldSeed(); again != first {
+		t.Errorf("restart got seed %d, want the saved %d", again, first)
+	}
+	worldSeedWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if fresh := loadWorldSeed(); fresh == first {
+		t.Errorf("seed %d kept past its window", fresh)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// WORLD_STATS_INTERVAL broadcasts aggregate stats ("42 online, ping 30ms")
+// to everyone this often; 0 disables them
+var worldStatsInterval = getEnvDuration("WORLD_STATS_INTERVAL", 0)
+
+// measureRTT enables the WebSocket pings that time each player's round trip
+func measureRTT() bool {
+	return latencyCompensation || worldStatsInterval > 0
+}
+
+// WorldStats is the worldStats payload. RTT figures cover the players
+// measured so far and are 0 before any are. Rooms counts the players of
+// each room that has any.
+type WorldStats struct {
+	Players     int            `json:"players"`
+	ActiveRooms int            `json:"activeRooms"`
+	Rooms       map[string]int `json:"rooms"`
+	AvgRTTMs    int64          `json:"avgRttMs"`
+	P50RTTMs    int64          `json:"p50RttMs"`
+	P95RTTMs    int64          `json:"p95RttMs"`
+}
+
+func collectWorldStats(list []*Player) WorldStats {
+	stats := WorldStats{Players: len(list), Rooms: make(map[string]int)}
+	var rtts []time.Duration
+	for _, player := range list {
+		stats.Rooms[player.room.ID]++
+		if rtt := time.Duration(player.rtt.Load()); rtt > 0 {
+			rtts = append(rtts, rtt)
+		}
+	}
+	stats.ActiveRooms = len(stats.Rooms)
+	if len(rtts) == 0 {
+		return stats
+	}
+	slices.Sort(rtts)
+	var total time.Duration
+	for _, rtt := range rtts {
+		total += rtt
+	}
+	stats.AvgRTTMs = (total / time.Duration(len(rtts))).Milliseconds()
+	stats.P50RTTMs = rtts[len(rtts)*50/100].Milliseconds()
+	stats.P95RTTMs = rtts[len(rtts)*95/100].Milliseconds()
+	return stats
+}
+
+func broadcastWorldStats() {
+	for {
+		time.Sleep(worldStatsInterval)
+		sendWorldStats()
+	}
+}
+
+// sendWorldStats sends everyone the current stats
+func sendWorldStats() {
+	list := connectedPlayers()
+	if len(list) == 0 {
+		return
+	}
+	stats := collectWorldStats(list)
+	sendAll(list, WSMessage{Type: "worldStats", Stats: &stats})
+}
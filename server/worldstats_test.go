@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorldStatsBroadcast(t *testing.T) {
+	resetPlayers(t)
+	setVar(t, &rooms, newRooms("arena", ""))
+	a, b := joinKey(t, "stats-a"), joinKey(t, "stats-b")
+	c := joinRoom(t, "stats-c", "arena")
+	for client, rtt := range map[*testClient]time.Duration{a: 20 * time.Millisecond, b: 40 * time.Millisecond, c: 90 * time.Millisecond} {
+		findPlayers(client.id)[0].rtt.Store(int64(rtt))
+	}
+
+	sendWorldStats()
+	for _, client := range []*testClient{a, b, c} {
+		msg := client.expect("worldStats")
+		if msg.Stats == nil {
+			t.Fatal("worldStats without stats")
+		}
+		s := *msg.Stats
+		if s.Players != 3 || s.ActiveRooms != 2 || s.Rooms[mainRoomID] != 2 || s.Rooms["arena"] != 1 {
+			t.Errorf("counts %+v, want 3 players over main (2) and arena (1)", s)
+		}
+		if s.AvgRTTMs != 50 || s.P50RTTMs != 40 || s.P95RTTMs != 90 {
+			t.Errorf("rtt avg %d, p50 %d, p95 %d; want 50, 40, 90", s.AvgRTTMs, s.P50RTTMs, s.P95RTTMs)
+		}
+	}
+}